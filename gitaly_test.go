@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -25,6 +26,7 @@ import (
 	"google.golang.org/grpc/codes"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
@@ -228,6 +230,83 @@ func TestPostReceivePackProxiedToGitalyInterrupted(t *testing.T) {
 	}
 }
 
+func TestPostReceivePackProxiedToGitalyTooLarge(t *testing.T) {
+	apiResponse := gitOkBody(t)
+	apiResponse.MaxPushSize = 1024
+
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse.GitalyServer.Address = "unix://" + socketPath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	commands := gitPktLine("0000000000000000000000000000000000000000 1e292f8fedd741b75372e19097c76d327140c312 refs/heads/master\x00report-status side-band-64k\n") + "0000"
+	pack := "PACK" + strings.Repeat("x", 2048)
+	report := gitPktLine("unpack push too large\n") + gitPktLine("ng refs/heads/master push too large\n") + "0000"
+	expected := gitPktLine("\x02Your push is larger than the limit of 1024 bytes for this project.\n") + gitPktLine("\x01"+report) + "0000"
+
+	for _, tc := range []struct {
+		desc string
+		body io.Reader
+	}{
+		{desc: "with Content-Length", body: strings.NewReader(commands + pack)},
+		// Hide the length of the body so that it gets sent chunked
+		{desc: "chunked", body: io.MultiReader(strings.NewReader(commands), strings.NewReader(pack))},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			resource := "/gitlab-org/gitlab-test.git/git-receive-pack"
+			resp, err := http.Post(ws.URL+resource, "application/x-git-receive-pack-request", tc.body)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, 200, resp.StatusCode, "POST %q", resource)
+			require.Equal(t, expected, string(body))
+		})
+	}
+}
+
+func TestPostReceivePackProxiedToGitalyInspected(t *testing.T) {
+	apiResponse := gitOkBody(t)
+	apiResponse.MaxBlobSize = 100 * 1024
+
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse.GitalyServer.Address = "unix://" + socketPath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	cfg := newUpstreamConfig(ts.URL)
+	cfg.PushInspection = &config.PushInspectionConfig{}
+	ws := startWorkhorseServerWithConfig(cfg)
+	defer ws.Close()
+
+	body, err := ioutil.ReadFile(path.Join(testhelper.RootDir(), "testdata/receive-pack-inspection-fixture.txt"))
+	require.NoError(t, err)
+
+	resource := "/gitlab-org/gitlab-test.git/git-receive-pack"
+	resp, err := http.Post(ws.URL+resource, "application/x-git-receive-pack-request", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, 200, resp.StatusCode, "POST %q", resource)
+	require.Contains(t, string(response), "assets/big.bin in commit 23bcfd03 is 204800 bytes")
+	require.Contains(t, string(response), "config/deploy.key in commit de7919a5 contains a possible private key")
+
+	report := gitPktLine("unpack secret detected\n") + gitPktLine("ng refs/heads/inspection secret detected\n") + "0000"
+	require.True(t, strings.HasSuffix(string(response), gitPktLine("\x01"+report)+"0000"), "report-status in sideband")
+}
+
 func TestPostUploadPackProxiedToGitalySuccessfully(t *testing.T) {
 	for i, tc := range []struct {
 		showAllRefs bool
@@ -327,6 +406,44 @@ func TestPostUploadPackProxiedToGitalyInterrupted(t *testing.T) {
 	}
 }
 
+func TestPostUploadPackProxiedToGitalyRequestTooLarge(t *testing.T) {
+	apiResponse := gitOkBody(t)
+
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse.GitalyServer.Address = "unix://" + socketPath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	cfg := newUpstreamConfig(ts.URL)
+	cfg.UploadPackRequestLimit = 1024
+	ws := startWorkhorseServerWithConfig(cfg)
+	defer ws.Close()
+
+	// The wants fit into the limit, the haves streamed after them do not
+	body := gitPktLine("want 1e292f8fedd741b75372e19097c76d327140c312\n") + "0000"
+	for len(body) <= 2*1024 {
+		body += gitPktLine("have 6907208d755b60ebeacb2e9dfea74c92c3449a1f\n")
+	}
+	body += gitPktLine("done\n")
+
+	resource := "/gitlab-org/gitlab-test.git/git-upload-pack"
+	resp, err := http.Post(ws.URL+resource, "application/x-git-upload-pack-request", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, 200, resp.StatusCode, "POST %q", resource)
+	require.Equal(t, gitPktLine("ERR upload-pack request is larger than 1024 bytes\n"), string(response))
+}
+
+func gitPktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
 func TestGetBlobProxiedToGitalySuccessfully(t *testing.T) {
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
 	defer gitalyServer.Stop()
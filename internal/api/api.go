@@ -11,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
 
@@ -18,6 +20,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tracing"
 )
 
 const (
@@ -34,6 +37,16 @@ type API struct {
 	Client  *http.Client
 	URL     *url.URL
 	Version string
+	// AuthFailureLimiter is optional. When set, PreAuthorizeHandler reports
+	// 401 and 403 responses from Rails to it and rejects blocked clients.
+	AuthFailureLimiter AuthFailureLimiter
+}
+
+// AuthFailureLimiter keeps track of authentication failures per client
+type AuthFailureLimiter interface {
+	Blocked(r *http.Request) bool
+	RecordFailure(r *http.Request)
+	RetryAfter() string
 }
 
 var (
@@ -78,6 +91,19 @@ type MultipartUploadParams struct {
 	AbortURL string
 }
 
+// ClonePolicy restricts expensive upload-pack requests for a repository
+type ClonePolicy struct {
+	// RequireFilterOrDepth rejects full clones that use neither a partial
+	// clone filter nor a depth limit
+	RequireFilterOrDepth bool
+	// QueueShallowFetches sends shallow fetches through the shallow fetch
+	// queue of the [clone_policy] config section
+	QueueShallowFetches bool
+	// MaxConcurrentFullClones limits full clones running at the same time
+	// per repository. 0 means no limit.
+	MaxConcurrentFullClones int
+}
+
 type RemoteObject struct {
 	// GetURL is an S3 GetObject URL
 	GetURL string
@@ -97,6 +123,21 @@ type RemoteObject struct {
 	MultipartUpload *MultipartUploadParams
 }
 
+// GitBundle is a pre-generated Git bundle of a repository that clients
+// download before they fetch the rest through upload-pack
+type GitBundle struct {
+	// ID names the bundle in the bundle list and in its download URL
+	ID string
+	// Path is the bundle file on disk, e.g. in the archive cache directory
+	Path string
+	// URL is the bundle in object storage. It is used when Path is empty.
+	URL string
+	// Redirect sends clients to URL instead of streaming it through workhorse
+	Redirect bool
+	// CreationToken orders incremental bundles. 0 means none.
+	CreationToken int64
+}
+
 type Response struct {
 	// GL_ID is an environment variable used by gitlab-shell hooks during 'git
 	// push' and 'git pull'
@@ -139,6 +180,22 @@ type Response struct {
 	Repository pb.Repository
 	// For git-http, does the requestor have the right to view all refs?
 	ShowAllRefs bool
+	// RepositorySizeClass selects the clone policy for upload-pack requests
+	// from the [clone_policy.size_class] sections of the config file
+	RepositorySizeClass string
+	// ClonePolicy overrides the policy of RepositorySizeClass
+	ClonePolicy *ClonePolicy
+	// MaxPushSize is the maximum size in bytes of a git-receive-pack
+	// request. 0 means unlimited.
+	MaxPushSize int64
+	// MaxBlobSize is the maximum size in bytes of a blob in a push that is
+	// inspected by workhorse. 0 means unlimited.
+	MaxBlobSize int64
+	// Bundles are advertised to protocol v2 clients through the bundle-uri
+	// capability, and served to them by workhorse
+	Bundles []GitBundle
+	// DisableInfoRefsCache turns off the info/refs cache for the repository
+	DisableInfoRefsCache bool
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
@@ -227,10 +284,17 @@ func (api *API) newRequest(r *http.Request, body io.Reader, suffix string) (*htt
 //
 // authResponse will only be present if the authorization check was successful
 func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http.Response, authResponse *Response, outErr error) {
+	span, _ := opentracing.StartSpanFromContext(r.Context(), "rails.preauthorize")
+	ext.SpanKindRPCClient.Set(span)
+	defer func() { tracing.FinishWithError(span, outErr) }()
+
 	authReq, err := api.newRequest(r, nil, suffix)
 	if err != nil {
 		return nil, nil, fmt.Errorf("preAuthorizeHandler newUpstreamRequest: %v", err)
 	}
+	ext.HTTPMethod.Set(span, authReq.Method)
+	ext.HTTPUrl.Set(span, helper.ScrubURLParams(authReq.URL.String()))
+	tracing.InjectRequestHeaders(span, authReq)
 
 	httpResponse, err = api.doRequestWithoutRedirects(authReq)
 	if err != nil {
@@ -243,6 +307,7 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 		}
 	}()
 	requestsCounter.WithLabelValues(strconv.Itoa(httpResponse.StatusCode), authReq.Method).Inc()
+	ext.HTTPStatusCode.Set(span, uint16(httpResponse.StatusCode))
 
 	// This may be a false positive, e.g. for .../info/refs, rather than a
 	// failure, so pass the response back
@@ -263,6 +328,12 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 
 func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter := api.AuthFailureLimiter; limiter != nil && limiter.Blocked(r) {
+			w.Header().Set("Retry-After", limiter.RetryAfter())
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
 		httpResponse, authResponse, err := api.PreAuthorize(suffix, r)
 		if httpResponse != nil {
 			defer httpResponse.Body.Close()
@@ -273,6 +344,10 @@ func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler
 			return
 		}
 
+		if api.AuthFailureLimiter != nil && isAuthFailure(r, httpResponse.StatusCode) {
+			api.AuthFailureLimiter.RecordFailure(r)
+		}
+
 		// The response couldn't be interpreted as a valid auth response, so
 		// pass it back (mostly) unmodified
 		if httpResponse != nil && authResponse == nil {
@@ -288,6 +363,31 @@ func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler
 	})
 }
 
+// isAuthFailure tells whether Rails rejected the credentials of r. Git
+// sends its first request without credentials and retries with them after
+// a 401, and a 403 only means the user may not access the project, so
+// neither is a failed login.
+func isAuthFailure(r *http.Request, statusCode int) bool {
+	return statusCode == http.StatusUnauthorized && hasCredentials(r)
+}
+
+var credentialParams = []string{"private_token", "access_token", "job_token"}
+
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	query := r.URL.Query()
+	for _, param := range credentialParams {
+		if query.Get(param) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (api *API) doRequestWithoutRedirects(authReq *http.Request) (*http.Response, error) {
 	return api.Client.Transport.RoundTrip(authReq)
 }
@@ -0,0 +1,209 @@
+/*
+Package bruteforce counts authentication failures reported by Rails per
+client IP and per attempted username. Clients that fail too often within a
+sliding window are answered with HTTP 429 by gitlab-workhorse itself until
+a cool-down period has passed, so that password spraying over Git HTTP no
+longer reaches Rails on every attempt.
+*/
+package bruteforce
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	DefaultMaxFailures = 10
+	DefaultWindow      = 1 * time.Minute
+	DefaultCooldown    = 1 * time.Hour
+
+	keyTypeIP       = "ip"
+	keyTypeUsername = "username"
+)
+
+var (
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_bruteforce_auth_failures",
+			Help: "How many authentication failures returned by the auth backend have been counted, partitioned by key type.",
+		},
+		[]string{"type"},
+	)
+	blocksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_bruteforce_blocks",
+			Help: "How many times a client IP or username has been blocked after too many authentication failures, partitioned by key type.",
+		},
+		[]string{"type"},
+	)
+	rejectedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_bruteforce_rejected_requests",
+			Help: "How many requests have been answered with 429 because the client IP or username is blocked.",
+		},
+	)
+	storeErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_bruteforce_store_errors",
+			Help: "How many times the brute-force protection state could not be read or updated.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		authFailures,
+		blocksTotal,
+		rejectedRequests,
+		storeErrors,
+	)
+}
+
+// store keeps failure counts and blocks. Implementations must be safe for
+// concurrent use.
+type store interface {
+	// addFailure records a failure for key at now and returns the number
+	// of failures recorded for key within the window ending at now.
+	addFailure(key string, now time.Time, window time.Duration) (int, error)
+	block(key string, now time.Time, cooldown time.Duration) error
+	isBlocked(key string, now time.Time) (bool, error)
+}
+
+// Limiter implements api.AuthFailureLimiter
+type Limiter struct {
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+	allowlist   []*net.IPNet
+	store       store
+	clock       func() time.Time
+}
+
+// NewLimiter creates a Limiter from cfg. The limiter keeps its state in
+// Redis when cfg.Shared is set, and in process memory otherwise.
+func NewLimiter(cfg *config.BruteForceConfig) (*Limiter, error) {
+	l := &Limiter{
+		maxFailures: DefaultMaxFailures,
+		window:      DefaultWindow,
+		cooldown:    DefaultCooldown,
+		clock:       time.Now,
+	}
+
+	if cfg.MaxFailures > 0 {
+		l.maxFailures = cfg.MaxFailures
+	}
+	if cfg.Window != nil {
+		l.window = cfg.Window.Duration
+	}
+	if cfg.Cooldown != nil {
+		l.cooldown = cfg.Cooldown.Duration
+	}
+
+	allowlist, err := helper.ParseNetworks(cfg.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("bruteforce: allowlist: %v", err)
+	}
+	l.allowlist = allowlist
+
+	if cfg.Shared {
+		l.store = &redisStore{}
+	} else {
+		l.store = newMemoryStore()
+	}
+
+	return l, nil
+}
+
+// Blocked reports whether r should be rejected without asking Rails
+func (l *Limiter) Blocked(r *http.Request) bool {
+	keys := l.keys(r)
+	now := l.clock()
+
+	for _, key := range keys {
+		blocked, err := l.store.isBlocked(key, now)
+		if err != nil {
+			l.logStoreError(r, err)
+			continue
+		}
+		if blocked {
+			rejectedRequests.Inc()
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecordFailure counts an authentication failure returned by Rails for r
+func (l *Limiter) RecordFailure(r *http.Request) {
+	now := l.clock()
+
+	for _, key := range l.keys(r) {
+		keyType := strings.SplitN(key, ":", 2)[0]
+		authFailures.WithLabelValues(keyType).Inc()
+
+		count, err := l.store.addFailure(key, now, l.window)
+		if err != nil {
+			l.logStoreError(r, err)
+			continue
+		}
+		if count < l.maxFailures {
+			continue
+		}
+
+		if err := l.store.block(key, now, l.cooldown); err != nil {
+			l.logStoreError(r, err)
+			continue
+		}
+
+		blocksTotal.WithLabelValues(keyType).Inc()
+		log.WithFields(r.Context(), log.Fields{
+			"key":      key,
+			"failures": count,
+			"cooldown": l.cooldown.String(),
+		}).Warning("bruteforce: too many authentication failures, blocking")
+	}
+}
+
+// RetryAfter is the value of the Retry-After header sent with 429 responses
+func (l *Limiter) RetryAfter() string {
+	return strconv.Itoa(int(l.cooldown.Seconds()))
+}
+
+func (l *Limiter) keys(r *http.Request) []string {
+	ip := clientIP(r)
+	if ip == nil || helper.NetworksContain(l.allowlist, ip) {
+		return nil
+	}
+
+	keys := []string{keyTypeIP + ":" + ip.String()}
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		keys = append(keys, keyTypeUsername+":"+strings.ToLower(username))
+	}
+
+	return keys
+}
+
+func (l *Limiter) logStoreError(r *http.Request, err error) {
+	storeErrors.Inc()
+	log.WithError(r.Context(), err).Error("bruteforce: store")
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,180 @@
+package bruteforce
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/badgateway"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time                 { return c.now }
+func (c *fakeClock) Advance(d time.Duration)        { c.now = c.now.Add(d) }
+func duration(d time.Duration) *config.TomlDuration { return &config.TomlDuration{Duration: d} }
+
+func newTestLimiter(t *testing.T, cfg *config.BruteForceConfig) (*Limiter, *fakeClock) {
+	l, err := NewLimiter(cfg)
+	require.NoError(t, err)
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	l.clock = clock.Now
+
+	return l, clock
+}
+
+func newRequest(remoteAddr, username string) *http.Request {
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-upload-pack", nil)
+	r.RemoteAddr = remoteAddr
+	if username != "" {
+		r.SetBasicAuth(username, "password")
+	}
+	return r
+}
+
+func TestBlocksIPAfterMaxFailures(t *testing.T) {
+	l, _ := newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 3})
+	r := newRequest("1.2.3.4:5678", "")
+
+	for i := 0; i < 2; i++ {
+		l.RecordFailure(r)
+		require.False(t, l.Blocked(r), "blocked after %d failures", i+1)
+	}
+
+	l.RecordFailure(r)
+	require.True(t, l.Blocked(r))
+	require.False(t, l.Blocked(newRequest("1.2.3.5:5678", "")), "other IPs must not be blocked")
+}
+
+func TestBlocksUsernameAcrossIPs(t *testing.T) {
+	l, _ := newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 3})
+
+	l.RecordFailure(newRequest("1.2.3.4:5678", "alice"))
+	l.RecordFailure(newRequest("1.2.3.5:5678", "Alice"))
+	l.RecordFailure(newRequest("1.2.3.6:5678", "ALICE"))
+
+	require.True(t, l.Blocked(newRequest("1.2.3.7:5678", "alice")))
+	require.False(t, l.Blocked(newRequest("1.2.3.7:5678", "bob")))
+}
+
+func TestFailuresExpireAfterWindow(t *testing.T) {
+	l, clock := newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 2, Window: duration(time.Minute)})
+	r := newRequest("1.2.3.4:5678", "")
+
+	l.RecordFailure(r)
+	clock.Advance(2 * time.Minute)
+	l.RecordFailure(r)
+
+	require.False(t, l.Blocked(r))
+}
+
+func TestBlockEndsAfterCooldown(t *testing.T) {
+	l, clock := newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 1, Cooldown: duration(time.Hour)})
+	r := newRequest("1.2.3.4:5678", "")
+
+	l.RecordFailure(r)
+	require.True(t, l.Blocked(r))
+
+	clock.Advance(time.Hour)
+	require.False(t, l.Blocked(r))
+}
+
+func TestAllowlist(t *testing.T) {
+	l, _ := newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 1, Allowlist: []string{"10.0.0.0/8", "192.168.1.1"}})
+
+	for _, addr := range []string{"10.1.2.3:1234", "192.168.1.1:1234"} {
+		r := newRequest(addr, "alice")
+		l.RecordFailure(r)
+		require.False(t, l.Blocked(r), "%s should be allowlisted", addr)
+	}
+
+	r := newRequest("192.168.1.2:1234", "alice")
+	l.RecordFailure(r)
+	require.True(t, l.Blocked(r))
+}
+
+func TestInvalidAllowlist(t *testing.T) {
+	_, err := NewLimiter(&config.BruteForceConfig{Allowlist: []string{"not-an-ip"}})
+	require.Error(t, err)
+}
+
+func TestPreAuthorizeHandlerAnswers429WhenBlocked(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	railsRequests := 0
+	ts := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		railsRequests++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	myAPI := api.NewAPI(backend, "123", badgateway.TestRoundTripper(backend))
+	myAPI.AuthFailureLimiter, _ = newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 2})
+
+	h := myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		t.Fatal("request should not be authorized")
+	}, "")
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("1.2.3.4:5678", "alice"))
+		codes = append(codes, w.Code)
+	}
+
+	require.Equal(t, []int{401, 401, 429}, codes)
+	require.Equal(t, 2, railsRequests)
+}
+
+func TestPreAuthorizeHandlerCountsOnlyRejectedCredentials(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	status := http.StatusUnauthorized
+	ts := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	myAPI := api.NewAPI(backend, "123", badgateway.TestRoundTripper(backend))
+	myAPI.AuthFailureLimiter, _ = newTestLimiter(t, &config.BruteForceConfig{MaxFailures: 2})
+
+	h := myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		t.Fatal("request should not be authorized")
+	}, "")
+
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Git asks without credentials first
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 401, serve(newRequest("1.2.3.4:5678", "")))
+	}
+
+	// Permission denials are not failed logins
+	status = http.StatusForbidden
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 403, serve(newRequest("1.2.3.4:5678", "alice")))
+	}
+
+	status = http.StatusUnauthorized
+	withToken := newRequest("1.2.3.4:5678", "")
+	withToken.URL.RawQuery = "private_token=wrong"
+	require.Equal(t, 401, serve(withToken))
+	require.Equal(t, 401, serve(newRequest("1.2.3.4:5678", "alice")))
+	require.Equal(t, 429, serve(newRequest("1.2.3.4:5678", "")))
+}
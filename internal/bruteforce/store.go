@@ -0,0 +1,174 @@
+package bruteforce
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	redisKeyPrefix = "workhorse:bruteforce:"
+	// Entries in memoryStore are only swept this often, so that
+	// addFailure stays cheap while an attack is going on.
+	memorySweepInterval = time.Minute
+)
+
+type memoryStore struct {
+	sync.Mutex
+	failures  map[string][]time.Time
+	blocked   map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		failures: make(map[string][]time.Time),
+		blocked:  make(map[string]time.Time),
+	}
+}
+
+func (s *memoryStore) addFailure(key string, now time.Time, window time.Duration) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sweep(now, window)
+
+	failures := append(recentFailures(s.failures[key], now, window), now)
+	s.failures[key] = failures
+
+	return len(failures), nil
+}
+
+func (s *memoryStore) block(key string, now time.Time, cooldown time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.blocked[key] = now.Add(cooldown)
+	delete(s.failures, key)
+
+	return nil
+}
+
+func (s *memoryStore) isBlocked(key string, now time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	until, ok := s.blocked[key]
+	if !ok {
+		return false, nil
+	}
+
+	if !now.Before(until) {
+		delete(s.blocked, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// sweep drops expired entries so that the maps do not grow without bound
+func (s *memoryStore) sweep(now time.Time, window time.Duration) {
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, failures := range s.failures {
+		if recent := recentFailures(failures, now, window); len(recent) > 0 {
+			s.failures[key] = recent
+		} else {
+			delete(s.failures, key)
+		}
+	}
+
+	for key, until := range s.blocked {
+		if !now.Before(until) {
+			delete(s.blocked, key)
+		}
+	}
+}
+
+func recentFailures(failures []time.Time, now time.Time, window time.Duration) []time.Time {
+	cutoff := now.Add(-window)
+	for i, t := range failures {
+		if t.After(cutoff) {
+			return failures[i:]
+		}
+	}
+
+	return nil
+}
+
+// redisStore shares failure counts and blocks between all workhorse
+// processes. Failures are kept in one sorted set per key, scored by time.
+type redisStore struct{}
+
+func (s *redisStore) addFailure(key string, now time.Time, window time.Duration) (int, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return 0, fmt.Errorf("redis: could not get connection from pool")
+	}
+	defer conn.Close()
+
+	redisKey := redisKeyPrefix + "failures:" + key
+	nowNano := now.UnixNano()
+
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", redisKey, "-inf", nowNano-window.Nanoseconds())
+	conn.Send("ZADD", redisKey, nowNano, nowNano)
+	conn.Send("ZCARD", redisKey)
+	conn.Send("PEXPIRE", redisKey, durationMillis(window))
+	replies, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, fmt.Errorf("redis: count failures: %v", err)
+	}
+	if len(replies) != 4 {
+		return 0, fmt.Errorf("redis: count failures: unexpected reply %v", replies)
+	}
+
+	return redigo.Int(replies[2], nil)
+}
+
+func (s *redisStore) block(key string, now time.Time, cooldown time.Duration) error {
+	conn := redis.Get()
+	if conn == nil {
+		return fmt.Errorf("redis: could not get connection from pool")
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", redisKeyPrefix+"blocked:"+key, "1", "PX", durationMillis(cooldown))
+	conn.Send("DEL", redisKeyPrefix+"failures:"+key)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("redis: block: %v", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) isBlocked(key string, now time.Time) (bool, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return false, fmt.Errorf("redis: could not get connection from pool")
+	}
+	defer conn.Close()
+
+	blocked, err := redigo.Bool(conn.Do("EXISTS", redisKeyPrefix+"blocked:"+key))
+	if err != nil {
+		return false, fmt.Errorf("redis: check block: %v", err)
+	}
+
+	return blocked, nil
+}
+
+func durationMillis(d time.Duration) int64 {
+	if ms := int64(d / time.Millisecond); ms > 0 {
+		return ms
+	}
+
+	return 1
+}
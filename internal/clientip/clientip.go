@@ -0,0 +1,96 @@
+/*
+Package clientip determines the address of the client that sent a request
+when gitlab-workhorse runs behind one or more reverse proxies.
+*/
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sebest/xff"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// Resolver rewrites the RemoteAddr of incoming requests
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a Resolver that only trusts X-Forwarded-For headers
+// added by proxies in trustedCIDRs. Without trustedCIDRs it falls back to
+// the private-range heuristic of github.com/sebest/xff.
+func NewResolver(trustedCIDRs []string) (*Resolver, error) {
+	trusted, err := helper.ParseNetworks(trustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resolver{trusted: trusted}, nil
+}
+
+// Trusted reports whether ip belongs to a trusted proxy
+func (c *Resolver) Trusted(ip net.IP) bool {
+	return helper.NetworksContain(c.trusted, ip)
+}
+
+// SetRemoteAddr replaces r.RemoteAddr with the address of the client.
+//
+// With trusted proxies configured, X-Forwarded-For is read from right to
+// left and the first address that is not a trusted proxy is the client.
+// RemoteAddr is left alone if the walk hits an entry that is not an IP.
+// Peers on a Unix socket have no address and are trusted like the
+// PROXY protocol listener trusts them: only local proxies can reach
+// the socket.
+// The header is then removed from r because the client address is in
+// RemoteAddr now: requests to Rails get a fresh X-Forwarded-For that
+// cannot carry addresses made up by the client.
+func (c *Resolver) SetRemoteAddr(r *http.Request) {
+	if len(c.trusted) == 0 {
+		// Automatic quasi-intelligent X-Forwarded-For parsing
+		r.RemoteAddr = xff.GetRemoteAddr(r)
+		return
+	}
+
+	defer r.Header.Del("X-Forwarded-For")
+
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix socket peers show up as "@" or "". Give the client a
+		// port so that RemoteAddr can still be split by later handlers.
+		port = "0"
+	} else if peer := net.ParseIP(host); peer == nil || !c.Trusted(peer) {
+		return
+	}
+
+	if client := c.clientFromForwardedFor(r.Header["X-Forwarded-For"]); client != nil {
+		r.RemoteAddr = net.JoinHostPort(client.String(), port)
+	}
+}
+
+func (c *Resolver) clientFromForwardedFor(headers []string) net.IP {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Everything left of a broken entry is unreliable, and
+			// the hops right of it are trusted proxies, not the
+			// client: keep the peer address.
+			return nil
+		}
+
+		client = ip
+		if !c.Trusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
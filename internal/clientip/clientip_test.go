@@ -0,0 +1,114 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetRemoteAddr(t *testing.T) {
+	resolver, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{
+			desc:       "no header",
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1:1234",
+		},
+		{
+			desc:       "untrusted peer",
+			remoteAddr: "1.2.3.4:1234",
+			xff:        []string{"5.6.7.8"},
+			expected:   "1.2.3.4:1234",
+		},
+		{
+			desc:       "trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"5.6.7.8"},
+			expected:   "5.6.7.8:1234",
+		},
+		{
+			desc:       "spoofed entries left of the client",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"1.1.1.1, 5.6.7.8, 192.168.1.1"},
+			expected:   "5.6.7.8:1234",
+		},
+		{
+			desc:       "multiple headers",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"1.1.1.1", "5.6.7.8", "10.2.3.4"},
+			expected:   "5.6.7.8:1234",
+		},
+		{
+			desc:       "only trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.1.1.1, 10.2.2.2"},
+			expected:   "10.1.1.1:1234",
+		},
+		{
+			desc:       "garbage keeps the peer address",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"5.6.7.8, garbage, 10.2.2.2"},
+			expected:   "10.0.0.1:1234",
+		},
+		{
+			desc:       "garbage left of the client",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"garbage, 5.6.7.8, 10.2.2.2"},
+			expected:   "5.6.7.8:1234",
+		},
+		{
+			desc:       "unix socket peer",
+			remoteAddr: "@",
+			xff:        []string{"5.6.7.8, 10.2.2.2"},
+			expected:   "5.6.7.8:0",
+		},
+		{
+			desc:       "unnamed unix socket peer",
+			remoteAddr: "",
+			xff:        []string{"5.6.7.8"},
+			expected:   "5.6.7.8:0",
+		},
+		{
+			desc:       "unix socket peer without header",
+			remoteAddr: "@",
+			expected:   "@",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, h := range tc.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+
+			resolver.SetRemoteAddr(r)
+
+			require.Equal(t, tc.expected, r.RemoteAddr)
+			require.Empty(t, r.Header.Get("X-Forwarded-For"))
+		})
+	}
+}
+
+func TestSetRemoteAddrWithoutTrustedProxies(t *testing.T) {
+	resolver, err := NewResolver(nil)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+
+	resolver.SetRemoteAddr(r)
+
+	require.Equal(t, "5.6.7.8:1234", r.RemoteAddr)
+	require.Equal(t, "5.6.7.8", r.Header.Get("X-Forwarded-For"))
+}
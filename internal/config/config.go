@@ -21,7 +21,7 @@ type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
 	d.Duration = temp
 	return err
@@ -40,18 +40,179 @@ type RedisConfig struct {
 	MaxActive       *int
 }
 
+// TracingConfig selects the distributed tracing exporter. Only "jaeger"
+// is supported as a Driver at present.
+type TracingConfig struct {
+	Driver       string
+	ServiceName  string
+	UDPEndpoint  string
+	HTTPEndpoint string
+	Sampler      string
+	SamplerParam float64
+}
+
+// BruteForceConfig configures blocking of clients after repeated
+// authentication failures. Window and Cooldown default to 1m and 1h.
+type BruteForceConfig struct {
+	MaxFailures int
+	Window      *TomlDuration
+	Cooldown    *TomlDuration
+	Allowlist   []string
+	Shared      bool
+}
+
+// RedactionConfig lists query parameters and headers whose values are
+// filtered from logs and error reports in addition to the built-in ones.
+type RedactionConfig struct {
+	QueryParams []string
+	Headers     []string
+}
+
+// ClonePolicy is the policy of a repository size class. It has the fields
+// of api.ClonePolicy.
+type ClonePolicy struct {
+	// RequireFilterOrDepth rejects full clones that use neither a partial
+	// clone filter nor a depth limit
+	RequireFilterOrDepth bool
+	// QueueShallowFetches sends shallow fetches through the shallow fetch
+	// queue of ClonePolicyConfig
+	QueueShallowFetches bool
+	// MaxConcurrentFullClones limits full clones running at the same time
+	// per repository. 0 means no limit.
+	MaxConcurrentFullClones int
+}
+
+// ClonePolicyConfig holds clone policies per repository size class. Rails
+// picks the size class, or sends a policy of its own, in the PreAuthorize
+// response of upload-pack requests.
+type ClonePolicyConfig struct {
+	ShallowFetchLimit        uint
+	ShallowFetchQueueLimit   uint
+	ShallowFetchQueueTimeout *TomlDuration
+	SizeClasses              map[string]ClonePolicy `toml:"size_class"`
+}
+
+// UploadPackCacheConfig configures the on-disk cache of upload-pack
+// responses. MaxBytes bounds the total size of the cache; MaxAge bounds
+// how long a response is served.
+type UploadPackCacheConfig struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   *TomlDuration
+}
+
+// InfoRefsCacheConfig enables the in-memory cache of upload-pack info/refs
+// advertisements. MaxAge bounds how long an advertisement is served if no
+// push notification arrives; MaxBytes bounds the total size of the cache.
+type InfoRefsCacheConfig struct {
+	MaxAge   *TomlDuration
+	MaxBytes int64
+}
+
+// SecretPattern is a regular expression for contents that must not be
+// pushed, such as credentials
+type SecretPattern struct {
+	Name    string
+	Pattern string
+}
+
+// PushInspectionConfig enables the inspection of pushed packfiles.
+// MaxMemory bounds the objects kept to resolve deltas and name paths per
+// push, MaxTotalMemory the memory of all inspections of the process; blobs
+// larger than MaxScanSize are not scanned for secrets.
+type PushInspectionConfig struct {
+	MaxMemory                    int64
+	MaxTotalMemory               int64
+	MaxScanSize                  int64
+	SecretPatterns               []SecretPattern `toml:"secret_pattern"`
+	DisableDefaultSecretPatterns bool
+}
+
+// GitalyConfig configures connections to Gitaly servers. CAFile holds the
+// certificates that tls:// addresses are verified against, in addition to
+// the system ones. Keepalive pings are only sent if KeepaliveTime is set.
+// Connections that fail a health check are dropped; HealthCheckInterval
+// defaults to 30s, and 0 turns health checks off. The remaining timeouts
+// cancel calls that Gitaly does not answer in time; 0 turns them off.
+type GitalyConfig struct {
+	CAFile              string
+	KeepaliveTime       *TomlDuration
+	KeepaliveTimeout    *TomlDuration
+	HealthCheckInterval *TomlDuration
+	HealthCheckTimeout  *TomlDuration
+	// InfoRefsFirstByteTimeout bounds the wait for the start of an
+	// info/refs advertisement. Defaults to 30s.
+	InfoRefsFirstByteTimeout *TomlDuration
+	// StreamIdleTimeout bounds the wait for the next message of a
+	// streaming call. Defaults to 5m.
+	StreamIdleTimeout *TomlDuration
+	// ArchiveTimeout bounds the duration of GetArchive calls. No default.
+	ArchiveTimeout *TomlDuration
+}
+
+// ArchiveConfig configures the compression of repository archives.
+// CompressionWorkers bounds how much archive compression runs at the same
+// time in this process and defaults to the number of CPUs. ParallelGzip
+// spreads the compression of a .tar.gz archive over several workers; it
+// does not change the output.
+type ArchiveConfig struct {
+	CompressionWorkers int
+	ParallelGzip       bool
+}
+
+// ArchiveCacheConfig bounds the git archive cache in Dir, the directory
+// that Rails puts cached archives in. The least recently used archives
+// are removed once the cache exceeds MaxBytes, or once less than
+// MinFreeBytes are free on its disk; 0 turns a limit off. The directory
+// is scanned for archives of other processes and orphaned temporary files
+// every CleanupInterval, 5m by default.
+type ArchiveCacheConfig struct {
+	Dir             string
+	MaxBytes        int64
+	MinFreeBytes    int64
+	CleanupInterval *TomlDuration
+}
+
+// ArchiveWarmingConfig makes workhorse generate archives of new tags into
+// the archive cache when Rails asks for it through Redis. Formats are the
+// archive extensions to generate, tar.gz and zip by default. Workers
+// bounds how many archives are generated at the same time, 1 by default;
+// QueueSize bounds how many tags wait for a worker, 100 by default. An
+// archive that takes longer than Timeout, 10m by default, is abandoned.
+type ArchiveWarmingConfig struct {
+	Formats   []string
+	Workers   int
+	QueueSize int
+	Timeout   *TomlDuration
+}
+
 type Config struct {
-	Redis                    *RedisConfig  `toml:"redis"`
-	Backend                  *url.URL      `toml:"-"`
-	Version                  string        `toml:"-"`
-	DocumentRoot             string        `toml:"-"`
-	DevelopmentMode          bool          `toml:"-"`
-	Socket                   string        `toml:"-"`
-	ProxyHeadersTimeout      time.Duration `toml:"-"`
-	APILimit                 uint          `toml:"-"`
-	APIQueueLimit            uint          `toml:"-"`
-	APIQueueTimeout          time.Duration `toml:"-"`
-	APICILongPollingDuration time.Duration `toml:"-"`
+	Redis                    *RedisConfig           `toml:"redis"`
+	Tracing                  *TracingConfig         `toml:"tracing"`
+	BruteForce               *BruteForceConfig      `toml:"bruteforce"`
+	Redaction                *RedactionConfig       `toml:"redaction"`
+	ClonePolicy              *ClonePolicyConfig     `toml:"clone_policy"`
+	UploadPackCache          *UploadPackCacheConfig `toml:"upload_pack_cache"`
+	PushInspection           *PushInspectionConfig  `toml:"push_inspection"`
+	InfoRefsCache            *InfoRefsCacheConfig   `toml:"info_refs_cache"`
+	Gitaly                   *GitalyConfig          `toml:"gitaly"`
+	Archive                  *ArchiveConfig         `toml:"archive"`
+	ArchiveCache             *ArchiveCacheConfig    `toml:"archive_cache"`
+	ArchiveWarming           *ArchiveWarmingConfig  `toml:"archive_warming"`
+	TrustedProxies           []string               `toml:"TrustedProxies"`
+	Backend                  *url.URL               `toml:"-"`
+	Version                  string                 `toml:"-"`
+	DocumentRoot             string                 `toml:"-"`
+	DevelopmentMode          bool                   `toml:"-"`
+	Socket                   string                 `toml:"-"`
+	ProxyHeadersTimeout      time.Duration          `toml:"-"`
+	APILimit                 uint                   `toml:"-"`
+	APIQueueLimit            uint                   `toml:"-"`
+	APIQueueTimeout          time.Duration          `toml:"-"`
+	APICILongPollingDuration time.Duration          `toml:"-"`
+	ReauthorizationInterval  time.Duration          `toml:"-"`
+	ListenProxyProtocol      bool                   `toml:"-"`
+	UploadPackRequestLimit   int64                  `toml:"-"`
 }
 
 // LoadConfig from a file
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestConfig(t *testing.T, content string) (*Config, error) {
+	f, err := ioutil.TempFile("", "workhorse-config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	return LoadConfig(f.Name())
+}
+
+func TestLoadConfigParsesDurations(t *testing.T) {
+	cfg, err := loadTestConfig(t, `
+[redis]
+URL = "unix:/tmp/redis.socket"
+ReadTimeout = "1s"
+WriteTimeout = "1m30s"
+KeepAlivePeriod = "5m"
+`)
+	require.NoError(t, err)
+
+	require.Equal(t, "unix", cfg.Redis.URL.Scheme)
+	require.Equal(t, time.Second, cfg.Redis.ReadTimeout.Duration)
+	require.Equal(t, 90*time.Second, cfg.Redis.WriteTimeout.Duration)
+	require.Equal(t, 5*time.Minute, cfg.Redis.KeepAlivePeriod.Duration)
+}
+
+func TestLoadConfigRejectsInvalidDurations(t *testing.T) {
+	_, err := loadTestConfig(t, `
+[redis]
+ReadTimeout = "one second"
+`)
+	require.Error(t, err)
+}
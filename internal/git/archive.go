@@ -5,6 +5,7 @@ In this file we handle 'git archive' downloads
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,7 +24,10 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
 
-type archive struct{ senddata.Prefix }
+type archive struct {
+	senddata.Prefix
+	cache *ArchiveCache
+}
 type archiveParams struct {
 	RepoPath         string
 	ArchivePath      string
@@ -32,10 +36,14 @@ type archiveParams struct {
 	GitalyServer     gitaly.Server
 	GitalyRepository pb.Repository
 	DisableCache     bool
+	ArchiveObject    *archiveObjectParams
+	// Path and Exclude make an archive of a subtree of CommitId
+	Path    string
+	Exclude []string
 }
 
 var (
-	SendArchive     = &archive{"git-archive:"}
+	SendArchive     = &archive{Prefix: "git-archive:"}
 	gitArchiveCache = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gitlab_workhorse_git_archive_cache",
@@ -49,6 +57,12 @@ func init() {
 	prometheus.MustRegister(gitArchiveCache)
 }
 
+// NewSendArchive returns the git-archive injecter for archives that are
+// cached in the directory of cache
+func NewSendArchive(cache *ArchiveCache) senddata.Injecter {
+	return &archive{Prefix: SendArchive.Prefix, cache: cache}
+}
+
 func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 	var params archiveParams
 	if err := a.Unpack(&params, sendData); err != nil {
@@ -63,80 +77,127 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		return
 	}
 
-	cacheEnabled := !params.DisableCache
-	archiveFilename := path.Base(params.ArchivePath)
+	if err := params.validateFilter(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
+		return
+	}
 
-	if cacheEnabled {
-		cachedArchive, err := os.Open(params.ArchivePath)
-		if err == nil {
-			defer cachedArchive.Close()
-			gitArchiveCache.WithLabelValues("hit").Inc()
-			setArchiveHeaders(w, format, archiveFilename)
-			// Even if somebody deleted the cachedArchive from disk since we opened
-			// the file, Unix file semantics guarantee we can still read from the
-			// open file in this process.
-			http.ServeContent(w, r, "", time.Unix(0, 0), cachedArchive)
-			return
-		}
+	archivePath := archiveCachePath(params, format, params.ArchivePath)
+	if params.DisableCache {
+		a.serveUncached(w, r, params, format, path.Base(archivePath))
+		return
 	}
 
-	gitArchiveCache.WithLabelValues("miss").Inc()
+	generate := archiveGenerator(params, format)
+	if params.ArchiveObject != nil {
+		a.serveObject(w, r, params, format, path.Base(archivePath), generate)
+		return
+	}
 
-	var tempFile *os.File
-	var err error
+	a.serveCached(w, r, format, archivePath, generate)
+}
 
-	if cacheEnabled {
-		// We assume the tempFile has a unique name so that concurrent requests are
-		// safe. We create the tempfile in the same directory as the final cached
-		// archive we want to create so that we can use an atomic link(2) operation
-		// to finalize the cached archive.
-		tempFile, err = prepareArchiveTempfile(path.Dir(params.ArchivePath), archiveFilename)
+// archiveGenerator writes the archive of params in format to a cache
+func archiveGenerator(params archiveParams, format archiveFormat) func(context.Context, io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		archiveReader, err := openArchive(ctx, params, format)
 		if err != nil {
-			helper.Fail500(w, r, fmt.Errorf("SendArchive: create tempfile: %v", err))
-			return
+			return err
 		}
-		defer tempFile.Close()
-		defer os.Remove(tempFile.Name())
+		defer archiveReader.Close()
+
+		_, err = io.Copy(w, archiveReader)
+		return err
 	}
+}
 
-	var archiveReader io.Reader
-	if params.GitalyServer.Address != "" {
-		archiveReader, err = handleArchiveWithGitaly(r, params, format)
+// serveUncached streams an archive that is not to be cached
+func (a *archive) serveUncached(w http.ResponseWriter, r *http.Request, params archiveParams, format archiveFormat, archiveFilename string) {
+	gitArchiveCache.WithLabelValues("miss").Inc()
 
-		if err != nil {
-			err = fmt.Errorf("operations.GetArchive: %v", err)
-		}
-	} else {
-		archiveReader, err = newArchiveReader(r.Context(), params.RepoPath, format, params.ArchivePrefix, params.CommitId)
-	}
+	archiveReader, err := openArchive(r.Context(), params, format)
 	if err != nil {
-		helper.Fail500(w, r, err)
+		failArchive(w, r, err)
 		return
 	}
-
-	reader := archiveReader
-	if cacheEnabled {
-		reader = io.TeeReader(archiveReader, tempFile)
-	}
+	defer archiveReader.Close()
 
 	// Start writing the response
 	setArchiveHeaders(w, format, archiveFilename)
 	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if _, err := io.Copy(w, reader); err != nil {
+	if _, err := io.Copy(w, archiveReader); err != nil {
 		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
 		return
 	}
+}
+
+// failArchive answers a request for an archive that could not be
+// generated. Archives of a path that does not exist are not found.
+func failArchive(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*archivePathNotFoundError); ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	helper.Fail500(w, r, err)
+}
+
+// serveFile serves an archive from the cache. Even if somebody deleted the
+// file from disk since we opened it, Unix file semantics guarantee we can
+// still read from the open file in this process.
+func (a *archive) serveFile(w http.ResponseWriter, r *http.Request, format archiveFormat, archivePath string, cachedArchive *os.File) {
+	defer cachedArchive.Close()
+
+	gitArchiveCache.WithLabelValues("hit").Inc()
+	a.cache.accessed(archivePath)
+	setArchiveHeaders(w, format, path.Base(archivePath))
+	http.ServeContent(w, r, "", time.Unix(0, 0), cachedArchive)
+}
+
+// openArchive starts generating an archive with Gitaly or git archive.
+// The returned reader must be closed.
+func openArchive(ctx context.Context, params archiveParams, format archiveFormat) (io.ReadCloser, error) {
+	var archiveReader io.Reader
+	var err error
+
+	compression := format.compression
+	if params.GitalyServer.Address != "" && params.filtered() {
+		// Gitaly sends the TAR archive of the whole tree
+		compression = format.compressedInProcess().compression
+		archiveReader, err = handleArchiveWithGitaly(ctx, params, pb.GetArchiveRequest_TAR)
+
+		if err != nil {
+			err = fmt.Errorf("operations.GetArchive: %v", err)
+		} else {
+			archiveFilterRequests.Inc()
+			archiveReader, err = filterArchive(archiveReader, params, format.format == pb.GetArchiveRequest_ZIP)
+		}
+	} else if params.GitalyServer.Address != "" {
+		archiveReader, err = handleArchiveWithGitaly(ctx, params, format.format)
 
-	if cacheEnabled {
-		err := finalizeCachedArchive(tempFile, params.ArchivePath)
 		if err != nil {
-			helper.LogError(r, fmt.Errorf("SendArchive: finalize cached archive: %v", err))
-			return
+			err = fmt.Errorf("operations.GetArchive: %v", err)
+		}
+	} else {
+		localFormat := format.compressedInProcess()
+		compression = localFormat.compression
+		err = checkArchivePath(params)
+		if err == nil {
+			archiveReader, err = newArchiveReader(ctx, params.RepoPath, localFormat.format, params.ArchivePrefix, params.CommitId, params.pathspecs())
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if compression == compressionNone {
+		return ioutil.NopCloser(archiveReader), nil
+	}
+
+	return compressArchive(archiveReader, compression)
 }
 
-func handleArchiveWithGitaly(r *http.Request, params archiveParams, format pb.GetArchiveRequest_Format) (io.Reader, error) {
+func handleArchiveWithGitaly(ctx context.Context, params archiveParams, format pb.GetArchiveRequest_Format) (io.Reader, error) {
 	c, err := gitaly.NewRepositoryClient(params.GitalyServer)
 	if err != nil {
 		return nil, err
@@ -149,26 +210,40 @@ func handleArchiveWithGitaly(r *http.Request, params archiveParams, format pb.Ge
 		Format:     format,
 	}
 
-	return c.ArchiveReader(r.Context(), request)
+	return c.ArchiveReader(ctx, request)
 }
 
-func setArchiveHeaders(w http.ResponseWriter, format pb.GetArchiveRequest_Format, archiveFilename string) {
+func setArchiveHeaders(w http.ResponseWriter, format archiveFormat, archiveFilename string) {
 	w.Header().Del("Content-Length")
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveFilename))
-	if format == pb.GetArchiveRequest_ZIP {
+	switch {
+	case format.compression == compressionXz:
+		w.Header().Set("Content-Type", "application/x-xz")
+	case format.compression == compressionZstd:
+		w.Header().Set("Content-Type", "application/zstd")
+	case format.format == pb.GetArchiveRequest_ZIP:
 		w.Header().Set("Content-Type", "application/zip")
-	} else {
+	default:
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 	w.Header().Set("Content-Transfer-Encoding", "binary")
 	w.Header().Set("Cache-Control", "private")
 }
 
+// prepareArchiveTempfile creates a temporary file in dir. The archive
+// cache removes empty directories, so dir may have to be created again.
 func prepareArchiveTempfile(dir string, prefix string) (*os.File, error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, err
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+
+		tempFile, err := ioutil.TempFile(dir, archiveTempfilePrefix+prefix)
+		if os.IsNotExist(err) && attempt < 2 {
+			continue
+		}
+		return tempFile, err
 	}
-	return ioutil.TempFile(dir, prefix)
 }
 
 func finalizeCachedArchive(tempFile *os.File, archivePath string) error {
@@ -187,22 +262,93 @@ var (
 	patternTar    = regexp.MustCompile(`\.tar$`)
 	patternTarGz  = regexp.MustCompile(`\.(tar\.gz|tgz|gz)$`)
 	patternTarBz2 = regexp.MustCompile(`\.(tar\.bz2|tbz|tbz2|tb2|bz2)$`)
+	patternTarXz  = regexp.MustCompile(`\.(tar\.xz|txz|xz)$`)
+	patternTarZst = regexp.MustCompile(`\.(tar\.zst|tzst|zst)$`)
 )
 
-func parseBasename(basename string) (pb.GetArchiveRequest_Format, bool) {
-	var format pb.GetArchiveRequest_Format
+// archiveFormat is the format to ask git archive or Gitaly for, and the
+// compression that workhorse applies to it
+type archiveFormat struct {
+	format      pb.GetArchiveRequest_Format
+	compression archiveCompression
+}
+
+// cachePath returns where the archive is cached. Archives compressed by
+// workhorse get their own extension, in place of any other archive
+// extension, in case Rails, not knowing the format, picked the path of
+// another one.
+func (f archiveFormat) cachePath(archivePath string) string {
+	switch {
+	case f.compression == compressionXz && !patternTarXz.MatchString(archivePath):
+		return trimArchiveExtension(archivePath) + ".tar.xz"
+	case f.compression == compressionZstd && !patternTarZst.MatchString(archivePath):
+		return trimArchiveExtension(archivePath) + ".tar.zst"
+	default:
+		return archivePath
+	}
+}
+
+func trimArchiveExtension(archivePath string) string {
+	for _, pattern := range []*regexp.Regexp{patternZip, patternTar, patternTarGz, patternTarBz2, patternTarXz, patternTarZst} {
+		if pattern.MatchString(archivePath) {
+			return pattern.ReplaceAllString(archivePath, "")
+		}
+	}
+
+	return archivePath
+}
+
+// String names the format after the extension of its archives
+func (f archiveFormat) String() string {
+	switch {
+	case f.compression == compressionXz:
+		return "tar.xz"
+	case f.compression == compressionZstd:
+		return "tar.zst"
+	case f.format == pb.GetArchiveRequest_ZIP:
+		return "zip"
+	case f.format == pb.GetArchiveRequest_TAR:
+		return "tar"
+	case f.format == pb.GetArchiveRequest_TAR_GZ:
+		return "tar.gz"
+	case f.format == pb.GetArchiveRequest_TAR_BZ2:
+		return "tar.bz2"
+	default:
+		return "invalid"
+	}
+}
+
+// compressedInProcess returns the format to make a .tar.gz or .tar.bz2
+// archive from the TAR output of git archive
+func (f archiveFormat) compressedInProcess() archiveFormat {
+	switch f.format {
+	case pb.GetArchiveRequest_TAR_GZ:
+		return archiveFormat{pb.GetArchiveRequest_TAR, compressionGzip}
+	case pb.GetArchiveRequest_TAR_BZ2:
+		return archiveFormat{pb.GetArchiveRequest_TAR, compressionBzip2}
+	default:
+		return f
+	}
+}
+
+func parseBasename(basename string) (archiveFormat, bool) {
+	var format archiveFormat
 
 	switch {
 	case (basename == "archive"):
-		format = pb.GetArchiveRequest_TAR_GZ
+		format.format = pb.GetArchiveRequest_TAR_GZ
 	case patternZip.MatchString(basename):
-		format = pb.GetArchiveRequest_ZIP
+		format.format = pb.GetArchiveRequest_ZIP
 	case patternTar.MatchString(basename):
-		format = pb.GetArchiveRequest_TAR
+		format.format = pb.GetArchiveRequest_TAR
 	case patternTarGz.MatchString(basename):
-		format = pb.GetArchiveRequest_TAR_GZ
+		format.format = pb.GetArchiveRequest_TAR_GZ
 	case patternTarBz2.MatchString(basename):
-		format = pb.GetArchiveRequest_TAR_BZ2
+		format.format = pb.GetArchiveRequest_TAR_BZ2
+	case patternTarXz.MatchString(basename):
+		format = archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}
+	case patternTarZst.MatchString(basename):
+		format = archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}
 	default:
 		return format, false
 	}
@@ -13,17 +13,21 @@ import (
 func TestParseBasename(t *testing.T) {
 	for _, testCase := range []struct {
 		in  string
-		out pb.GetArchiveRequest_Format
+		out archiveFormat
 	}{
-		{"archive", pb.GetArchiveRequest_TAR_GZ},
-		{"master.tar.gz", pb.GetArchiveRequest_TAR_GZ},
-		{"foo-master.tgz", pb.GetArchiveRequest_TAR_GZ},
-		{"foo-v1.2.1.gz", pb.GetArchiveRequest_TAR_GZ},
-		{"foo.tar.bz2", pb.GetArchiveRequest_TAR_BZ2},
-		{"archive.tbz", pb.GetArchiveRequest_TAR_BZ2},
-		{"archive.tbz2", pb.GetArchiveRequest_TAR_BZ2},
-		{"archive.tb2", pb.GetArchiveRequest_TAR_BZ2},
-		{"archive.bz2", pb.GetArchiveRequest_TAR_BZ2},
+		{"archive", archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}},
+		{"master.tar.gz", archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}},
+		{"foo-master.tgz", archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}},
+		{"foo-v1.2.1.gz", archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}},
+		{"foo.tar.bz2", archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}},
+		{"archive.tbz", archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}},
+		{"archive.tbz2", archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}},
+		{"archive.tb2", archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}},
+		{"archive.bz2", archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}},
+		{"foo.tar.xz", archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}},
+		{"archive.txz", archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}},
+		{"foo.tar.zst", archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}},
+		{"archive.tzst", archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}},
 	} {
 		basename := testCase.in
 		out, ok := parseBasename(basename)
@@ -32,7 +36,7 @@ func TestParseBasename(t *testing.T) {
 		}
 
 		if out != testCase.out {
-			t.Fatalf("expected %q, got %q", testCase.out, out)
+			t.Fatalf("expected %v, got %v", testCase.out, out)
 		}
 	}
 }
@@ -53,13 +57,15 @@ func TestFinalizeArchive(t *testing.T) {
 
 func TestSetArchiveHeaders(t *testing.T) {
 	for _, testCase := range []struct {
-		in  pb.GetArchiveRequest_Format
+		in  archiveFormat
 		out string
 	}{
-		{pb.GetArchiveRequest_ZIP, "application/zip"},
-		{pb.GetArchiveRequest_TAR, "application/octet-stream"},
-		{pb.GetArchiveRequest_TAR_GZ, "application/octet-stream"},
-		{pb.GetArchiveRequest_TAR_BZ2, "application/octet-stream"},
+		{archiveFormat{format: pb.GetArchiveRequest_ZIP}, "application/zip"},
+		{archiveFormat{format: pb.GetArchiveRequest_TAR}, "application/octet-stream"},
+		{archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}, "application/octet-stream"},
+		{archiveFormat{format: pb.GetArchiveRequest_TAR_BZ2}, "application/octet-stream"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}, "application/x-xz"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}, "application/zstd"},
 	} {
 		w := httptest.NewRecorder()
 
@@ -77,3 +83,24 @@ func TestSetArchiveHeaders(t *testing.T) {
 		testhelper.AssertResponseWriterHeader(t, w, "Cache-Control", "private")
 	}
 }
+
+func TestArchiveCachePath(t *testing.T) {
+	for _, testCase := range []struct {
+		format archiveFormat
+		in     string
+		out    string
+	}{
+		{archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}, "/cache/project-v1.tar.gz", "/cache/project-v1.tar.gz"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}, "/cache/project-v1.tar.xz", "/cache/project-v1.tar.xz"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}, "/cache/project-v1.txz", "/cache/project-v1.txz"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}, "/cache/project-v1.tar.gz", "/cache/project-v1.tar.xz"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}, "/cache/project-v1.tar.zst", "/cache/project-v1.tar.zst"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}, "/cache/project-v1.tar.xz", "/cache/project-v1.tar.zst"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionZstd}, "/cache/project-v1.2", "/cache/project-v1.2.tar.zst"},
+		{archiveFormat{pb.GetArchiveRequest_TAR, compressionXz}, "/cache/project-v1.tar", "/cache/project-v1.tar.xz"},
+	} {
+		if out := testCase.format.cachePath(testCase.in); out != testCase.out {
+			t.Fatalf("expected %q, got %q", testCase.out, out)
+		}
+	}
+}
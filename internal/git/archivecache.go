@@ -0,0 +1,362 @@
+package git
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	defaultArchiveCacheCleanupInterval = 5 * time.Minute
+
+	// Temporary files that have not been written to for this long are
+	// left behind by a request or process that went away
+	archiveTempfileMaxAge = time.Hour
+
+	archiveTempfilePrefix = ".tmp-"
+)
+
+// Before temporary files got their own prefix, they were named after the
+// archive with random digits appended
+var legacyArchiveTempfilePattern = regexp.MustCompile(`\.(zip|tar|gz|tgz|bz2|tbz|tbz2|tb2)[0-9]+$`)
+
+var (
+	archiveCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_bytes",
+			Help: "Total size of the archives in the git archive cache.",
+		},
+	)
+
+	archiveCacheFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_files",
+			Help: "How many archives are in the git archive cache.",
+		},
+	)
+
+	archiveCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_cache_evictions",
+			Help: "How many files have been removed from the git archive cache, partitioned by reason (size, free_disk, orphan).",
+		},
+		[]string{"reason"},
+	)
+
+	// archiveCacheDiskFree returns the bytes available to workhorse on the
+	// file system of dir
+	archiveCacheDiskFree = func(dir string) (int64, error) {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return 0, err
+		}
+		return int64(stat.Bavail) * int64(stat.Bsize), nil
+	}
+)
+
+func init() {
+	prometheus.MustRegister(archiveCacheBytes)
+	prometheus.MustRegister(archiveCacheFiles)
+	prometheus.MustRegister(archiveCacheEvictions)
+}
+
+// ArchiveCache removes the least recently used archives from the
+// directory that Rails keeps cached archives in. Archives that were not
+// served by this process since it started are ordered by modification
+// time. A nil *ArchiveCache removes nothing.
+type ArchiveCache struct {
+	dir          string
+	maxBytes     int64
+	minFreeBytes int64
+
+	mutex      sync.Mutex
+	entries    map[string]*archiveCacheEntry
+	lru        *list.List
+	totalBytes int64
+}
+
+type archiveCacheEntry struct {
+	path    string
+	size    int64
+	element *list.Element
+}
+
+// NewArchiveCache indexes the archives in cfg.Dir and starts removing
+// archives and orphaned temporary files in the background.
+func NewArchiveCache(cfg *config.ArchiveCacheConfig) (*ArchiveCache, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("NewArchiveCache: Dir is not set")
+	}
+
+	c := newArchiveCache(cfg)
+	interval := defaultArchiveCacheCleanupInterval
+	if cfg.CleanupInterval != nil {
+		interval = cfg.CleanupInterval.Duration
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("NewArchiveCache: CleanupInterval must be positive")
+	}
+
+	c.cleanup()
+	go func() {
+		for range time.Tick(interval) {
+			c.cleanup()
+		}
+	}()
+
+	return c, nil
+}
+
+func newArchiveCache(cfg *config.ArchiveCacheConfig) *ArchiveCache {
+	return &ArchiveCache{
+		dir:          filepath.Clean(cfg.Dir),
+		maxBytes:     cfg.MaxBytes,
+		minFreeBytes: cfg.MinFreeBytes,
+		entries:      make(map[string]*archiveCacheEntry),
+		lru:          list.New(),
+	}
+}
+
+func isArchiveTempfile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, archiveTempfilePrefix) || legacyArchiveTempfilePattern.MatchString(name)
+}
+
+// manages tells whether path is inside the cache directory
+func (c *ArchiveCache) manages(path string) bool {
+	rel, err := filepath.Rel(c.dir, path)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// accessed moves a cached archive that was served to the front of the
+// LRU list
+func (c *ArchiveCache) accessed(path string) {
+	if c == nil || !c.manages(path) {
+		return
+	}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[filepath.Clean(path)]
+	if ok {
+		c.lru.MoveToFront(entry.element)
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		return
+	}
+
+	// Another process created the archive since the last scan
+	if info, err := os.Stat(path); err == nil {
+		c.mutex.Lock()
+		if _, ok := c.entries[filepath.Clean(path)]; !ok {
+			c.add(path, info.Size())
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// added indexes an archive that was just cached, and removes old
+// archives if the cache is now too large
+func (c *ArchiveCache) added(path string) {
+	if c == nil || !c.manages(path) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if entry, ok := c.entries[filepath.Clean(path)]; ok {
+		c.lru.MoveToFront(entry.element)
+	} else {
+		c.add(path, info.Size())
+	}
+	c.mutex.Unlock()
+
+	c.evict()
+}
+
+// add must be called with c.mutex held
+func (c *ArchiveCache) add(path string, size int64) {
+	entry := &archiveCacheEntry{path: filepath.Clean(path), size: size}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[entry.path] = entry
+	c.totalBytes += size
+	c.updateMetrics()
+}
+
+// drop must be called with c.mutex held
+func (c *ArchiveCache) drop(entry *archiveCacheEntry) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.path)
+	c.totalBytes -= entry.size
+	c.updateMetrics()
+}
+
+// updateMetrics must be called with c.mutex held
+func (c *ArchiveCache) updateMetrics() {
+	archiveCacheBytes.Set(float64(c.totalBytes))
+	archiveCacheFiles.Set(float64(len(c.entries)))
+}
+
+// evict removes the least recently used archives while the cache is too
+// large or the disk too full. The files are removed without holding
+// c.mutex. Clients still downloading an archive keep their open file
+// descriptor.
+func (c *ArchiveCache) evict() {
+	c.mutex.Lock()
+	var victims []*archiveCacheEntry
+	for c.maxBytes > 0 && c.totalBytes > c.maxBytes && c.lru.Len() > 0 {
+		victims = append(victims, c.takeOldest())
+	}
+	c.mutex.Unlock()
+	c.remove(victims, "size")
+
+	if c.minFreeBytes <= 0 {
+		return
+	}
+
+	free, err := archiveCacheDiskFree(c.dir)
+	if err != nil {
+		log.WithFields(context.Background(), log.Fields{"path": c.dir}).WithError(err).Warning("ArchiveCache: statfs")
+		return
+	}
+
+	c.mutex.Lock()
+	victims = nil
+	for free < c.minFreeBytes && c.lru.Len() > 0 {
+		entry := c.takeOldest()
+		victims = append(victims, entry)
+		free += entry.size
+	}
+	c.mutex.Unlock()
+	c.remove(victims, "free_disk")
+}
+
+// takeOldest must be called with c.mutex held. It drops the least recently
+// used archive from the index and returns it.
+func (c *ArchiveCache) takeOldest() *archiveCacheEntry {
+	entry := c.lru.Back().Value.(*archiveCacheEntry)
+	c.drop(entry)
+	return entry
+}
+
+func (c *ArchiveCache) remove(entries []*archiveCacheEntry, reason string) {
+	for _, entry := range entries {
+		c.removeFile(entry.path, reason)
+	}
+}
+
+// removeFile removes a file of the cache directory, and the directories
+// that it leaves empty, e.g. the one of a commit
+func (c *ArchiveCache) removeFile(path string, reason string) {
+	if err := os.Remove(path); err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(context.Background(), log.Fields{"path": path}).WithError(err).Warning("ArchiveCache: remove")
+		}
+		return
+	}
+
+	archiveCacheEvictions.WithLabelValues(reason).Inc()
+
+	for dir := filepath.Dir(path); c.manages(dir); dir = filepath.Dir(dir) {
+		// Fails for directories that are not empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+type archiveCacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// cleanup indexes archives created by other processes, forgets archives
+// removed by them, removes orphaned temporary files and evicts archives
+// if necessary
+func (c *ArchiveCache) cleanup() {
+	var files []archiveCacheFile
+	seen := make(map[string]bool)
+
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if isArchiveTempfile(path) {
+			if time.Since(info.ModTime()) > archiveTempfileMaxAge {
+				c.removeFile(path, "orphan")
+			}
+			return nil
+		}
+
+		seen[path] = true
+		files = append(files, archiveCacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		log.WithFields(context.Background(), log.Fields{"path": c.dir}).WithError(err).Warning("ArchiveCache: scan")
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var unseen []string
+	c.mutex.Lock()
+	for _, entry := range c.entries {
+		if !seen[entry.path] {
+			unseen = append(unseen, entry.path)
+		}
+	}
+	c.mutex.Unlock()
+
+	// The archives may have been added during the scan
+	var removed []string
+	for _, path := range unseen {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			removed = append(removed, path)
+		}
+	}
+
+	c.mutex.Lock()
+	for _, path := range removed {
+		if entry, ok := c.entries[path]; ok {
+			c.drop(entry)
+		}
+	}
+	for _, file := range files {
+		if _, ok := c.entries[file.path]; !ok {
+			c.add(file.path, file.size)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.evict()
+}
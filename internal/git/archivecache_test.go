@@ -0,0 +1,156 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func writeCachedArchive(t *testing.T, path string, size int, age time.Duration) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, size), 0600))
+
+	modTime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func requireFileExists(t *testing.T, path string, exists bool) {
+	_, err := os.Stat(path)
+	if exists {
+		require.NoError(t, err, "%s should exist", path)
+	} else {
+		require.True(t, os.IsNotExist(err), "%s should not exist", path)
+	}
+}
+
+func TestArchiveCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldest := filepath.Join(dir, "project-1", "a.tar.gz")
+	older := filepath.Join(dir, "project-1", "b.zip")
+	newest := filepath.Join(dir, "project-2", "c.tar")
+	writeCachedArchive(t, oldest, 100, 3*time.Hour)
+	writeCachedArchive(t, older, 100, 2*time.Hour)
+	writeCachedArchive(t, newest, 100, time.Hour)
+
+	c := newArchiveCache(&config.ArchiveCacheConfig{Dir: dir, MaxBytes: 350})
+	c.cleanup()
+	require.Equal(t, int64(300), c.totalBytes)
+	require.Len(t, c.entries, 3)
+
+	// Serving an archive protects it from eviction
+	c.accessed(oldest)
+
+	added := filepath.Join(dir, "project-2", "d.tar.bz2")
+	writeCachedArchive(t, added, 100, 0)
+	c.added(added)
+
+	requireFileExists(t, oldest, true)
+	requireFileExists(t, older, false)
+	requireFileExists(t, newest, true)
+	requireFileExists(t, added, true)
+	require.Equal(t, int64(300), c.totalBytes)
+
+	// Archives outside of the directory are not touched
+	outside := filepath.Join(os.TempDir(), "elsewhere.tar.gz")
+	c.added(outside)
+	require.Len(t, c.entries, 3)
+
+	// Directories left empty are removed
+	large := filepath.Join(dir, "project-3", "e.tar")
+	writeCachedArchive(t, large, 300, 0)
+	c.added(large)
+	requireFileExists(t, filepath.Join(dir, "project-1"), false)
+	requireFileExists(t, large, true)
+	requireFileExists(t, dir, true)
+}
+
+func TestArchiveCacheKeepsFreeDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(diskFree func(string) (int64, error)) { archiveCacheDiskFree = diskFree }(archiveCacheDiskFree)
+	archiveCacheDiskFree = func(string) (int64, error) { return 150, nil }
+
+	oldest := filepath.Join(dir, "a.tar.gz")
+	older := filepath.Join(dir, "b.tar.gz")
+	newest := filepath.Join(dir, "c.tar.gz")
+	writeCachedArchive(t, oldest, 100, 3*time.Hour)
+	writeCachedArchive(t, older, 100, 2*time.Hour)
+	writeCachedArchive(t, newest, 100, time.Hour)
+
+	c := newArchiveCache(&config.ArchiveCacheConfig{Dir: dir, MinFreeBytes: 300})
+	c.cleanup()
+
+	requireFileExists(t, oldest, false)
+	requireFileExists(t, older, false)
+	requireFileExists(t, newest, true)
+	require.Equal(t, int64(100), c.totalBytes)
+}
+
+func TestArchiveCacheCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	orphan := filepath.Join(dir, "project-1", archiveTempfilePrefix+"a.tar.gz123")
+	legacyOrphan := filepath.Join(dir, "project-1", "a.zip4567")
+	inProgress := filepath.Join(dir, "project-1", archiveTempfilePrefix+"b.tar.gz456")
+	archive := filepath.Join(dir, "project-1", "c.tar.gz")
+	writeCachedArchive(t, orphan, 100, 2*archiveTempfileMaxAge)
+	writeCachedArchive(t, legacyOrphan, 100, 2*archiveTempfileMaxAge)
+	writeCachedArchive(t, inProgress, 100, 0)
+	writeCachedArchive(t, archive, 100, 0)
+
+	c := newArchiveCache(&config.ArchiveCacheConfig{Dir: dir})
+	c.cleanup()
+
+	requireFileExists(t, orphan, false)
+	requireFileExists(t, legacyOrphan, false)
+	requireFileExists(t, inProgress, true)
+	require.Equal(t, int64(100), c.totalBytes)
+	require.Len(t, c.entries, 1)
+
+	// Archives removed by somebody else are forgotten
+	require.NoError(t, os.Remove(archive))
+	c.cleanup()
+	require.Equal(t, int64(0), c.totalBytes)
+	require.Empty(t, c.entries)
+}
+
+func TestNewArchiveCache(t *testing.T) {
+	cache, err := NewArchiveCache(nil)
+	require.NoError(t, err)
+	require.Nil(t, cache)
+
+	// A nil cache is a no-op
+	cache.accessed("/some/archive.zip")
+	cache.added("/some/archive.zip")
+
+	_, err = NewArchiveCache(&config.ArchiveCacheConfig{})
+	require.Error(t, err)
+
+	_, err = NewArchiveCache(&config.ArchiveCacheConfig{Dir: "/tmp", CleanupInterval: &config.TomlDuration{}})
+	require.Error(t, err)
+}
+
+func TestPrepareArchiveTempfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tempFile, err := prepareArchiveTempfile(filepath.Join(dir, "project-1"), "archive.tar.gz")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	require.True(t, isArchiveTempfile(tempFile.Name()))
+}
@@ -0,0 +1,176 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// archiveCompression is applied by workhorse itself to the TAR output of
+// git archive or Gitaly
+type archiveCompression int
+
+const (
+	compressionNone archiveCompression = iota
+	compressionXz
+	compressionZstd
+	compressionGzip
+	compressionBzip2
+)
+
+var archiveSettings atomic.Value
+
+func init() {
+	archiveSettings.Store(newCompressionSettings(nil))
+}
+
+// compressionSettings bound the CPU that archive compression takes. Every
+// piece of work holds one of the tokens, which are shared by all archives
+// of the process.
+type compressionSettings struct {
+	tokens       chan struct{}
+	parallelGzip bool
+}
+
+func newCompressionSettings(cfg *config.ArchiveConfig) *compressionSettings {
+	workers := runtime.NumCPU()
+	settings := &compressionSettings{}
+
+	if cfg != nil {
+		if cfg.CompressionWorkers > 0 {
+			workers = cfg.CompressionWorkers
+		}
+		settings.parallelGzip = cfg.ParallelGzip
+	}
+
+	settings.tokens = make(chan struct{}, workers)
+	return settings
+}
+
+// ConfigureArchive sets how archives are compressed. Archives that are
+// being compressed keep the settings they started with.
+func ConfigureArchive(cfg *config.ArchiveConfig) {
+	archiveSettings.Store(newCompressionSettings(cfg))
+}
+
+func currentCompressionSettings() *compressionSettings {
+	return archiveSettings.Load().(*compressionSettings)
+}
+
+func (s *compressionSettings) acquire() { s.tokens <- struct{}{} }
+func (s *compressionSettings) release() { <-s.tokens }
+
+func (c archiveCompression) newWriter(w io.Writer, settings *compressionSettings) (io.WriteCloser, error) {
+	switch c {
+	case compressionXz:
+		return newStreamCompressor(w, settings, func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		})
+	case compressionZstd:
+		return newStreamCompressor(w, settings, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithZeroFrames(true), zstd.WithEncoderConcurrency(1))
+		})
+	case compressionBzip2:
+		return newStreamCompressor(w, settings, func(w io.Writer) (io.WriteCloser, error) {
+			return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+		})
+	case compressionGzip:
+		return newGzipWriter(w, settings), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}
+}
+
+// compressArchive compresses tar while it is read. The returned reader
+// must be closed to stop the compression if it is not read to the end.
+func compressArchive(tar io.Reader, compression archiveCompression) (io.ReadCloser, error) {
+	switch compression {
+	case compressionXz, compressionZstd, compressionGzip, compressionBzip2:
+	default:
+		return nil, fmt.Errorf("SendArchive: unknown compression %d", compression)
+	}
+
+	settings := currentCompressionSettings()
+	pr, pw := io.Pipe()
+
+	// Compressors can write headers right away, so they are created in
+	// the goroutine that feeds the pipe
+	go func() {
+		pw.CloseWithError(compressTo(pw, tar, compression, settings))
+	}()
+
+	return pr, nil
+}
+
+func compressTo(w io.Writer, tar io.Reader, compression archiveCompression, settings *compressionSettings) error {
+	compressor, err := compression.newWriter(w, settings)
+	if err != nil {
+		return fmt.Errorf("compressor: %v", err)
+	}
+
+	_, err = io.Copy(compressor, tar)
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// streamCompressor runs a compressor that cannot be split up while it
+// holds a token. The output is buffered so that a slow client never
+// keeps a token.
+type streamCompressor struct {
+	w          io.Writer
+	settings   *compressionSettings
+	buf        bytes.Buffer
+	compressor io.WriteCloser
+}
+
+func newStreamCompressor(w io.Writer, settings *compressionSettings, newCompressor func(io.Writer) (io.WriteCloser, error)) (*streamCompressor, error) {
+	s := &streamCompressor{w: w, settings: settings}
+
+	var err error
+	s.withToken(func() { s.compressor, err = newCompressor(&s.buf) })
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.flush()
+}
+
+func (s *streamCompressor) withToken(f func()) {
+	s.settings.acquire()
+	defer s.settings.release()
+	f()
+}
+
+func (s *streamCompressor) flush() error {
+	_, err := s.buf.WriteTo(s.w)
+	return err
+}
+
+func (s *streamCompressor) Write(p []byte) (n int, err error) {
+	s.withToken(func() { n, err = s.compressor.Write(p) })
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.flush()
+}
+
+func (s *streamCompressor) Close() (err error) {
+	s.withToken(func() { err = s.compressor.Close() })
+	if err != nil {
+		return err
+	}
+
+	return s.flush()
+}
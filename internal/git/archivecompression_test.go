@@ -0,0 +1,153 @@
+package git
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestCompressArchive(t *testing.T) {
+	tar := bytes.Repeat([]byte("archive contents "), 100000)
+
+	for _, testCase := range []struct {
+		desc        string
+		compression archiveCompression
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{"xz", compressionXz, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }},
+		{"zstd", compressionZstd, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"gzip", compressionGzip, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"bzip2", compressionBzip2, func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			compressed, err := compressArchive(bytes.NewReader(tar), testCase.compression)
+			require.NoError(t, err)
+			defer compressed.Close()
+
+			data, err := ioutil.ReadAll(compressed)
+			require.NoError(t, err)
+			require.True(t, len(data) < len(tar)/100)
+
+			decompressed, err := testCase.decompress(bytes.NewReader(data))
+			require.NoError(t, err)
+			out, err := ioutil.ReadAll(decompressed)
+			require.NoError(t, err)
+			require.Equal(t, tar, out)
+		})
+	}
+}
+
+func TestCompressArchiveClosedEarly(t *testing.T) {
+	compressed, err := compressArchive(io.MultiReader(bytes.NewReader(make([]byte, 1<<20)), infiniteReader{}), compressionZstd)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(compressed, make([]byte, 16))
+	require.NoError(t, err)
+	require.NoError(t, compressed.Close())
+}
+
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i)
+	}
+	return len(p), nil
+}
+
+func TestCompressArchiveSourceError(t *testing.T) {
+	compressed, err := compressArchive(io.MultiReader(bytes.NewReader([]byte("partial")), errReader{}), compressionXz)
+	require.NoError(t, err)
+	defer compressed.Close()
+
+	_, err = ioutil.ReadAll(compressed)
+	require.Equal(t, errBrokenArchive, err)
+}
+
+var errBrokenArchive = errors.New("git archive failed")
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errBrokenArchive }
+
+func gzipWithBlocks(t *testing.T, data []byte, blockSize int, settings *compressionSettings) []byte {
+	buf := &bytes.Buffer{}
+	g := newGzipWriter(buf, settings)
+	g.blockSize = blockSize
+
+	// Uneven writes cross block boundaries
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := g.Write(data[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+	require.NoError(t, g.Close())
+
+	return buf.Bytes()
+}
+
+func TestGzipWriterIsDeterministic(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 300000)
+	for i := range data {
+		// Compressible, with matches across block boundaries
+		data[i] = "abcdefgh"[rng.Intn(8)]
+	}
+
+	serial := newCompressionSettings(&config.ArchiveConfig{CompressionWorkers: 1})
+	parallel := newCompressionSettings(&config.ArchiveConfig{CompressionWorkers: 8, ParallelGzip: true})
+
+	for _, blockSize := range []int{10000, 50000, gzipBlockSize} {
+		expected := gzipWithBlocks(t, data, blockSize, serial)
+		require.Equal(t, expected, gzipWithBlocks(t, data, blockSize, parallel), "block size %d", blockSize)
+
+		require.Equal(t, gzipHeader, expected[:len(gzipHeader)])
+		reader, err := gzip.NewReader(bytes.NewReader(expected))
+		require.NoError(t, err)
+		require.Equal(t, "", reader.Name)
+		require.True(t, reader.ModTime.IsZero())
+		out, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+	}
+
+	require.Empty(t, serial.tokens)
+	require.Empty(t, parallel.tokens)
+}
+
+func TestGzipWriterEmptyInput(t *testing.T) {
+	data := gzipWithBlocks(t, nil, gzipBlockSize, newCompressionSettings(nil))
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Empty(t, out)
+}
+
+func TestConfigureArchive(t *testing.T) {
+	defer ConfigureArchive(nil)
+
+	ConfigureArchive(&config.ArchiveConfig{CompressionWorkers: 3, ParallelGzip: true})
+	settings := currentCompressionSettings()
+	require.Equal(t, 3, cap(settings.tokens))
+	require.Equal(t, 3, newGzipWriter(ioutil.Discard, settings).maxPending)
+
+	ConfigureArchive(nil)
+	require.Equal(t, 1, newGzipWriter(ioutil.Discard, currentCompressionSettings()).maxPending)
+}
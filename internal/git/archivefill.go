@@ -0,0 +1,270 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+// archiveFills are the archives being generated by this process, by the
+// key of their destination. Requests for an archive that is being
+// generated follow its temporary file instead of generating it again.
+// The mutex only guards the map; no file system access happens with it
+// held.
+var archiveFills = &archiveFillSet{fills: make(map[string]*archiveFill)}
+
+type archiveFillSet struct {
+	mutex sync.Mutex
+	fills map[string]*archiveFill
+}
+
+// archiveFill is an entry of archiveFills. Its temporary file is created
+// after the entry is added, ready is closed once fill or err is set.
+type archiveFill struct {
+	ready chan struct{}
+	fill  *cacheFill
+	err   error
+}
+
+// errArchiveFillGone is returned for a fill that ended before it could be
+// followed. Its archive is in the cache by now, or has to be generated
+// again.
+var errArchiveFillGone = errors.New("SendArchive: fill ended")
+
+// archiveDestination is where a generated archive is cached
+type archiveDestination struct {
+	// key identifies the archive among the fills of this process
+	key      string
+	filename string
+	tempDir  string
+	// store caches the complete temporary file and closes it
+	store func(tempFile *os.File) error
+	// storeLater runs store after the clients of the fill have been
+	// served. Clients that arrive in the meantime still follow the fill.
+	storeLater bool
+	// stored tells whether a fill that just ended stored the archive
+	// already. It may be nil.
+	stored func() bool
+}
+
+// serveCached serves the archive from the cache, or generates it once for
+// all clients asking for it at the same time
+func (a *archive) serveCached(w http.ResponseWriter, r *http.Request, format archiveFormat, archivePath string, generate func(context.Context, io.Writer) error) {
+	dest := a.cachedArchiveDestination(archivePath)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if cachedArchive, err := os.Open(archivePath); err == nil {
+			a.serveFile(w, r, format, archivePath, cachedArchive)
+			return
+		}
+
+		if a.serveFill(w, r, format, dest, generate) != errArchiveFillGone {
+			return
+		}
+	}
+
+	helper.Fail500(w, r, errArchiveFillGone)
+}
+
+// cachedArchiveDestination is archivePath in the archive cache directory
+func (a *archive) cachedArchiveDestination(archivePath string) archiveDestination {
+	return archiveDestination{
+		key:      archivePath,
+		filename: path.Base(archivePath),
+		tempDir:  path.Dir(archivePath),
+		store: func(tempFile *os.File) error {
+			if err := finalizeCachedArchive(tempFile, archivePath); err != nil {
+				return err
+			}
+			a.cache.added(archivePath)
+			return nil
+		},
+		stored: func() bool {
+			_, err := os.Stat(archivePath)
+			return err == nil
+		},
+	}
+}
+
+// serveFill serves the archive that is generated for dest. It returns
+// errArchiveFillGone, without writing a response, if the fill that it
+// joined ended in the meantime.
+func (a *archive) serveFill(w http.ResponseWriter, r *http.Request, format archiveFormat, dest archiveDestination, generate func(context.Context, io.Writer) error) error {
+	fill, reader, result, err := joinArchiveFill(r.Context(), dest, generate)
+	if err == errArchiveFillGone {
+		return err
+	}
+	if err != nil {
+		helper.Fail500(w, r, err)
+		return nil
+	}
+	defer fill.unfollow(reader)
+
+	gitArchiveCache.WithLabelValues(result).Inc()
+
+	if err := fill.started(r.Context()); err != nil {
+		failArchive(w, r, err)
+		return nil
+	}
+
+	// Start writing the response
+	setArchiveHeaders(w, format, dest.filename)
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+	if err := fill.copyTo(r.Context(), w, reader); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
+	}
+	return nil
+}
+
+// joinArchiveFill follows the fill of dest, which is started if there is
+// none yet, and tells whether the archive is coalesced or a miss. The
+// caller must unfollow the returned reader. The generation keeps the
+// values of ctx, such as the correlation ID, but not its cancellation.
+func joinArchiveFill(ctx context.Context, dest archiveDestination, generate func(context.Context, io.Writer) error) (*cacheFill, *os.File, string, error) {
+	archiveFills.mutex.Lock()
+	entry, ok := archiveFills.fills[dest.key]
+	if !ok {
+		entry = &archiveFill{ready: make(chan struct{})}
+		archiveFills.fills[dest.key] = entry
+	}
+	archiveFills.mutex.Unlock()
+
+	if !ok {
+		fill, reader, err := startArchiveFill(ctx, entry, dest, generate)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return fill, reader, "miss", nil
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return nil, nil, "", ctx.Err()
+	}
+	if entry.err != nil {
+		return nil, nil, "", entry.err
+	}
+
+	reader, err := entry.fill.follow()
+	if os.IsNotExist(err) {
+		// The temporary file was removed after the fill ended
+		return nil, nil, "", errArchiveFillGone
+	}
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("SendArchive: follow fill: %v", err)
+	}
+
+	return entry.fill, reader, "coalesced", nil
+}
+
+// startArchiveFill creates the temporary file of entry, which has just
+// been added to archiveFills, and starts generating the archive. It is
+// generated independently of the request that started it, and cancelled
+// when no client is left.
+func startArchiveFill(ctx context.Context, entry *archiveFill, dest archiveDestination, generate func(context.Context, io.Writer) error) (*cacheFill, *os.File, error) {
+	defer close(entry.ready)
+
+	if dest.stored != nil && dest.stored() {
+		// Stored by a fill that ended after the caller looked
+		entry.err = errArchiveFillGone
+		forgetArchiveFill(entry, dest)
+		return nil, nil, entry.err
+	}
+
+	// We create the tempfile in the same directory as the final cached
+	// archive we want to create so that we can use an atomic link(2)
+	// operation to finalize the cached archive.
+	tempFile, err := prepareArchiveTempfile(dest.tempDir, dest.filename)
+	if err != nil {
+		entry.err = fmt.Errorf("SendArchive: create tempfile: %v", err)
+		forgetArchiveFill(entry, dest)
+		return nil, nil, entry.err
+	}
+
+	fillCtx, cancel := context.WithCancel(detachedContext{ctx})
+	fill := newCacheFill(tempFile, cancel)
+	reader, err := fill.follow()
+	if err != nil {
+		cancel()
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		entry.err = fmt.Errorf("SendArchive: follow fill: %v", err)
+		forgetArchiveFill(entry, dest)
+		return nil, nil, entry.err
+	}
+	entry.fill = fill
+
+	go func() {
+		err := generate(fillCtx, fill)
+		cancel()
+		finishArchiveFill(entry, dest, err)
+	}()
+
+	return fill, reader, nil
+}
+
+func finishArchiveFill(entry *archiveFill, dest archiveDestination, err error) {
+	fill := entry.fill
+
+	if err == nil && dest.storeLater {
+		// Clients keep following the complete temporary file while it is
+		// stored
+		fill.finish(nil)
+		storeArchiveFill(fill, dest)
+		forgetArchiveFill(entry, dest)
+		os.Remove(fill.file.Name())
+		return
+	}
+
+	if err == nil {
+		storeArchiveFill(fill, dest)
+	} else {
+		fill.file.Close()
+	}
+	// Clients that arrive from now on find the stored archive, or start
+	// again
+	forgetArchiveFill(entry, dest)
+	os.Remove(fill.file.Name())
+
+	fill.finish(err)
+}
+
+func storeArchiveFill(fill *cacheFill, dest archiveDestination) {
+	if err := dest.store(fill.file); err != nil {
+		// The archive is complete, it is just not cached
+		log.WithFields(context.Background(), log.Fields{"archive": dest.filename}).WithError(err).Warning("SendArchive: store cached archive")
+	}
+}
+
+func forgetArchiveFill(entry *archiveFill, dest archiveDestination) {
+	archiveFills.mutex.Lock()
+	defer archiveFills.mutex.Unlock()
+
+	if archiveFills.fills[dest.key] == entry {
+		delete(archiveFills.fills, dest.key)
+	}
+}
+
+// detachedContext keeps the values of a request context, such as the
+// correlation ID and the access log fields, without its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
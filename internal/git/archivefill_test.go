@@ -0,0 +1,209 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+var testArchiveFormat = archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}
+
+func serveTestArchive(archivePath string, generate func(context.Context, io.Writer) error) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/archive.tar.gz", nil)
+	SendArchive.serveCached(w, r, testArchiveFormat, archivePath, generate)
+	return w
+}
+
+func archiveFillFollowers(archivePath string) int {
+	archiveFills.mutex.Lock()
+	defer archiveFills.mutex.Unlock()
+
+	entry := archiveFills.fills[archivePath]
+	if entry == nil {
+		return 0
+	}
+	select {
+	case <-entry.ready:
+	default:
+		return 0
+	}
+	fill := entry.fill
+	fill.mutex.Lock()
+	defer fill.mutex.Unlock()
+	return fill.followers
+}
+
+func TestArchiveFillCoalescesMisses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "project-1", "archive.tar.gz")
+
+	var calls int32
+	proceed := make(chan struct{})
+	generate := func(_ context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, "first half ")
+		<-proceed
+		_, err := io.WriteString(w, "second half")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 5)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serveTestArchive(archivePath, generate)
+		}(i)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); archiveFillFollowers(archivePath) < len(responses); time.Sleep(time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "clients did not join the fill")
+	}
+
+	close(proceed)
+	wg.Wait()
+
+	require.Equal(t, int32(1), calls)
+	for _, response := range responses {
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "first half second half", response.Body.String())
+		require.Equal(t, `attachment; filename="archive.tar.gz"`, response.Header().Get("Content-Disposition"))
+	}
+
+	cached, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.Equal(t, "first half second half", string(cached))
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(filepath.Dir(archivePath))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// Later requests are served from the cache
+	response := serveTestArchive(archivePath, generate)
+	require.Equal(t, "first half second half", response.Body.String())
+	require.Equal(t, int32(1), calls)
+}
+
+func TestArchiveFillErrorBeforeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+
+	response := serveTestArchive(archivePath, func(context.Context, io.Writer) error {
+		return errors.New("gitaly went away")
+	})
+	require.Equal(t, 500, response.Code)
+
+	_, err = os.Stat(archivePath)
+	require.True(t, os.IsNotExist(err))
+	require.Empty(t, archiveFills.fills)
+}
+
+func TestArchiveFillErrorAfterData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+
+	response := serveTestArchive(archivePath, func(_ context.Context, w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("gitaly went away")
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "partial", response.Body.String())
+
+	_, err = os.Stat(archivePath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestArchiveFillCancelledWithoutClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+
+	cancelled := make(chan struct{})
+	generate := func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/archive.tar.gz", nil).WithContext(ctx)
+	SendArchive.serveCached(w, r, testArchiveFormat, archivePath, generate)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fill was not cancelled")
+	}
+}
+
+type testContextKey struct{}
+
+func TestArchiveFillKeepsRequestValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+
+	var value interface{}
+	var fillErr error
+	generate := func(ctx context.Context, w io.Writer) error {
+		value, fillErr = ctx.Value(testContextKey{}), ctx.Err()
+		_, err := io.WriteString(w, "archive")
+		return err
+	}
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "correlation-id")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/archive.tar.gz", nil).WithContext(ctx)
+	SendArchive.serveCached(w, r, testArchiveFormat, archivePath, generate)
+
+	require.Equal(t, "archive", w.Body.String())
+	require.Equal(t, "correlation-id", value)
+	require.NoError(t, fillErr)
+}
+
+func TestArchiveFillCacheHitsDoNotWaitForFills(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar.gz")
+	require.NoError(t, ioutil.WriteFile(archivePath, []byte("cached"), 0600))
+
+	archiveFills.mutex.Lock()
+	defer archiveFills.mutex.Unlock()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveTestArchive(archivePath, nil)
+	}()
+
+	select {
+	case response := <-done:
+		require.Equal(t, "cached", response.Body.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache hit waited for archiveFills.mutex")
+	}
+}
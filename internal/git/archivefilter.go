@@ -0,0 +1,372 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var (
+	archiveFilterRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_filter_requests",
+			Help: "How many archives of a subtree have been filtered from the archive of the whole tree sent by Gitaly.",
+		},
+	)
+
+	archiveFilterReadBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_filter_read_bytes",
+			Help: "How many bytes of whole-tree TAR archives have been read from Gitaly to filter archives of a subtree.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(archiveFilterRequests)
+	prometheus.MustRegister(archiveFilterReadBytes)
+}
+
+// An archive of a subtree contains Path without the subtrees in Exclude,
+// plus the directories above Path. Paths are relative to the root of the
+// repository and are matched literally, like git archive does with
+// ':(literal)' pathspecs.
+
+func (params *archiveParams) filtered() bool {
+	return params.Path != "" || len(params.Exclude) > 0
+}
+
+func validateArchivePath(p string) error {
+	if p == "" || p == "." || path.Clean(p) != p || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("invalid path %q", p)
+	}
+	return nil
+}
+
+// validateFilter rejects paths that are not clean and relative
+func (params *archiveParams) validateFilter() error {
+	if params.Path != "" {
+		if err := validateArchivePath(params.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, exclude := range params.Exclude {
+		if err := validateArchivePath(exclude); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pathspecs are the pathspecs of git archive for Path and Exclude
+func (params *archiveParams) pathspecs() []string {
+	var pathspecs []string
+	if params.Path != "" {
+		pathspecs = append(pathspecs, ":(literal)"+params.Path)
+	}
+	for _, exclude := range params.Exclude {
+		pathspecs = append(pathspecs, ":(exclude,literal)"+exclude)
+	}
+	return pathspecs
+}
+
+// checkArchivePath makes sure that Path exists in the commit before git
+// archive is started. For a pathspec that matches nothing, git archive
+// exits without writing anything, which would end up as a failed or an
+// empty download instead of a 404.
+func checkArchivePath(params archiveParams) error {
+	if params.Path == "" {
+		return nil
+	}
+
+	cmd := gitCommand("git", "--git-dir="+params.RepoPath, "rev-parse", "--verify", "--quiet", params.CommitId+":"+params.Path)
+	err := cmd.Run()
+	if st, ok := helper.ExitStatus(err); ok && st == 1 {
+		return &archivePathNotFoundError{path: params.Path}
+	}
+	if err != nil {
+		return fmt.Errorf("SendArchive: check path: %v", err)
+	}
+
+	return nil
+}
+
+// archiveCachePath is where the archive of params is cached. Archives of
+// a subtree are kept in a subdirectory named after Path and Exclude, so
+// that they never share a cache entry with other archives of the commit.
+func archiveCachePath(params archiveParams, format archiveFormat, archivePath string) string {
+	archivePath = format.cachePath(archivePath)
+	if !params.filtered() {
+		return archivePath
+	}
+
+	key := sha256.Sum256([]byte(strings.Join(append([]string{params.Path}, params.Exclude...), "\x00")))
+	return path.Join(path.Dir(archivePath), fmt.Sprintf("filtered-%x", key), path.Base(archivePath))
+}
+
+// isUnderPath tells whether the relative path name is p or inside it
+func isUnderPath(name string, p string) bool {
+	return name == p || strings.HasPrefix(name, p+"/")
+}
+
+// includes tells whether an entry of a TAR archive belongs to the archive
+// of a subtree
+func (params *archiveParams) includes(hdr *tar.Header) bool {
+	name := strings.TrimPrefix(hdr.Name, params.ArchivePrefix+"/")
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return true
+	}
+
+	for _, exclude := range params.Exclude {
+		if isUnderPath(name, exclude) {
+			return false
+		}
+	}
+
+	if params.Path == "" || isUnderPath(name, params.Path) {
+		return true
+	}
+
+	return hdr.Typeflag == tar.TypeDir && strings.HasPrefix(params.Path, name+"/")
+}
+
+// archivePathNotFoundError is returned when Path matches no file of the
+// commit
+type archivePathNotFoundError struct {
+	path string
+}
+
+func (e *archivePathNotFoundError) Error() string {
+	return fmt.Sprintf("filter archive: path %q did not match any files", e.path)
+}
+
+// filterArchive reduces the TAR archive of a whole tree to the archive of
+// a subtree. The GetArchive RPC of our Gitaly protocol version cannot do
+// this itself, so Gitaly still builds and sends the whole tree. With
+// zipOutput, the result is written as a ZIP archive. filterArchive returns
+// once Path has matched, so that a path that matches nothing fails before
+// anything is written.
+func filterArchive(tarReader io.Reader, params archiveParams, zipOutput bool) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	matched := make(chan struct{})
+	errC := make(chan error, 1)
+
+	go func() {
+		err := filterArchiveTo(pw, tarReader, params, zipOutput, func() { close(matched) })
+		errC <- err
+		pw.CloseWithError(err)
+	}()
+
+	select {
+	case <-matched:
+		return pr, nil
+	case err := <-errC:
+		if err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}
+}
+
+// heldWriter keeps what is written to it until it is released
+type heldWriter struct {
+	w    io.Writer
+	held *bytes.Buffer
+}
+
+func (h *heldWriter) Write(p []byte) (int, error) {
+	if h.held != nil {
+		return h.held.Write(p)
+	}
+	return h.w.Write(p)
+}
+
+func (h *heldWriter) release() error {
+	held := h.held
+	h.held = nil
+	if held.Len() == 0 {
+		return nil
+	}
+	_, err := h.w.Write(held.Bytes())
+	return err
+}
+
+// filterArchiveTo calls onMatch before it writes anything to w
+func filterArchiveTo(w io.Writer, r io.Reader, params archiveParams, zipOutput bool, onMatch func()) error {
+	out := &heldWriter{w: w, held: &bytes.Buffer{}}
+	counter := &countingReader{r: r}
+	defer func() { archiveFilterReadBytes.Add(float64(counter.n)) }()
+
+	var add func(*tar.Header, io.Reader) error
+	var archiveWriter io.Closer
+	if zipOutput {
+		commented := &zipCommentWriter{w: out, comment: params.CommitId}
+		zipWriter := zip.NewWriter(commented)
+		add = func(hdr *tar.Header, body io.Reader) error { return addZipEntry(zipWriter, hdr, body) }
+		archiveWriter = multiCloser{zipWriter, commented}
+	} else {
+		tarWriter := tar.NewWriter(out)
+		add = func(hdr *tar.Header, body io.Reader) error {
+			if err := tarWriter.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tarWriter, body)
+			return err
+		}
+		archiveWriter = tarWriter
+	}
+
+	match := func() error {
+		onMatch()
+		return out.release()
+	}
+
+	matched := params.Path == ""
+	if matched {
+		if err := match(); err != nil {
+			return fmt.Errorf("filter archive: write: %v", err)
+		}
+	}
+
+	tarReader := tar.NewReader(counter)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("filter archive: read: %v", err)
+		}
+
+		// The global header holds the commit ID
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			if !params.includes(hdr) {
+				continue
+			}
+			if !matched && isUnderPath(strings.TrimPrefix(hdr.Name, params.ArchivePrefix+"/"), params.Path) {
+				matched = true
+				if err := match(); err != nil {
+					return fmt.Errorf("filter archive: write: %v", err)
+				}
+			}
+		}
+
+		if err := add(hdr, tarReader); err != nil {
+			return fmt.Errorf("filter archive: write: %v", err)
+		}
+	}
+
+	if !matched {
+		return &archivePathNotFoundError{path: params.Path}
+	}
+
+	if err := archiveWriter.Close(); err != nil {
+		return fmt.Errorf("filter archive: write: %v", err)
+	}
+
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (closers multiCloser) Close() error {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipCommentWriter sets the comment of a ZIP archive, like git archive
+// does with the commit ID. zip.Writer ends the archive with the length of
+// an empty comment; the last two bytes written are held back and replaced
+// on Close.
+type zipCommentWriter struct {
+	w       io.Writer
+	comment string
+	tail    []byte
+}
+
+func (z *zipCommentWriter) Write(p []byte) (int, error) {
+	buf := append(z.tail, p...)
+	if len(buf) <= 2 {
+		z.tail = buf
+		return len(p), nil
+	}
+
+	if _, err := z.w.Write(buf[:len(buf)-2]); err != nil {
+		return 0, err
+	}
+	z.tail = append([]byte(nil), buf[len(buf)-2:]...)
+	return len(p), nil
+}
+
+func (z *zipCommentWriter) Close() error {
+	if len(z.comment) > 0xffff || len(z.tail) != 2 || z.tail[0] != 0 || z.tail[1] != 0 {
+		// Not the end of a ZIP archive without comment
+		_, err := z.w.Write(z.tail)
+		return err
+	}
+
+	length := []byte{byte(len(z.comment)), byte(len(z.comment) >> 8)}
+	_, err := z.w.Write(append(length, z.comment...))
+	return err
+}
+
+func addZipEntry(zipWriter *zip.Writer, hdr *tar.Header, body io.Reader) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir, tar.TypeReg:
+	case tar.TypeSymlink:
+		// ZIP archives store the target of a symlink as its content
+		body = strings.NewReader(hdr.Linkname)
+	default:
+		return nil
+	}
+
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return err
+	}
+	fh.Name = hdr.Name
+	if hdr.Typeflag == tar.TypeDir {
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+		fh.Method = zip.Store
+	} else if hdr.Typeflag == tar.TypeSymlink {
+		fh.Method = zip.Store
+	} else {
+		fh.Method = zip.Deflate
+	}
+
+	entry, err := zipWriter.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, body)
+	return err
+}
@@ -0,0 +1,207 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+// newFilterTestRepo creates a repository with a few nested directories
+func newFilterTestRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archive-filter")
+	require.NoError(t, err)
+
+	files := map[string]string{
+		"README":          "readme",
+		"docs/index.md":   "index",
+		"docs/big/a.bin":  "big",
+		"docs/api/v4.md":  "v4",
+		"docsets/other":   "other",
+		"src/main.go":     "package main",
+		"src/docs/readme": "nested",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+	}
+
+	return dir
+}
+
+func readArchive(t *testing.T, params archiveParams, format pb.GetArchiveRequest_Format, pathspecs []string) []byte {
+	reader, err := newArchiveReader(context.Background(), filepath.Join(params.RepoPath, ".git"), format, params.ArchivePrefix, "HEAD", pathspecs)
+	require.NoError(t, err)
+	archive, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return archive
+}
+
+func headCommit(t *testing.T, repo string) string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = repo
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func openFilteredArchive(t *testing.T, whole []byte, params archiveParams, zipOutput bool) io.Reader {
+	reader, err := filterArchive(bytes.NewReader(whole), params, zipOutput)
+	require.NoError(t, err)
+	return reader
+}
+
+func tarEntries(t *testing.T, archive []byte) []string {
+	var names []string
+	tarReader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return names
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, hdr.Name)
+		}
+	}
+}
+
+func TestFilterArchiveMatchesGitArchive(t *testing.T) {
+	repo := newFilterTestRepo(t)
+	defer os.RemoveAll(repo)
+
+	testCases := []struct {
+		path    string
+		exclude []string
+	}{
+		{path: "docs"},
+		{path: "docs/api"},
+		{path: "docs/index.md"},
+		{path: "docs", exclude: []string{"docs/big"}},
+		{exclude: []string{"docs", "src/main.go"}},
+	}
+
+	for _, tc := range testCases {
+		params := archiveParams{RepoPath: repo, ArchivePrefix: "project-v1.0", CommitId: headCommit(t, repo), Path: tc.path, Exclude: tc.exclude}
+		require.NoError(t, params.validateFilter())
+
+		expected := tarEntries(t, readArchive(t, params, pb.GetArchiveRequest_TAR, params.pathspecs()))
+		require.NotEmpty(t, expected)
+
+		// Gitaly sends the archive of the whole tree
+		whole := readArchive(t, params, pb.GetArchiveRequest_TAR, nil)
+		filtered, err := ioutil.ReadAll(openFilteredArchive(t, whole, params, false))
+		require.NoError(t, err)
+		require.Equal(t, expected, tarEntries(t, filtered), "path %q, exclude %v", tc.path, tc.exclude)
+
+		zipped, err := ioutil.ReadAll(openFilteredArchive(t, whole, params, true))
+		require.NoError(t, err)
+		zipReader, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+		require.NoError(t, err)
+		require.Equal(t, params.CommitId, zipReader.Comment, "commit ID like git archive")
+		var zipNames []string
+		for _, file := range zipReader.File {
+			zipNames = append(zipNames, file.Name)
+		}
+		require.Equal(t, expected, zipNames, "path %q, exclude %v", tc.path, tc.exclude)
+	}
+}
+
+func TestFilterArchivePathNotFound(t *testing.T) {
+	repo := newFilterTestRepo(t)
+	defer os.RemoveAll(repo)
+
+	params := archiveParams{RepoPath: repo, ArchivePrefix: "project-v1.0", Path: "doc"}
+	whole := readArchive(t, params, pb.GetArchiveRequest_TAR, nil)
+	_, err := filterArchive(bytes.NewReader(whole), params, false)
+	require.Equal(t, &archivePathNotFoundError{path: "doc"}, err, "fails before anything is read")
+
+	w := httptest.NewRecorder()
+	failArchive(w, httptest.NewRequest("GET", "/archive.tar.gz", nil), err)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestOpenArchivePathNotFound(t *testing.T) {
+	repo := newFilterTestRepo(t)
+	defer os.RemoveAll(repo)
+
+	params := archiveParams{RepoPath: filepath.Join(repo, ".git"), ArchivePrefix: "project-v1.0", CommitId: headCommit(t, repo), Path: "doc"}
+	format := archiveFormat{format: pb.GetArchiveRequest_TAR_GZ}
+
+	// git archive itself would exit without output
+	_, err := openArchive(context.Background(), params, format)
+	require.Equal(t, &archivePathNotFoundError{path: "doc"}, err)
+
+	params.Path = "docs/api"
+	reader, err := openArchive(context.Background(), params, format)
+	require.NoError(t, err)
+	defer reader.Close()
+	archive, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NotEmpty(t, archive)
+}
+
+func TestValidateArchiveFilter(t *testing.T) {
+	for _, params := range []archiveParams{
+		{},
+		{Path: "docs"},
+		{Path: "docs/api", Exclude: []string{"docs/api/internal"}},
+	} {
+		require.NoError(t, params.validateFilter(), "%+v", params)
+	}
+
+	for _, params := range []archiveParams{
+		{Path: "/docs"},
+		{Path: "../other"},
+		{Path: "docs/../.."},
+		{Path: "docs/"},
+		{Path: "."},
+		{Exclude: []string{""}},
+		{Exclude: []string{".."}},
+	} {
+		require.Error(t, params.validateFilter(), "%+v", params)
+	}
+}
+
+func TestFilteredArchiveCachePath(t *testing.T) {
+	format := archiveFormat{format: pb.GetArchiveRequest_ZIP}
+	whole := archiveCachePath(archiveParams{}, format, "/cache/project-1/abc/project-v1.0.zip")
+	require.Equal(t, "/cache/project-1/abc/project-v1.0.zip", whole)
+
+	docs := archiveCachePath(archiveParams{Path: "docs"}, format, "/cache/project-1/abc/project-v1.0.zip")
+	require.NotEqual(t, whole, docs)
+	require.Equal(t, "project-v1.0.zip", filepath.Base(docs))
+
+	withExclude := archiveCachePath(archiveParams{Path: "docs", Exclude: []string{"docs/big"}}, format, "/cache/project-1/abc/project-v1.0.zip")
+	require.NotEqual(t, docs, withExclude)
+
+	require.NotEqual(t, archiveObjectKey(archiveParams{}, format), archiveObjectKey(archiveParams{Path: "docs"}, format))
+	require.NotEqual(t,
+		archiveObjectKey(archiveParams{Path: "docs", Exclude: []string{"a"}}, format),
+		archiveObjectKey(archiveParams{Path: "docs", Exclude: []string{"b"}}, format),
+	)
+}
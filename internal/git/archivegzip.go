@@ -0,0 +1,183 @@
+package git
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	gzipBlockSize  = 1 << 20
+	gzipWindowSize = 32 << 10
+)
+
+// gzipHeader has neither a file name nor a modification time, like the
+// output of 'gzip -n'
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+
+type gzipBlock struct {
+	data []byte
+	err  error
+}
+
+// gzipWriter writes a single gzip member whose DEFLATE stream is made of
+// independently compressed blocks of the input. Every block uses the end
+// of the previous one as its dictionary, so the output only depends on
+// the input and not on how many blocks are compressed at the same time.
+// This keeps cached archives byte-for-byte reproducible.
+type gzipWriter struct {
+	w          io.Writer
+	settings   *compressionSettings
+	blockSize  int
+	maxPending int
+
+	block   []byte
+	dict    []byte
+	pending []chan gzipBlock
+	crc     uint32
+	size    uint32
+	started bool
+	err     error
+}
+
+func newGzipWriter(w io.Writer, settings *compressionSettings) *gzipWriter {
+	maxPending := 1
+	if settings.parallelGzip {
+		maxPending = cap(settings.tokens)
+	}
+
+	return &gzipWriter{
+		w:          w,
+		settings:   settings,
+		blockSize:  gzipBlockSize,
+		maxPending: maxPending,
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+
+	g.crc = crc32.Update(g.crc, crc32.IEEETable, p)
+	g.size += uint32(len(p))
+
+	written := 0
+	for len(p) > 0 {
+		if g.block == nil {
+			g.block = make([]byte, 0, g.blockSize)
+		}
+
+		n := copy(g.block[len(g.block):g.blockSize], p)
+		g.block = g.block[:len(g.block)+n]
+		p = p[n:]
+		written += n
+
+		if len(g.block) == g.blockSize {
+			if err := g.compressBlock(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (g *gzipWriter) Close() error {
+	if g.err != nil {
+		return g.err
+	}
+
+	if err := g.compressBlock(true); err != nil {
+		return err
+	}
+	for len(g.pending) > 0 {
+		if err := g.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[:4], g.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+	_, g.err = g.w.Write(trailer)
+	return g.err
+}
+
+// compressBlock hands the current block to a worker. Only the last block
+// ends the DEFLATE stream.
+func (g *gzipWriter) compressBlock(last bool) error {
+	for len(g.pending) >= g.maxPending {
+		if err := g.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	block, dict := g.block, g.dict
+	if len(block) >= gzipWindowSize {
+		g.dict = block[len(block)-gzipWindowSize:]
+	} else {
+		g.dict = append(append([]byte(nil), dict...), block...)
+		if len(g.dict) > gzipWindowSize {
+			g.dict = g.dict[len(g.dict)-gzipWindowSize:]
+		}
+	}
+	g.block = nil
+
+	result := make(chan gzipBlock, 1)
+	g.pending = append(g.pending, result)
+
+	g.settings.acquire()
+	go func() {
+		defer g.settings.release()
+		data, err := deflateBlock(block, dict, last)
+		result <- gzipBlock{data: data, err: err}
+	}()
+
+	return nil
+}
+
+// writeBlock writes the oldest pending block once it is compressed
+func (g *gzipWriter) writeBlock() error {
+	result := <-g.pending[0]
+	g.pending = g.pending[1:]
+
+	if result.err != nil {
+		g.err = result.err
+		return g.err
+	}
+
+	if !g.started {
+		if _, g.err = g.w.Write(gzipHeader); g.err != nil {
+			return g.err
+		}
+		g.started = true
+	}
+
+	_, g.err = g.w.Write(result.data)
+	return g.err
+}
+
+func deflateBlock(block []byte, dict []byte, last bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fw, err := flate.NewWriterDict(buf, flate.DefaultCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(block); err != nil {
+		return nil, err
+	}
+
+	// A sync flush ends the block on a byte boundary, so that the next
+	// block can be appended to it
+	if last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+
+	return buf.Bytes(), err
+}
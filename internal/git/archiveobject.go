@@ -0,0 +1,207 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
+)
+
+// archiveObjectParams is the cached archive in object storage. Rails
+// sends it instead of caching archives in ArchivePath, and presigns its
+// URLs for an object keyed by the project, commit, prefix, format, Path
+// and Exclude of the archive, so that all workhorse nodes share the
+// cache.
+type archiveObjectParams struct {
+	// GetURL, StoreURL and the upload settings of the object. DeleteURL is
+	// not used: the archive stays for later requests.
+	api.RemoteObject
+	// Redirect sends clients to GetURL on a hit instead of streaming the
+	// archive through workhorse
+	Redirect bool
+}
+
+// Headers of object storage responses that are passed on to clients
+var archiveObjectHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "ETag", "Last-Modified"}
+
+var (
+	archiveObjectRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_object_requests",
+			Help: "How many archives cached in object storage have been requested, partitioned by result (hit, redirect, miss, error).",
+		},
+		[]string{"result"},
+	)
+
+	archiveObjectUploads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_object_uploads",
+			Help: "How many generated archives have been uploaded to object storage, partitioned by result (success, error).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(archiveObjectRequests)
+	prometheus.MustRegister(archiveObjectUploads)
+}
+
+// archiveObjectClient is as restrictive as the HTTP clients of
+// objectstore and sendurl
+var archiveObjectClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          2,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// archiveObjectKey identifies an archive independently of where Rails
+// would cache it on disk. Exclude comes last, so that keys of different
+// archives never collide.
+func archiveObjectKey(params archiveParams, format archiveFormat) string {
+	project := params.RepoPath
+	if params.GitalyServer.Address != "" {
+		project = params.GitalyRepository.StorageName + ":" + params.GitalyRepository.RelativePath
+	}
+
+	fields := []string{"object", project, params.CommitId, params.ArchivePrefix, format.String(), params.Path}
+	return strings.Join(append(fields, params.Exclude...), "\x00")
+}
+
+// serveObject serves the archive from object storage, or generates it
+// once for all clients asking for it at the same time and uploads it
+func (a *archive) serveObject(w http.ResponseWriter, r *http.Request, params archiveParams, format archiveFormat, filename string, generate func(context.Context, io.Writer) error) {
+	object := params.ArchiveObject
+
+	resp, err := getArchiveObject(r, object.GetURL, object.Redirect)
+	if err != nil {
+		// Object storage being unavailable does not stop downloads
+		archiveObjectRequests.WithLabelValues("error").Inc()
+		helper.LogError(r, fmt.Errorf("SendArchive: %v", err))
+	}
+
+	if resp != nil {
+		defer resp.Body.Close()
+		gitArchiveCache.WithLabelValues("hit").Inc()
+
+		if object.Redirect {
+			archiveObjectRequests.WithLabelValues("redirect").Inc()
+			http.Redirect(w, r, object.GetURL, http.StatusFound)
+			return
+		}
+
+		archiveObjectRequests.WithLabelValues("hit").Inc()
+		setArchiveHeaders(w, format, filename)
+		for _, header := range archiveObjectHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy archive object: %v", err)})
+		}
+		return
+	}
+
+	if err == nil {
+		archiveObjectRequests.WithLabelValues("miss").Inc()
+	}
+
+	dest := archiveDestination{
+		key:      archiveObjectKey(params, format),
+		filename: filename,
+		tempDir:  os.TempDir(),
+		store: func(tempFile *os.File) error {
+			if err := tempFile.Close(); err != nil {
+				return err
+			}
+			return uploadArchiveObject(tempFile.Name(), object.RemoteObject)
+		},
+		storeLater: true,
+	}
+	// A fill that ended just now is followed by a new one
+	if a.serveFill(w, r, format, dest, generate) == errArchiveFillGone {
+		if a.serveFill(w, r, format, dest, generate) == errArchiveFillGone {
+			helper.Fail500(w, r, errArchiveFillGone)
+		}
+	}
+}
+
+// getArchiveObject requests the archive from object storage. It returns
+// nil if the archive is not there yet. To check for a redirect only the
+// first byte is requested, otherwise the Range headers of the client are
+// passed on.
+func getArchiveObject(r *http.Request, getURL string, redirect bool) (*http.Response, error) {
+	req, err := http.NewRequest("GET", getURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET %q: %v", helper.ScrubURLParams(getURL), redact.Error(err))
+	}
+	req = req.WithContext(r.Context())
+
+	if redirect {
+		req.Header.Set("Range", "bytes=0-0")
+	} else {
+		for _, header := range []string{"Range", "If-Range"} {
+			if value := r.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+
+	resp, err := archiveObjectClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %q: %v", helper.ScrubURLParams(getURL), redact.Error(err))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return resp, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		// S3 answers 403 for missing objects without the permission to list them
+		resp.Body.Close()
+		return nil, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %q: %s", helper.ScrubURLParams(getURL), resp.Status)
+	}
+}
+
+// uploadArchiveObject stores the generated archive in object storage
+// with the objectstore upload code
+func uploadArchiveObject(archivePath string, object api.RemoteObject) error {
+	opts := filestore.GetOpts(&api.Response{RemoteObject: object})
+	opts.PresignedDelete = ""
+
+	ctx, cancel := context.WithDeadline(context.Background(), opts.Deadline)
+	defer cancel()
+
+	if _, err := filestore.SaveFileFromDisk(ctx, archivePath, opts); err != nil {
+		archiveObjectUploads.WithLabelValues("error").Inc()
+		return fmt.Errorf("upload %s: %v", path.Base(archivePath), err)
+	}
+
+	archiveObjectUploads.WithLabelValues("success").Inc()
+	return nil
+}
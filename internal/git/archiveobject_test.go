@@ -0,0 +1,169 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+// archiveObjectStore answers GET like S3 does without the permission to
+// list the bucket, and stores PUT requests
+type archiveObjectStore struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *archiveObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.Method {
+	case "GET":
+		object, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(403)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	case "PUT":
+		object, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		s.objects[r.URL.Path] = object
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(object)))
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *archiveObjectStore) get(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object, ok := s.objects[path]
+	return object, ok
+}
+
+func startArchiveObjectStore() (*archiveObjectStore, *httptest.Server) {
+	store := &archiveObjectStore{objects: make(map[string][]byte)}
+	return store, httptest.NewServer(store)
+}
+
+func serveTestArchiveObject(params archiveParams, header http.Header, generate func(context.Context, io.Writer) error) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/archive.tar.gz", nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	SendArchive.serveObject(w, r, params, testArchiveFormat, "archive.tar.gz", generate)
+	return w
+}
+
+func testArchiveObjectParams(ts *httptest.Server, redirect bool) archiveParams {
+	return archiveParams{
+		RepoPath:      "/repos/project-1.git",
+		CommitId:      "c7fbe50c7c7419d9701eebe64b1fdacc3df5b9dd",
+		ArchivePrefix: "project-1-master",
+		ArchiveObject: &archiveObjectParams{
+			RemoteObject: api.RemoteObject{
+				GetURL:   ts.URL + "/archives/project-1.tar.gz",
+				StoreURL: ts.URL + "/archives/project-1.tar.gz",
+			},
+			Redirect: redirect,
+		},
+	}
+}
+
+func TestArchiveObjectMissUploadsArchive(t *testing.T) {
+	store, ts := startArchiveObjectStore()
+	defer ts.Close()
+	params := testArchiveObjectParams(ts, false)
+
+	var calls int32
+	generate := func(_ context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := io.WriteString(w, "archive contents")
+		return err
+	}
+
+	response := serveTestArchiveObject(params, nil, generate)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "archive contents", response.Body.String())
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := store.get("/archives/project-1.tar.gz"); ok {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "archive was not uploaded")
+	}
+	object, _ := store.get("/archives/project-1.tar.gz")
+	require.Equal(t, "archive contents", string(object))
+
+	// Later requests are served from object storage
+	response = serveTestArchiveObject(params, nil, generate)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "archive contents", response.Body.String())
+	require.Equal(t, `attachment; filename="archive.tar.gz"`, response.Header().Get("Content-Disposition"))
+	require.Equal(t, int32(1), calls)
+
+	response = serveTestArchiveObject(params, http.Header{"Range": {"bytes=8-"}}, generate)
+	require.Equal(t, 206, response.Code)
+	require.Equal(t, "contents", response.Body.String())
+	require.Equal(t, "bytes 8-15/16", response.Header().Get("Content-Range"))
+}
+
+func TestArchiveObjectRedirect(t *testing.T) {
+	store, ts := startArchiveObjectStore()
+	defer ts.Close()
+	params := testArchiveObjectParams(ts, true)
+	store.objects["/archives/project-1.tar.gz"] = []byte("archive contents")
+
+	response := serveTestArchiveObject(params, nil, func(context.Context, io.Writer) error {
+		t.Fatal("archive should not be generated")
+		return nil
+	})
+	require.Equal(t, 302, response.Code)
+	require.Equal(t, params.ArchiveObject.GetURL, response.Header().Get("Location"))
+}
+
+func TestArchiveObjectUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	// The archive is still served when object storage is down
+	response := serveTestArchiveObject(testArchiveObjectParams(ts, true), nil, func(_ context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "archive contents")
+		return err
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "archive contents", response.Body.String())
+}
+
+func TestArchiveObjectKey(t *testing.T) {
+	params := archiveParams{RepoPath: "/repos/project-1.git", CommitId: "c7fbe50c", ArchivePrefix: "project-1-master"}
+	key := archiveObjectKey(params, testArchiveFormat)
+
+	otherPrefix := params
+	otherPrefix.ArchivePrefix = "project-1-c7fbe50c"
+	require.NotEqual(t, key, archiveObjectKey(otherPrefix, testArchiveFormat))
+
+	require.NotEqual(t, key, archiveObjectKey(params, archiveFormat{format: pb.GetArchiveRequest_ZIP}))
+	require.NotEqual(t, key, archiveObjectKey(params, archiveFormat{format: pb.GetArchiveRequest_TAR, compression: compressionXz}))
+}
@@ -0,0 +1,275 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	defaultArchiveWarmingWorkers   = 1
+	defaultArchiveWarmingQueueSize = 100
+	defaultArchiveWarmingTimeout   = 10 * time.Minute
+
+	// archiveWarmingNotificationPrefix starts the keys of keywatcher
+	// notifications about pushed tags
+	archiveWarmingNotificationPrefix = "workhorse:archive_warming:"
+)
+
+var defaultArchiveWarmingFormats = []string{"tar.gz", "zip"}
+
+var (
+	archiveWarmingNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_warming_notifications",
+			Help: "How many archive warming notifications have been received, partitioned by result (queued, dropped, ignored, invalid).",
+		},
+		[]string{"result"},
+	)
+
+	archiveWarmingArchives = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_warming_archives",
+			Help: "How many archives have been warmed, partitioned by result (cached, coalesced, generated, error).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(archiveWarmingNotifications)
+	prometheus.MustRegister(archiveWarmingArchives)
+}
+
+var (
+	archiveWarmersMutex sync.Mutex
+	archiveWarmers      []*ArchiveWarmer
+)
+
+// ArchiveWarmer generates the archives of new tags into the archive cache
+// before the first client asks for them. Rails publishes a keywatcher
+// notification after a tag push, with the git-archive send-data of the
+// tag as value; its ArchivePath has no extension, workhorse adds one per
+// format. Only archives inside the archive cache directory are written.
+// A nil *ArchiveWarmer warms nothing.
+type ArchiveWarmer struct {
+	archive   *archive
+	formats   []archiveFormat
+	timeout   time.Duration
+	queue     chan archiveParams
+	generator func(archiveParams, archiveFormat) func(context.Context, io.Writer) error
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// NewArchiveWarmer starts the workers and listens for notifications
+// through the Redis keywatcher channel
+func NewArchiveWarmer(cfg *config.ArchiveWarmingConfig, cache *ArchiveCache) (*ArchiveWarmer, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	w, err := newArchiveWarmer(cfg, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = defaultArchiveWarmingWorkers
+	}
+	w.start(workers)
+	redis.ListenKeys(archiveWarmingNotificationPrefix, w.handleNotification)
+
+	archiveWarmersMutex.Lock()
+	archiveWarmers = append(archiveWarmers, w)
+	archiveWarmersMutex.Unlock()
+
+	return w, nil
+}
+
+func newArchiveWarmer(cfg *config.ArchiveWarmingConfig, cache *ArchiveCache) (*ArchiveWarmer, error) {
+	if cache == nil {
+		// Notifications must not pick where archives are written
+		return nil, fmt.Errorf("NewArchiveWarmer: an archive cache is required")
+	}
+
+	names := cfg.Formats
+	if len(names) == 0 {
+		names = defaultArchiveWarmingFormats
+	}
+
+	var formats []archiveFormat
+	for _, name := range names {
+		format, ok := parseBasename("archive." + name)
+		if !ok {
+			return nil, fmt.Errorf("NewArchiveWarmer: invalid format %q", name)
+		}
+		formats = append(formats, format)
+	}
+
+	if cfg.Workers < 0 || cfg.QueueSize < 0 {
+		return nil, fmt.Errorf("NewArchiveWarmer: Workers and QueueSize must not be negative")
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultArchiveWarmingQueueSize
+	}
+
+	timeout := defaultArchiveWarmingTimeout
+	if cfg.Timeout != nil {
+		timeout = cfg.Timeout.Duration
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("NewArchiveWarmer: Timeout must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ArchiveWarmer{
+		archive:   &archive{Prefix: SendArchive.Prefix, cache: cache},
+		formats:   formats,
+		timeout:   timeout,
+		queue:     make(chan archiveParams, queueSize),
+		generator: archiveGenerator,
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+func (w *ArchiveWarmer) start(workers int) {
+	for i := 0; i < workers; i++ {
+		w.workers.Add(1)
+		go w.work()
+	}
+}
+
+// Drain stops warming and waits for the workers to return. Archives that
+// no client is waiting for are not generated to the end.
+func (w *ArchiveWarmer) Drain() {
+	if w == nil {
+		return
+	}
+
+	w.cancel()
+	w.workers.Wait()
+}
+
+// DrainArchiveWarmers drains all archive warmers of the process
+func DrainArchiveWarmers() {
+	archiveWarmersMutex.Lock()
+	warmers := archiveWarmers
+	archiveWarmersMutex.Unlock()
+
+	for _, w := range warmers {
+		w.Drain()
+	}
+}
+
+// handleNotification queues the archives of a tag. It must not block the
+// keywatcher, so tags that do not fit into the queue are dropped; their
+// archives are generated on the first download as usual.
+func (w *ArchiveWarmer) handleNotification(key, value string) {
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	var params archiveParams
+	err := w.archive.Unpack(&params, value)
+	if err == nil && params.ArchivePath == "" {
+		err = fmt.Errorf("ArchivePath is not set")
+	}
+	if err == nil && !w.archive.cache.manages(params.ArchivePath) {
+		err = fmt.Errorf("ArchivePath is outside of the archive cache")
+	}
+	if err == nil {
+		err = params.validateFilter()
+	}
+	if err != nil {
+		archiveWarmingNotifications.WithLabelValues("invalid").Inc()
+		log.WithFields(context.Background(), log.Fields{"key": key}).WithError(err).Warning("ArchiveWarmer: invalid notification")
+		return
+	}
+
+	if params.DisableCache || params.ArchiveObject != nil {
+		// Such archives are not cached in the archive cache directory
+		archiveWarmingNotifications.WithLabelValues("ignored").Inc()
+		return
+	}
+
+	select {
+	case w.queue <- params:
+		archiveWarmingNotifications.WithLabelValues("queued").Inc()
+	default:
+		archiveWarmingNotifications.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (w *ArchiveWarmer) work() {
+	defer w.workers.Done()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case params := <-w.queue:
+			for _, format := range w.formats {
+				if w.ctx.Err() != nil {
+					return
+				}
+				w.warm(params, format)
+			}
+		}
+	}
+}
+
+// warm generates one archive into the cache, unless it is cached already.
+// Downloads of the archive in the meantime follow the same fill.
+func (w *ArchiveWarmer) warm(params archiveParams, format archiveFormat) {
+	archivePath := archiveCachePath(params, format, params.ArchivePath+"."+format.String())
+	if !w.archive.cache.manages(archivePath) {
+		archiveWarmingArchives.WithLabelValues("error").Inc()
+		log.WithFields(context.Background(), log.Fields{"archive": archivePath}).Warning("ArchiveWarmer: archive is outside of the archive cache")
+		return
+	}
+
+	if _, err := os.Stat(archivePath); err == nil {
+		archiveWarmingArchives.WithLabelValues("cached").Inc()
+		return
+	}
+
+	fill, reader, result, err := joinArchiveFill(w.ctx, w.archive.cachedArchiveDestination(archivePath), w.generator(params, format))
+	if err == errArchiveFillGone {
+		// A download cached it in the meantime
+		archiveWarmingArchives.WithLabelValues("cached").Inc()
+		return
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+		err = fill.wait(ctx)
+		cancel()
+		fill.unfollow(reader)
+	}
+
+	if err != nil {
+		archiveWarmingArchives.WithLabelValues("error").Inc()
+		log.WithFields(context.Background(), log.Fields{"archive": archivePath}).WithError(err).Warning("ArchiveWarmer: warm archive")
+		return
+	}
+
+	if result == "miss" {
+		archiveWarmingArchives.WithLabelValues("generated").Inc()
+	} else {
+		archiveWarmingArchives.WithLabelValues("coalesced").Inc()
+	}
+}
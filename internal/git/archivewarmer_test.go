@@ -0,0 +1,171 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func newTestArchiveWarmer(t *testing.T, dir string, cfg *config.ArchiveWarmingConfig, generate func(context.Context, io.Writer) error) *ArchiveWarmer {
+	w, err := newArchiveWarmer(cfg, newArchiveCache(&config.ArchiveCacheConfig{Dir: dir}))
+	require.NoError(t, err)
+	w.generator = func(archiveParams, archiveFormat) func(context.Context, io.Writer) error {
+		return generate
+	}
+	return w
+}
+
+func archiveWarmingNotification(t *testing.T, archivePath string) string {
+	value, err := SendArchive.Pack(archiveParams{RepoPath: "/repos/project-1.git", CommitId: "c7fbe50c", ArchivePrefix: "project-1-v1.0", ArchivePath: archivePath})
+	require.NoError(t, err)
+	return value
+}
+
+func waitForFile(t *testing.T, path string) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		require.True(t, time.Now().Before(deadline), "%s was not created", path)
+	}
+}
+
+func TestArchiveWarmerGeneratesFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-warming")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "project-1", "c7fbe50c", "project-1-v1.0")
+
+	var calls int32
+	w := newTestArchiveWarmer(t, dir, &config.ArchiveWarmingConfig{Formats: []string{"zip", "tar.xz"}}, func(_ context.Context, out io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := io.WriteString(out, "archive contents")
+		return err
+	})
+	w.start(2)
+	defer w.Drain()
+
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, archivePath))
+
+	for _, ext := range []string{".zip", ".tar.xz"} {
+		waitForFile(t, archivePath+ext)
+		cached, err := ioutil.ReadFile(archivePath + ext)
+		require.NoError(t, err)
+		require.Equal(t, "archive contents", string(cached))
+	}
+
+	// Warming cached archives again does not generate them
+	w.warm(archiveParams{ArchivePath: archivePath}, w.formats[0])
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestArchiveWarmerDropsInvalidNotifications(t *testing.T) {
+	w := newTestArchiveWarmer(t, "/cache", &config.ArchiveWarmingConfig{QueueSize: 1}, nil)
+
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", "not base64!")
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, ""))
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, "/etc/cron.d/archive"))
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, "/cache/../etc/cron.d/archive"))
+	require.Len(t, w.queue, 0)
+
+	// Archives that are not cached on disk are not warmed
+	for _, params := range []archiveParams{
+		{ArchivePath: "/cache/a", DisableCache: true},
+		{ArchivePath: "/cache/a", ArchiveObject: &archiveObjectParams{}},
+	} {
+		value, err := SendArchive.Pack(params)
+		require.NoError(t, err)
+		w.handleNotification(archiveWarmingNotificationPrefix+"1", value)
+	}
+	require.Len(t, w.queue, 0)
+
+	// Without workers the queue fills up
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, "/cache/a"))
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, "/cache/b"))
+	require.Len(t, w.queue, 1)
+	require.Equal(t, "/cache/a", (<-w.queue).ArchivePath)
+}
+
+func TestArchiveWarmerDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-warming")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "project-1-v1.0")
+
+	started := make(chan struct{})
+	w := newTestArchiveWarmer(t, dir, &config.ArchiveWarmingConfig{Formats: []string{"tar.gz"}}, func(ctx context.Context, _ io.Writer) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w.start(1)
+
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, archivePath))
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		w.Drain()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warmer was not drained")
+	}
+
+	requireFileExists(t, archivePath+".tar.gz", false)
+
+	// Notifications after draining are ignored
+	w.handleNotification(archiveWarmingNotificationPrefix+"1", archiveWarmingNotification(t, archivePath))
+	require.Len(t, w.queue, 0)
+}
+
+func TestArchiveWarmerError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-warming")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "project-1-v1.0")
+
+	w := newTestArchiveWarmer(t, dir, &config.ArchiveWarmingConfig{Formats: []string{"tar"}}, func(context.Context, io.Writer) error {
+		return errors.New("gitaly went away")
+	})
+
+	w.warm(archiveParams{ArchivePath: archivePath}, w.formats[0])
+	requireFileExists(t, archivePath+".tar", false)
+}
+
+func TestNewArchiveWarmer(t *testing.T) {
+	w, err := NewArchiveWarmer(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, w)
+
+	// A nil warmer is a no-op
+	w.Drain()
+
+	cache := newArchiveCache(&config.ArchiveCacheConfig{Dir: "/cache"})
+
+	_, err = newArchiveWarmer(&config.ArchiveWarmingConfig{}, nil)
+	require.Error(t, err, "archive cache required")
+
+	_, err = newArchiveWarmer(&config.ArchiveWarmingConfig{Formats: []string{"rar"}}, cache)
+	require.Error(t, err)
+
+	_, err = newArchiveWarmer(&config.ArchiveWarmingConfig{Timeout: &config.TomlDuration{}}, cache)
+	require.Error(t, err)
+
+	w, err = newArchiveWarmer(&config.ArchiveWarmingConfig{}, cache)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tar.gz", "zip"}, []string{w.formats[0].String(), w.formats[1].String()})
+}
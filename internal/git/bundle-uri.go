@@ -0,0 +1,239 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendurl"
+)
+
+// BundlePath is the directory below the repository URL that bundles are
+// served from
+const BundlePath = "gitlab-bundles/"
+
+// CloneBundlePath is where clients that do not speak protocol v2, such as
+// the repo tool, look for a single bundle to clone from
+const CloneBundlePath = "clone.bundle"
+
+// Bundle IDs end up in Git config keys and URLs
+var bundleIDPattern = regexp.MustCompile(`\A[0-9A-Za-z_-]+\z`)
+
+var (
+	bundleRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_bundle_requests",
+			Help: "How many bundle lists and bundles have been served, partitioned by how.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bundleRequests)
+}
+
+// advertisedBundles returns the bundles of a that can be advertised
+func advertisedBundles(a *api.Response) []api.GitBundle {
+	var bundles []api.GitBundle
+	for _, b := range a.Bundles {
+		if bundleIDPattern.MatchString(b.ID) && (b.Path != "" || b.URL != "") {
+			bundles = append(bundles, b)
+		}
+	}
+
+	return bundles
+}
+
+// writeBundleList answers a protocol v2 bundle-uri command. The URIs are
+// relative to the repository URL, which makes clients download the
+// bundles from workhorse.
+func writeBundleList(w *HttpResponseWriter, bundles []api.GitBundle) error {
+	var list bytes.Buffer
+	writePktLine(&list, "bundle.version=1")
+	writePktLine(&list, "bundle.mode=all")
+
+	heuristic := true
+	for _, b := range bundles {
+		heuristic = heuristic && b.CreationToken > 0
+	}
+	if heuristic {
+		writePktLine(&list, "bundle.heuristic=creationToken")
+	}
+
+	for _, b := range bundles {
+		writePktLine(&list, fmt.Sprintf("bundle.%s.uri=%s%s", b.ID, BundlePath, b.ID))
+		if heuristic {
+			writePktLine(&list, fmt.Sprintf("bundle.%s.creationToken=%d", b.ID, b.CreationToken))
+		}
+	}
+	list.WriteString("0000")
+
+	bundleRequests.WithLabelValues("list").Inc()
+	if _, err := w.Write(list.Bytes()); err != nil {
+		return fmt.Errorf("writeBundleList: %v", err)
+	}
+
+	return nil
+}
+
+// bundleURIAdvertiser adds the bundle-uri capability to a protocol v2
+// info/refs response as it passes through
+type bundleURIAdvertiser struct {
+	http.ResponseWriter
+	buf  []byte
+	v2   bool
+	done bool
+}
+
+func (b *bundleURIAdvertiser) Write(p []byte) (int, error) {
+	if b.done {
+		return b.ResponseWriter.Write(p)
+	}
+
+	b.buf = append(b.buf, p...)
+	for !b.done && len(b.buf) >= 4 {
+		size, err := strconv.ParseUint(string(b.buf[:4]), 16, 16)
+		if err != nil {
+			b.done = true
+			break
+		}
+
+		if size == 0 && b.v2 {
+			// The flush packet ends the capability advertisement
+			var capability bytes.Buffer
+			writePktLine(&capability, "bundle-uri\n")
+			if _, err := b.ResponseWriter.Write(capability.Bytes()); err != nil {
+				return 0, err
+			}
+			b.done = true
+			break
+		}
+
+		if size < 4 {
+			// Flush and delimiter packets have no payload
+			size = 4
+		}
+		if uint64(len(b.buf)) < size {
+			break
+		}
+
+		switch string(bytes.TrimSuffix(b.buf[4:size], []byte("\n"))) {
+		case "version 2":
+			b.v2 = true
+		case "bundle-uri":
+			// The server advertises bundle URIs of its own
+			b.done = true
+		}
+
+		if _, err := b.ResponseWriter.Write(b.buf[:size]); err != nil {
+			return 0, err
+		}
+		b.buf = b.buf[size:]
+	}
+
+	if err := b.flush(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// flush writes out what is buffered once no capability is to be added
+func (b *bundleURIAdvertiser) flush() error {
+	if !b.done || len(b.buf) == 0 {
+		return nil
+	}
+
+	_, err := b.ResponseWriter.Write(b.buf)
+	b.buf = nil
+	return err
+}
+
+// close writes out what is left at the end of the response
+func (b *bundleURIAdvertiser) close() error {
+	b.done = true
+	return b.flush()
+}
+
+// cloneBundle returns the bundle to serve as clone.bundle. That is the
+// bundle with the lowest creation token, the only one that does not build
+// on another bundle.
+func cloneBundle(bundles []api.GitBundle) *api.GitBundle {
+	var bundle *api.GitBundle
+	for i := range bundles {
+		if bundle == nil || bundles[i].CreationToken < bundle.CreationToken {
+			bundle = &bundles[i]
+		}
+	}
+
+	return bundle
+}
+
+// GetBundle serves the bundle named in the request URL, or the clone
+// bundle, from disk or from object storage. It relies on sendfile and sendurl to do the sending, so
+// it supports Range requests.
+func GetBundle(a *api.API) http.Handler {
+	return senddata.SendData(
+		sendfile.SendFile(repoPreAuthorizeHandler(a, handleGetBundle)),
+		sendurl.SendURL,
+	)
+}
+
+func handleGetBundle(w http.ResponseWriter, r *http.Request, a *api.Response) {
+	id := path.Base(r.URL.Path)
+	bundles := advertisedBundles(a)
+
+	var bundle *api.GitBundle
+	if id == CloneBundlePath {
+		bundle = cloneBundle(bundles)
+	} else {
+		for i := range bundles {
+			if bundles[i].ID == id {
+				bundle = &bundles[i]
+				break
+			}
+		}
+	}
+	if bundle == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	helper.SetAccessLogField(r.Context(), "gitBundle", bundle.ID)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	switch {
+	case bundle.Path != "":
+		bundleRequests.WithLabelValues("file").Inc()
+		w.Header().Set(sendfile.ResponseHeader, bundle.Path)
+		w.WriteHeader(http.StatusOK)
+
+	case bundle.Redirect:
+		bundleRequests.WithLabelValues("redirect").Inc()
+		http.Redirect(w, r, bundle.URL, http.StatusFound)
+
+	default:
+		sendData, err := sendurl.SendURL.Pack(struct {
+			URL            string
+			AllowRedirects bool
+		}{URL: bundle.URL, AllowRedirects: true})
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("handleGetBundle: %v", err))
+			return
+		}
+
+		bundleRequests.WithLabelValues("url").Inc()
+		w.Header().Set(senddata.HeaderKey, sendData)
+		w.WriteHeader(http.StatusOK)
+	}
+}
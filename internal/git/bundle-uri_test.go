@@ -0,0 +1,174 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendurl"
+)
+
+func TestBundleURIAdvertiser(t *testing.T) {
+	service := pktLine("# service=git-upload-pack\n") + "0000"
+	v2 := pktLine("version 2\n") + pktLine("agent=git/2.40.0\n") + pktLine("ls-refs=unborn\n") + pktLine("fetch=shallow\n")
+
+	for _, tc := range []struct {
+		desc     string
+		response string
+		expected string
+	}{
+		{
+			desc:     "protocol v2",
+			response: service + v2 + "0000",
+			expected: service + v2 + pktLine("bundle-uri\n") + "0000",
+		},
+		{
+			desc:     "already advertised",
+			response: service + pktLine("version 2\n") + pktLine("bundle-uri\n") + "0000",
+			expected: service + pktLine("version 2\n") + pktLine("bundle-uri\n") + "0000",
+		},
+		{
+			desc:     "protocol v0",
+			response: service + pktLine(oid1+" HEAD\x00multi_ack\n") + "0000",
+			expected: service + pktLine(oid1+" HEAD\x00multi_ack\n") + "0000",
+		},
+		{
+			desc:     "not pkt-lines",
+			response: "garbage",
+			expected: "garbage",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Write byte by byte to cover pkt-lines split across writes
+			rr := httptest.NewRecorder()
+			advertiser := &bundleURIAdvertiser{ResponseWriter: rr}
+			for i := range tc.response {
+				n, err := advertiser.Write([]byte(tc.response[i : i+1]))
+				require.NoError(t, err)
+				require.Equal(t, 1, n)
+			}
+			require.NoError(t, advertiser.close())
+
+			require.Equal(t, tc.expected, rr.Body.String())
+		})
+	}
+}
+
+func TestUploadPackBundleURICommand(t *testing.T) {
+	a := &api.Response{Bundles: []api.GitBundle{
+		{ID: "base", Path: "/bundles/base.bundle", CreationToken: 1},
+		{ID: "daily", URL: "https://objects.example.com/daily.bundle", CreationToken: 2},
+		{ID: "../invalid", Path: "/bundles/invalid.bundle"},
+	}}
+
+	body := pktLine("command=bundle-uri\n") + pktLine("object-format=sha1\n") + "0001" + "0000"
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+
+	rr := httptest.NewRecorder()
+	require.NoError(t, (&uploadPack{}).handle(NewHttpResponseWriter(rr), req, a))
+
+	expected := pktLine("bundle.version=1") +
+		pktLine("bundle.mode=all") +
+		pktLine("bundle.heuristic=creationToken") +
+		pktLine("bundle.base.uri=gitlab-bundles/base") +
+		pktLine("bundle.base.creationToken=1") +
+		pktLine("bundle.daily.uri=gitlab-bundles/daily") +
+		pktLine("bundle.daily.creationToken=2") +
+		"0000"
+	require.Equal(t, "application/x-git-upload-pack-result", rr.Header().Get("Content-Type"))
+	require.Equal(t, expected, rr.Body.String())
+}
+
+func TestWriteBundleListWithoutCreationTokens(t *testing.T) {
+	rr := httptest.NewRecorder()
+	bundles := []api.GitBundle{{ID: "base", Path: "/bundles/base.bundle"}}
+	require.NoError(t, writeBundleList(NewHttpResponseWriter(rr), bundles))
+
+	expected := pktLine("bundle.version=1") + pktLine("bundle.mode=all") + pktLine("bundle.base.uri=gitlab-bundles/base") + "0000"
+	require.Equal(t, expected, rr.Body.String())
+}
+
+func serveBundle(t *testing.T, a *api.Response, file string, header http.Header) *httptest.ResponseRecorder {
+	handler := senddata.SendData(
+		sendfile.SendFile(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleGetBundle(w, r, a)
+		})),
+		sendurl.SendURL,
+	)
+
+	req := httptest.NewRequest("GET", "/gitlab/gitlab-ce.git/"+file, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGetBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bundlePath := path.Join(dir, "base.bundle")
+	require.NoError(t, ioutil.WriteFile(bundlePath, []byte("# v2 git bundle\nfile contents"), 0644))
+
+	objectStorage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/daily.bundle", r.URL.Path)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("# v2 git bundle\nobject contents"))
+	}))
+	defer objectStorage.Close()
+
+	a := &api.Response{Bundles: []api.GitBundle{
+		{ID: "base", Path: bundlePath},
+		{ID: "daily", URL: objectStorage.URL + "/daily.bundle"},
+		{ID: "weekly", URL: objectStorage.URL + "/weekly.bundle", Redirect: true},
+	}}
+
+	rr := serveBundle(t, a, BundlePath+"base", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "# v2 git bundle\nfile contents", rr.Body.String())
+	require.Empty(t, rr.Header().Get(sendfile.ResponseHeader))
+
+	rr = serveBundle(t, a, BundlePath+"base", http.Header{"Range": {"bytes=16-"}})
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "file contents", rr.Body.String())
+
+	rr = serveBundle(t, a, BundlePath+"daily", http.Header{"Range": {"bytes=16-"}})
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "object contents", rr.Body.String())
+	require.Empty(t, rr.Header().Get(senddata.HeaderKey))
+
+	rr = serveBundle(t, a, BundlePath+"weekly", nil)
+	require.Equal(t, http.StatusFound, rr.Code)
+	require.Equal(t, objectStorage.URL+"/weekly.bundle", rr.Header().Get("Location"))
+
+	rr = serveBundle(t, a, BundlePath+"monthly", nil)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetCloneBundle(t *testing.T) {
+	a := &api.Response{Bundles: []api.GitBundle{
+		{ID: "daily", URL: "https://objects.example.com/daily.bundle", Redirect: true, CreationToken: 2},
+		{ID: "base", URL: "https://objects.example.com/base.bundle", Redirect: true, CreationToken: 1},
+	}}
+
+	rr := serveBundle(t, a, CloneBundlePath, nil)
+	require.Equal(t, http.StatusFound, rr.Code)
+	require.Equal(t, "https://objects.example.com/base.bundle", rr.Header().Get("Location"))
+
+	rr = serveBundle(t, &api.Response{}, CloneBundlePath, nil)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,166 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// cacheFill is a file being written to a cache. Readers follow the file
+// as it grows. The fill is cancelled when its last reader goes away before
+// it is complete.
+type cacheFill struct {
+	file   *os.File
+	cancel context.CancelFunc
+
+	mutex     sync.Mutex
+	size      int64
+	done      bool
+	err       error
+	changed   chan struct{}
+	followers int
+}
+
+func newCacheFill(file *os.File, cancel context.CancelFunc) *cacheFill {
+	return &cacheFill{
+		file:    file,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *cacheFill) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+
+	f.mutex.Lock()
+	f.size += int64(n)
+	f.notify()
+	f.mutex.Unlock()
+
+	return n, err
+}
+
+// notify must be called with f.mutex held
+func (f *cacheFill) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *cacheFill) finish(err error) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.done = true
+	f.err = err
+	f.notify()
+
+	return f.size
+}
+
+func (f *cacheFill) follow() (*os.File, error) {
+	reader, err := os.Open(f.file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	f.followers++
+	f.mutex.Unlock()
+
+	return reader, nil
+}
+
+func (f *cacheFill) unfollow(reader *os.File) {
+	reader.Close()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.followers--
+	if f.followers == 0 && !f.done {
+		f.cancel()
+	}
+}
+
+// started waits until the fill has data or is done, and returns the
+// error of a fill that failed before writing anything
+func (f *cacheFill) started(ctx context.Context) error {
+	for {
+		f.mutex.Lock()
+		size, done, fillErr, changed := f.size, f.done, f.err, f.changed
+		f.mutex.Unlock()
+
+		if size > 0 {
+			return nil
+		}
+		if done {
+			return fillErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// wait waits until the fill is done and returns its error
+func (f *cacheFill) wait(ctx context.Context) error {
+	for {
+		f.mutex.Lock()
+		done, fillErr, changed := f.done, f.err, f.changed
+		f.mutex.Unlock()
+
+		if done {
+			return fillErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (f *cacheFill) copyTo(ctx context.Context, w io.Writer, reader *os.File) error {
+	buf := make([]byte, 32*1024)
+	var offset int64
+
+	for {
+		f.mutex.Lock()
+		size, done, fillErr, changed := f.size, f.done, f.err, f.changed
+		f.mutex.Unlock()
+
+		if offset < size {
+			chunk := buf
+			if remaining := size - offset; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+
+			n, err := reader.ReadAt(chunk, offset)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("read fill: %v", err)
+			}
+			offset += int64(n)
+
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return fmt.Errorf("write response: %v", err)
+			}
+			continue
+		}
+
+		if done {
+			return fillErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
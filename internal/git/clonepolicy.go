@@ -0,0 +1,186 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+const (
+	rejectFilterOrDepthRequired = "filter_or_depth_required"
+	rejectTooManyFullClones     = "too_many_full_clones"
+	rejectShallowQueueFull      = "shallow_queue_full"
+	rejectShallowQueueTimeout   = "shallow_queue_timeout"
+)
+
+var (
+	clonePolicyRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_clone_policy_rejections",
+			Help: "How many upload-pack requests have been rejected by a clone policy, partitioned by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clonePolicyRejections)
+}
+
+// ClonePolicies enforces the clone policies of upload-pack requests. A nil
+// *ClonePolicies enforces nothing.
+type ClonePolicies struct {
+	sizeClasses  map[string]api.ClonePolicy
+	shallowQueue *queueing.Queue
+
+	fullClonesMutex sync.Mutex
+	fullClones      map[string]int
+}
+
+// NewClonePolicies sets up the policies in cfg. Without cfg only policies
+// sent by Rails apply, and shallow fetches are never queued. It must be
+// called at most once per process because the shallow fetch queue
+// registers metrics.
+func NewClonePolicies(cfg *config.ClonePolicyConfig) *ClonePolicies {
+	p := &ClonePolicies{
+		sizeClasses: make(map[string]api.ClonePolicy),
+		fullClones:  make(map[string]int),
+	}
+	if cfg == nil {
+		return p
+	}
+
+	for class, policy := range cfg.SizeClasses {
+		p.sizeClasses[class] = api.ClonePolicy(policy)
+	}
+
+	if cfg.ShallowFetchLimit > 0 {
+		var timeout config.TomlDuration
+		if cfg.ShallowFetchQueueTimeout != nil {
+			timeout = *cfg.ShallowFetchQueueTimeout
+		}
+		p.shallowQueue = queueing.NewQueue("git_shallow_fetches", cfg.ShallowFetchLimit, cfg.ShallowFetchQueueLimit, timeout.Duration)
+	}
+
+	return p
+}
+
+func (p *ClonePolicies) policyFor(a *api.Response) *api.ClonePolicy {
+	if a.ClonePolicy != nil {
+		return a.ClonePolicy
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	if policy, ok := p.sizeClasses[a.RepositorySizeClass]; ok {
+		return &policy
+	}
+
+	return nil
+}
+
+// clonePolicyError is sent to the git client as an ERR pkt-line
+type clonePolicyError struct {
+	reason  string
+	message string
+}
+
+func (e *clonePolicyError) Error() string {
+	return e.message
+}
+
+// admit checks the negotiation against the policy of the repository. The
+// returned release function must be called when the request is done, also
+// when err is not nil.
+func (p *ClonePolicies) admit(a *api.Response, n *negotiation) (release func(), err error) {
+	release = func() {}
+
+	policy := p.policyFor(a)
+	if policy == nil {
+		return release, nil
+	}
+
+	switch n.kind() {
+	case fetchKindClone:
+		if policy.RequireFilterOrDepth {
+			return release, &clonePolicyError{
+				reason:  rejectFilterOrDepthRequired,
+				message: "full clones of this repository are not allowed, use a shallow clone (--depth) or a partial clone (--filter)",
+			}
+		}
+
+		if policy.MaxConcurrentFullClones > 0 && p != nil {
+			return p.acquireFullClone(repositoryKey(a), policy.MaxConcurrentFullClones)
+		}
+
+	case fetchKindShallow:
+		if policy.QueueShallowFetches && p != nil && p.shallowQueue != nil {
+			return p.acquireShallowFetch()
+		}
+	}
+
+	return release, nil
+}
+
+func (p *ClonePolicies) acquireFullClone(key string, max int) (func(), error) {
+	p.fullClonesMutex.Lock()
+	defer p.fullClonesMutex.Unlock()
+
+	if p.fullClones[key] >= max {
+		return func() {}, &clonePolicyError{
+			reason:  rejectTooManyFullClones,
+			message: "too many clones of this repository are running, try again later",
+		}
+	}
+	p.fullClones[key]++
+
+	return func() {
+		p.fullClonesMutex.Lock()
+		defer p.fullClonesMutex.Unlock()
+
+		if p.fullClones[key]--; p.fullClones[key] <= 0 {
+			delete(p.fullClones, key)
+		}
+	}, nil
+}
+
+func (p *ClonePolicies) acquireShallowFetch() (func(), error) {
+	switch err := p.shallowQueue.Acquire(); err {
+	case nil:
+		return p.shallowQueue.Release, nil
+	case queueing.ErrTooManyRequests:
+		return func() {}, &clonePolicyError{reason: rejectShallowQueueFull, message: "too many shallow fetches are queued, try again later"}
+	default:
+		return func() {}, &clonePolicyError{reason: rejectShallowQueueTimeout, message: "timed out waiting for other shallow fetches, try again later"}
+	}
+}
+
+func repositoryKey(a *api.Response) string {
+	if a.GL_REPOSITORY != "" {
+		return a.GL_REPOSITORY
+	}
+
+	if a.Repository.RelativePath == "" && a.RepoPath != "" {
+		// Without Gitaly the path on disk is all we have
+		return a.RepoPath
+	}
+
+	return a.Repository.StorageName + ":" + a.Repository.RelativePath
+}
+
+// writeErrorPktLine answers an upload-pack request with an ERR pkt-line.
+// Git clients print its message as "remote error: <message>".
+func writeErrorPktLine(w http.ResponseWriter, action string, message string) error {
+	writePostRPCHeader(w, action)
+	w.WriteHeader(http.StatusOK)
+
+	return writePktLine(w, fmt.Sprintf("ERR %s\n", message))
+}
@@ -0,0 +1,152 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var (
+	cloneNegotiation       = &negotiation{wants: 1, done: true}
+	shallowNegotiation     = &negotiation{wants: 1, deepen: 1, done: true}
+	partialNegotiation     = &negotiation{wants: 1, filter: "blob:none", done: true}
+	incrementalNegotiation = &negotiation{wants: 1, haves: 10}
+)
+
+func requirePolicyError(t *testing.T, err error, reason string) {
+	policyErr, ok := err.(*clonePolicyError)
+	if !ok {
+		t.Fatalf("expected clone policy error %q, got %v", reason, err)
+	}
+	if policyErr.reason != reason {
+		t.Fatalf("expected reason %q, got %q", reason, policyErr.reason)
+	}
+}
+
+func TestClonePolicyRequireFilterOrDepth(t *testing.T) {
+	policies := NewClonePolicies(&config.ClonePolicyConfig{
+		SizeClasses: map[string]config.ClonePolicy{
+			"large": {RequireFilterOrDepth: true},
+		},
+	})
+	large := &api.Response{RepositorySizeClass: "large"}
+
+	_, err := policies.admit(large, cloneNegotiation)
+	requirePolicyError(t, err, rejectFilterOrDepthRequired)
+
+	for _, n := range []*negotiation{shallowNegotiation, partialNegotiation, incrementalNegotiation} {
+		if _, err := policies.admit(large, n); err != nil {
+			t.Fatalf("%+v: %v", n, err)
+		}
+	}
+
+	if _, err := policies.admit(&api.Response{RepositorySizeClass: "small"}, cloneNegotiation); err != nil {
+		t.Fatalf("unknown size class: %v", err)
+	}
+}
+
+func TestClonePolicyFromPreAuthorize(t *testing.T) {
+	var policies *ClonePolicies
+	a := &api.Response{ClonePolicy: &api.ClonePolicy{RequireFilterOrDepth: true}}
+
+	_, err := policies.admit(a, cloneNegotiation)
+	requirePolicyError(t, err, rejectFilterOrDepthRequired)
+}
+
+func TestClonePolicyMaxConcurrentFullClones(t *testing.T) {
+	// Limits sent by Rails apply without a [clone_policy] section
+	policies := NewClonePolicies(nil)
+	a := &api.Response{
+		GL_REPOSITORY: "project-1",
+		ClonePolicy:   &api.ClonePolicy{MaxConcurrentFullClones: 2},
+	}
+
+	release1, err := policies.admit(a, cloneNegotiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := policies.admit(a, cloneNegotiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = policies.admit(a, cloneNegotiation)
+	requirePolicyError(t, err, rejectTooManyFullClones)
+
+	releaseOther, err := policies.admit(&api.Response{GL_REPOSITORY: "project-2", ClonePolicy: a.ClonePolicy}, cloneNegotiation)
+	if err != nil {
+		t.Fatalf("other repository: %v", err)
+	}
+	releaseOther()
+	if _, err := policies.admit(a, incrementalNegotiation); err != nil {
+		t.Fatalf("incremental fetch: %v", err)
+	}
+
+	release1()
+	release3, err := policies.admit(a, cloneNegotiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release2()
+	release3()
+	if len(policies.fullClones) != 0 {
+		t.Fatalf("expected no running clones, got %v", policies.fullClones)
+	}
+}
+
+func TestClonePolicyShallowQueue(t *testing.T) {
+	policies := NewClonePolicies(&config.ClonePolicyConfig{
+		ShallowFetchLimit:        1,
+		ShallowFetchQueueLimit:   0,
+		ShallowFetchQueueTimeout: &config.TomlDuration{Duration: time.Millisecond},
+	})
+	a := &api.Response{ClonePolicy: &api.ClonePolicy{QueueShallowFetches: true}}
+
+	release, err := policies.admit(a, shallowNegotiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = policies.admit(a, shallowNegotiation)
+	requirePolicyError(t, err, rejectShallowQueueFull)
+
+	if _, err := policies.admit(a, cloneNegotiation); err != nil {
+		t.Fatalf("clones do not use the shallow queue: %v", err)
+	}
+
+	release()
+	release, err = policies.admit(a, shallowNegotiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestUploadPackClonePolicyRejection(t *testing.T) {
+	body := pktLine("want "+oid1+" thin-pack\n") + "0000" + pktLine("done\n")
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", strings.NewReader(body))
+
+	rr := httptest.NewRecorder()
+	a := &api.Response{ClonePolicy: &api.ClonePolicy{RequireFilterOrDepth: true}}
+	if err := (&uploadPack{}).handle(NewHttpResponseWriter(rr), req, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-git-upload-pack-result" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+
+	expected := "ERR full clones of this repository are not allowed, use a shallow clone (--depth) or a partial clone (--filter)\n"
+	if response := rr.Body.String(); response != pktLine(expected) {
+		t.Fatalf("expected ERR pkt-line, got %q", response)
+	}
+}
@@ -5,6 +5,7 @@ In this file we handle the Git 'smart HTTP' protocol
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
@@ -23,12 +25,19 @@ const (
 	GitConfigShowAllRefs = "transfer.hideRefs=!refs"
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+// ReceivePack handles pushes. The cached upload-pack responses of the
+// repository are dropped after every push.
+func ReceivePack(a *api.API, cache *UploadPackCache, infoRefsCache *InfoRefsCache, inspector *PushInspector) http.Handler {
+	return postRPCHandler(a, "handleReceivePack", func(w *HttpResponseWriter, r *http.Request, ar *api.Response) error {
+		defer cache.Invalidate(repositoryKey(ar))
+		defer infoRefsCache.Invalidate(repositoryKey(ar))
+		return handleReceivePack(w, r, ar, inspector)
+	})
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, policies *ClonePolicies, cache *UploadPackCache, requestLimit int64) http.Handler {
+	u := &uploadPack{policies: policies, cache: cache, requestLimit: requestLimit}
+	return postRPCHandler(a, "handleUploadPack", u.handle)
 }
 
 func gitConfigOptions(a *api.Response) []string {
@@ -68,13 +77,27 @@ func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Han
 }
 
 func startGitCommand(a *api.Response, stdin io.Reader, stdout io.Writer, action string, options ...string) (cmd *exec.Cmd, err error) {
+	return startGitRPCCommand(a, stdin, stdout, action, nil, "", options...)
+}
+
+// startGitRPCCommand starts 'git <action> --stateless-rpc' with the
+// configuration options in gitConfig and the Git-Protocol header value in
+// gitProtocol, the way Gitaly would run it
+func startGitRPCCommand(a *api.Response, stdin io.Reader, stdout io.Writer, action string, gitConfig []string, gitProtocol string, options ...string) (cmd *exec.Cmd, err error) {
 	// Prepare our Git subprocess
-	args := []string{subCommand(action), "--stateless-rpc"}
+	var args []string
+	for _, option := range gitConfig {
+		args = append(args, "-c", option)
+	}
+	args = append(args, subCommand(action), "--stateless-rpc")
 	args = append(args, options...)
 	args = append(args, a.RepoPath)
 	cmd = gitCommandApi(a, "git", args...)
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_PROTOCOL=%s", gitProtocol))
+	}
 
 	if err = cmd.Start(); err != nil {
 		return nil, fmt.Errorf("start %v: %v", cmd.Args, err)
@@ -83,6 +106,21 @@ func startGitCommand(a *api.Response, stdin io.Reader, stdout io.Writer, action
 	return cmd, nil
 }
 
+// terminateOnCancel stops the process group of cmd when ctx is done. Call
+// the returned function once cmd has exited.
+func terminateOnCancel(ctx context.Context, cmd *exec.Cmd) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
 func writePostRPCHeader(w http.ResponseWriter, action string) {
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", action))
 	w.Header().Set("Cache-Control", "no-cache")
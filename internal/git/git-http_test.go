@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -32,7 +33,61 @@ func createTestPayload() []byte {
 }
 
 func TestHandleReceivePack(t *testing.T) {
-	testHandlePostRpc(t, "git-receive-pack", handleReceivePack)
+	testHandlePostRpc(t, "git-receive-pack", func(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+		return handleReceivePack(w, r, a, nil)
+	})
+}
+
+func TestHandleUploadPack(t *testing.T) {
+	testHandlePostRpc(t, "git-upload-pack", (&uploadPack{}).handle)
+}
+
+func TestHandleGetInfoRefsLocally(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.Command }()
+
+	req, err := http.NewRequest("GET", "/gitlab/gitlab-ce.git/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+
+	rr := httptest.NewRecorder()
+	handleGetInfoRefs(rr, req, &api.Response{GL_ID: GL_ID, RepoPath: "/repo.git", ShowAllRefs: true}, nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-git-upload-pack-advertisement" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+
+	expected := "001e# service=git-upload-pack\n0000" +
+		"git -c transfer.hideRefs=!refs upload-pack --stateless-rpc --advertise-refs /repo.git\n" +
+		"GIT_PROTOCOL=version=2\n"
+	if body := rr.Body.String(); body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestHandleGetInfoRefsLocallyStartFailure(t *testing.T) {
+	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("/nonexistent/git") }
+	defer func() { execCommand = exec.Command }()
+
+	req, err := http.NewRequest("GET", "/gitlab/gitlab-ce.git/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handleGetInfoRefs(rr, req, &api.Response{GL_ID: GL_ID, RepoPath: "/repo.git"}, nil)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "# service=") {
+		t.Fatalf("expected no service announcement, got %q", body)
+	}
 }
 
 func testHandlePostRpc(t *testing.T, action string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error) {
@@ -100,7 +155,17 @@ func TestGitCommandProcess(t *testing.T) {
 
 	uploadPack := stringInSlice("upload-pack", os.Args)
 
-	if uploadPack {
+	if stringInSlice("--advertise-refs", os.Args) {
+		// Echo how we were called
+		args := os.Args
+		for i, arg := range args {
+			if arg == "--" {
+				args = args[i+1:]
+				break
+			}
+		}
+		fmt.Printf("%s\nGIT_PROTOCOL=%s\n", strings.Join(args, " "), os.Getenv("GIT_PROTOCOL"))
+	} else if uploadPack {
 		// First, send a large payload to stdout so that this executable will be blocked
 		// until the reader consumes the data
 		testInput := createTestPayload()
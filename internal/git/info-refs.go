@@ -11,11 +11,13 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func GetInfoRefsHandler(a *api.API) http.Handler {
-	return repoPreAuthorizeHandler(a, handleGetInfoRefs)
+func GetInfoRefsHandler(a *api.API, cache *InfoRefsCache) http.Handler {
+	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
+		handleGetInfoRefs(rw, r, ar, cache)
+	})
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, cache *InfoRefsCache) {
 	w := NewHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer w.Log(r, 0)
@@ -31,15 +33,87 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 	w.Header().Set("Cache-Control", "no-cache")
 
 	gitProtocol := r.Header.Get("Git-Protocol")
+	if isProtocolV2(gitProtocol) {
+		helper.SetAccessLogField(r.Context(), "gitProtocol", "v2")
+	}
+
+	var out http.ResponseWriter = w
+	var advertiser *bundleURIAdvertiser
+	if rpc == "git-upload-pack" && isProtocolV2(gitProtocol) && len(advertisedBundles(a)) > 0 {
+		advertiser = &bundleURIAdvertiser{ResponseWriter: w}
+		out = advertiser
+	}
 
-	err := handleGetInfoRefsWithGitaly(r.Context(), w, a, rpc, gitProtocol)
+	generate := func(w io.Writer) error {
+		if a.GitalyServer.Address == "" {
+			return handleGetInfoRefsLocally(r.Context(), w, a, rpc, gitProtocol)
+		}
+		return handleGetInfoRefsWithGitaly(r.Context(), w, a, rpc, gitProtocol)
+	}
+
+	var err error
+	if rpc == "git-upload-pack" {
+		err = cache.serve(r.Context(), out, a, gitProtocol, generate)
+	} else {
+		err = generate(out)
+	}
+	if err == nil && advertiser != nil {
+		err = advertiser.close()
+	}
 
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("handleGetInfoRefs: %v", err))
 	}
 }
 
-func handleGetInfoRefsWithGitaly(ctx context.Context, w http.ResponseWriter, a *api.Response, rpc string, gitProtocol string) error {
+func handleGetInfoRefsLocally(ctx context.Context, w io.Writer, a *api.Response, rpc string, gitProtocol string) error {
+	// Like git-http-backend, announce the service before the refs. It is
+	// written with the first output of git, so that nothing has been
+	// written yet if git fails to start.
+	announcer := &serviceAnnouncer{w: w, rpc: rpc}
+
+	cmd, err := startGitRPCCommand(a, nil, announcer, rpc, gitConfigOptions(a), gitProtocol, "--advertise-refs")
+	if err != nil {
+		return fmt.Errorf("handleGetInfoRefsLocally: %v", err)
+	}
+	defer helper.CleanUpProcessGroup(cmd)
+	defer terminateOnCancel(ctx, cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("handleGetInfoRefsLocally: wait for %v: %v", cmd.Args, err)
+	}
+
+	if _, err := announcer.Write(nil); err != nil {
+		return fmt.Errorf("handleGetInfoRefsLocally: %v", err)
+	}
+
+	return nil
+}
+
+// serviceAnnouncer writes the '# service=' pkt-line to w before the first
+// write
+type serviceAnnouncer struct {
+	w         io.Writer
+	rpc       string
+	announced bool
+}
+
+func (s *serviceAnnouncer) Write(p []byte) (int, error) {
+	if !s.announced {
+		s.announced = true
+		service := fmt.Sprintf("# service=%s\n", s.rpc)
+		if _, err := fmt.Fprintf(s.w, "%04x%s0000", len(service)+4, service); err != nil {
+			return 0, fmt.Errorf("write service: %v", err)
+		}
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return s.w.Write(p)
+}
+
+func handleGetInfoRefsWithGitaly(ctx context.Context, w io.Writer, a *api.Response, rpc string, gitProtocol string) error {
 	smarthttp, err := gitaly.NewSmartHTTPClient(a.GitalyServer)
 	if err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: %v", err)
@@ -49,6 +123,7 @@ func handleGetInfoRefsWithGitaly(ctx context.Context, w http.ResponseWriter, a *
 	if err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: %v", err)
 	}
+	defer infoRefsResponseReader.Close()
 
 	if _, err = io.Copy(w, infoRefsResponseReader); err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: copy Gitaly response: %v", err)
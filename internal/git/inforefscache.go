@@ -0,0 +1,322 @@
+package git
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	infoRefsCacheHit      = "hit"
+	infoRefsCacheMiss     = "miss"
+	infoRefsCacheDisabled = "disabled"
+
+	defaultInfoRefsCacheMaxAge   = time.Minute
+	defaultInfoRefsCacheMaxBytes = 256 * 1024 * 1024
+
+	// infoRefsNotificationPrefix starts the keys of keywatcher
+	// notifications about pushes
+	infoRefsNotificationPrefix = "workhorse:info_refs:"
+)
+
+var (
+	infoRefsCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_requests",
+			Help: "How many upload-pack info/refs requests have been served, partitioned by cache result (hit, miss, disabled).",
+		},
+		[]string{"result"},
+	)
+
+	infoRefsCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_bytes",
+			Help: "Total size of the info/refs advertisements in the cache.",
+		},
+	)
+
+	infoRefsCacheInvalidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_invalidations",
+			Help: "How many times the info/refs advertisements of a repository have been dropped, partitioned by source (push, notification).",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(infoRefsCacheRequests)
+	prometheus.MustRegister(infoRefsCacheBytes)
+	prometheus.MustRegister(infoRefsCacheInvalidations)
+}
+
+// The caches of all upstreams of the process are invalidated by a single
+// Redis listener
+var (
+	infoRefsCachesMutex  sync.Mutex
+	infoRefsCaches       []*InfoRefsCache
+	infoRefsCacheListens sync.Once
+)
+
+// InfoRefsCache keeps upload-pack info/refs advertisements in memory.
+// Entries of a repository are dropped when a push to it completes on any
+// workhorse process, and after a short maximum age at the latest. Pushes
+// over SSH or from the web UI do not pass workhorse; their changes are
+// only seen after the maximum age unless Rails publishes them. A nil
+// *InfoRefsCache caches nothing.
+type InfoRefsCache struct {
+	maxAge   time.Duration
+	maxBytes int64
+
+	mutex      sync.Mutex
+	entries    map[string]*infoRefsCacheEntry
+	lru        *list.List
+	totalBytes int64
+	// generations counts invalidations per repository so that responses
+	// generated across an invalidation are not stored
+	generations map[string]uint64
+	// fills are closed when the advertisement being generated for a key
+	// has been stored or given up on
+	fills map[string]chan struct{}
+}
+
+type infoRefsCacheEntry struct {
+	key     string
+	repo    string
+	body    []byte
+	created time.Time
+	element *list.Element
+}
+
+// NewInfoRefsCache starts listening for pushes on other workhorse
+// processes through the Redis keywatcher channel
+func NewInfoRefsCache(cfg *config.InfoRefsCacheConfig) *InfoRefsCache {
+	if cfg == nil {
+		return nil
+	}
+
+	c := &InfoRefsCache{
+		maxAge:      defaultInfoRefsCacheMaxAge,
+		maxBytes:    cfg.MaxBytes,
+		entries:     make(map[string]*infoRefsCacheEntry),
+		lru:         list.New(),
+		generations: make(map[string]uint64),
+		fills:       make(map[string]chan struct{}),
+	}
+	if cfg.MaxAge != nil {
+		c.maxAge = cfg.MaxAge.Duration
+	}
+	if c.maxBytes == 0 {
+		c.maxBytes = defaultInfoRefsCacheMaxBytes
+	}
+
+	infoRefsCachesMutex.Lock()
+	infoRefsCaches = append(infoRefsCaches, c)
+	infoRefsCachesMutex.Unlock()
+	infoRefsCacheListens.Do(func() {
+		redis.ListenKeys(infoRefsNotificationPrefix, handleInfoRefsCacheNotification)
+	})
+
+	return c
+}
+
+// infoRefsCacheKey separates the advertisements of a repository by
+// protocol version and by the Git config options, which include the
+// per-user options of Rails
+func infoRefsCacheKey(a *api.Response, gitProtocol string) string {
+	options := append(gitConfigOptions(a), a.GitConfigOptions...)
+	return fmt.Sprintf("%s\x00%d\x00%s", repositoryKey(a), protocolVersion(gitProtocol), strings.Join(options, "\x00"))
+}
+
+// serve writes the advertisement for a to w. On a miss, generate writes it
+// to w and it is stored if it is complete. Concurrent misses for the same
+// key wait for the first one and generate the advertisement themselves
+// only if it could not be stored.
+func (c *InfoRefsCache) serve(ctx context.Context, w io.Writer, a *api.Response, gitProtocol string, generate func(io.Writer) error) error {
+	if c == nil || a.DisableInfoRefsCache {
+		infoRefsCacheRequests.WithLabelValues(infoRefsCacheDisabled).Inc()
+		return generate(w)
+	}
+
+	key := infoRefsCacheKey(a, gitProtocol)
+	repo := repositoryKey(a)
+
+	c.mutex.Lock()
+	entry := c.lookup(key)
+	fill, filling := c.fills[key]
+	if entry == nil && filling {
+		c.mutex.Unlock()
+
+		select {
+		case <-fill:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		c.mutex.Lock()
+		entry = c.lookup(key)
+		fill, filling = c.fills[key]
+	}
+	if entry == nil && !filling {
+		fill = make(chan struct{})
+		c.fills[key] = fill
+		defer c.endFill(key, fill)
+	}
+	generation := c.generations[repo]
+	c.mutex.Unlock()
+
+	if entry != nil {
+		infoRefsCacheRequests.WithLabelValues(infoRefsCacheHit).Inc()
+		if _, err := w.Write(entry.body); err != nil {
+			return fmt.Errorf("InfoRefsCache: write response: %v", err)
+		}
+		return nil
+	}
+
+	infoRefsCacheRequests.WithLabelValues(infoRefsCacheMiss).Inc()
+	buf := &cappedBuffer{max: c.maxBytes}
+	if err := generate(io.MultiWriter(w, buf)); err != nil {
+		return err
+	}
+
+	if !buf.overflow {
+		c.store(key, repo, generation, buf.data)
+	}
+
+	return nil
+}
+
+// endFill wakes up the requests waiting for the advertisement of key
+func (c *InfoRefsCache) endFill(key string, fill chan struct{}) {
+	c.mutex.Lock()
+	if c.fills[key] == fill {
+		delete(c.fills, key)
+	}
+	c.mutex.Unlock()
+
+	close(fill)
+}
+
+// lookup must be called with c.mutex held
+func (c *InfoRefsCache) lookup(key string) *infoRefsCacheEntry {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Since(entry.created) > c.maxAge {
+		c.remove(entry)
+		return nil
+	}
+
+	c.lru.MoveToFront(entry.element)
+	return entry
+}
+
+func (c *InfoRefsCache) store(key string, repo string, generation uint64, body []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generations[repo] != generation {
+		// A push completed while the advertisement was generated
+		return
+	}
+
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+
+	entry := &infoRefsCacheEntry{
+		key:     key,
+		repo:    repo,
+		body:    body,
+		created: time.Now(),
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[key] = entry
+	c.totalBytes += int64(len(body))
+
+	for c.totalBytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*infoRefsCacheEntry))
+	}
+	infoRefsCacheBytes.Set(float64(c.totalBytes))
+}
+
+// remove must be called with c.mutex held
+func (c *InfoRefsCache) remove(entry *infoRefsCacheEntry) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.totalBytes -= int64(len(entry.body))
+	infoRefsCacheBytes.Set(float64(c.totalBytes))
+}
+
+// Invalidate drops the advertisements of repo, e.g. after a push, here and
+// on all other workhorse processes listening on Redis
+func (c *InfoRefsCache) Invalidate(repo string) {
+	if c == nil {
+		return
+	}
+
+	c.invalidate(repo, "push")
+
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := redis.Publish(infoRefsNotificationPrefix+repo, value); err != nil {
+		log.WithFields(context.Background(), log.Fields{"repository": repo}).WithError(err).Warning("InfoRefsCache: publish invalidation")
+	}
+}
+
+func handleInfoRefsCacheNotification(key, value string) {
+	infoRefsCachesMutex.Lock()
+	caches := infoRefsCaches
+	infoRefsCachesMutex.Unlock()
+
+	for _, c := range caches {
+		c.invalidate(strings.TrimPrefix(key, infoRefsNotificationPrefix), "notification")
+	}
+}
+
+func (c *InfoRefsCache) invalidate(repo string, source string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generations[repo]++
+	for _, entry := range c.entries {
+		if entry.repo == repo {
+			c.remove(entry)
+		}
+	}
+
+	infoRefsCacheInvalidations.WithLabelValues(source).Inc()
+}
+
+// cappedBuffer keeps what is written to it up to max bytes
+type cappedBuffer struct {
+	max      int64
+	data     []byte
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if int64(len(b.data)+len(p)) > b.max {
+			b.overflow = true
+			b.data = nil
+		} else {
+			b.data = append(b.data, p...)
+		}
+	}
+
+	return len(p), nil
+}
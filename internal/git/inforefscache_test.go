@@ -0,0 +1,183 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func advertisement(response string, calls *int) func(io.Writer) error {
+	return func(w io.Writer) error {
+		*calls++
+		_, err := io.WriteString(w, response)
+		return err
+	}
+}
+
+func serveInfoRefs(t *testing.T, c *InfoRefsCache, a *api.Response, gitProtocol string, generate func(io.Writer) error) string {
+	var out bytes.Buffer
+	require.NoError(t, c.serve(context.Background(), &out, a, gitProtocol, generate))
+	return out.String()
+}
+
+func TestInfoRefsCacheHit(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+
+	calls := 0
+	generate := advertisement("refs", &calls)
+	require.Equal(t, "refs", serveInfoRefs(t, c, a, "", generate))
+	require.Equal(t, "refs", serveInfoRefs(t, c, a, "", generate))
+	require.Equal(t, 1, calls)
+
+	// Other protocol versions and ref visibility are cached separately
+	serveInfoRefs(t, c, a, "version=1", generate)
+	serveInfoRefs(t, c, a, "version=2", generate)
+	serveInfoRefs(t, c, &api.Response{GL_REPOSITORY: "project-1", ShowAllRefs: true}, "", generate)
+	serveInfoRefs(t, c, &api.Response{GL_REPOSITORY: "project-2"}, "", generate)
+	require.Equal(t, 5, calls)
+
+	// Options of Rails, e.g. per user, are cached separately
+	hidden := &api.Response{GL_REPOSITORY: "project-1", GitConfigOptions: []string{"uploadpack.hideRefs=refs/secret"}}
+	serveInfoRefs(t, c, hidden, "", generate)
+	serveInfoRefs(t, c, hidden, "", generate)
+	require.Equal(t, 6, calls)
+}
+
+func TestInfoRefsCacheConcurrentMisses(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+
+	var calls int32
+	release := make(chan struct{})
+	generate := func(w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		_, err := io.WriteString(w, "refs")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]string, 5)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serveInfoRefs(t, c, a, "", generate)
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, response := range responses {
+		require.Equal(t, "refs", response)
+	}
+}
+
+func TestInfoRefsCacheDisabled(t *testing.T) {
+	calls := 0
+	generate := advertisement("refs", &calls)
+
+	a := &api.Response{GL_REPOSITORY: "project-1", DisableInfoRefsCache: true}
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	serveInfoRefs(t, c, a, "", generate)
+	serveInfoRefs(t, c, a, "", generate)
+	require.Equal(t, 2, calls, "kill switch of the repository")
+
+	var nilCache *InfoRefsCache
+	serveInfoRefs(t, nilCache, &api.Response{}, "", generate)
+	nilCache.Invalidate("project-1")
+	require.Equal(t, 3, calls)
+}
+
+func TestInfoRefsCacheInvalidate(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+	other := &api.Response{GL_REPOSITORY: "project-2"}
+
+	calls := 0
+	generate := advertisement("refs", &calls)
+	serveInfoRefs(t, c, a, "", generate)
+	serveInfoRefs(t, c, other, "", generate)
+
+	c.Invalidate("project-1")
+	serveInfoRefs(t, c, a, "", generate)
+	serveInfoRefs(t, c, other, "", generate)
+	require.Equal(t, 3, calls)
+
+	// A push on another workhorse process
+	handleInfoRefsCacheNotification(infoRefsNotificationPrefix+"project-1", "1546300800")
+	serveInfoRefs(t, c, a, "", generate)
+	require.Equal(t, 4, calls)
+}
+
+func TestInfoRefsCacheDropsAdvertisementsOfConcurrentPushes(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+
+	calls := 0
+	serveInfoRefs(t, c, a, "", func(w io.Writer) error {
+		c.Invalidate("project-1")
+		return advertisement("old refs", &calls)(w)
+	})
+	require.Equal(t, "new refs", serveInfoRefs(t, c, a, "", advertisement("new refs", &calls)))
+}
+
+func TestInfoRefsCacheMaxAge(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{MaxAge: &config.TomlDuration{Duration: time.Nanosecond}})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+
+	calls := 0
+	generate := advertisement("refs", &calls)
+	serveInfoRefs(t, c, a, "", generate)
+	time.Sleep(time.Millisecond)
+	serveInfoRefs(t, c, a, "", generate)
+	require.Equal(t, 2, calls)
+}
+
+func TestInfoRefsCacheMaxBytes(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{MaxBytes: 10})
+
+	calls := 0
+	large := &api.Response{GL_REPOSITORY: "large"}
+	serveInfoRefs(t, c, large, "", advertisement("more than ten bytes", &calls))
+	serveInfoRefs(t, c, large, "", advertisement("more than ten bytes", &calls))
+	require.Equal(t, 2, calls, "too large to cache")
+
+	first, second := &api.Response{GL_REPOSITORY: "first"}, &api.Response{GL_REPOSITORY: "second"}
+	serveInfoRefs(t, c, first, "", advertisement("123456", &calls))
+	serveInfoRefs(t, c, second, "", advertisement("123456", &calls))
+	serveInfoRefs(t, c, second, "", advertisement("123456", &calls))
+	require.Equal(t, 4, calls)
+	serveInfoRefs(t, c, first, "", advertisement("123456", &calls))
+	require.Equal(t, 5, calls, "least recently used entry evicted")
+}
+
+func TestInfoRefsCacheFailedAdvertisement(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{})
+	a := &api.Response{GL_REPOSITORY: "project-1"}
+
+	var out bytes.Buffer
+	err := c.serve(context.Background(), &out, a, "", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("gitaly went away")
+	})
+	require.Error(t, err)
+
+	calls := 0
+	require.Equal(t, "refs", serveInfoRefs(t, c, a, "", advertisement("refs", &calls)))
+	require.Equal(t, 1, calls)
+}
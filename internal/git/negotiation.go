@@ -0,0 +1,290 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of fetches, told apart by their negotiation
+const (
+	fetchKindNone        = "none"
+	fetchKindClone       = "clone"
+	fetchKindShallow     = "shallow"
+	fetchKindPartial     = "partial"
+	fetchKindIncremental = "incremental"
+)
+
+var (
+	uploadPackWants = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_wants",
+			Help:    "Number of 'want' lines per upload-pack request, partitioned by fetch kind.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+		[]string{"kind"},
+	)
+
+	uploadPackHaves = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_haves",
+			Help:    "Number of 'have' lines per upload-pack request, partitioned by fetch kind.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+		[]string{"kind"},
+	)
+
+	uploadPackDeepen = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_deepen",
+			Help:    "Requested depth of shallow upload-pack requests.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackWants)
+	prometheus.MustRegister(uploadPackHaves)
+	prometheus.MustRegister(uploadPackDeepen)
+}
+
+// negotiation summarizes the pkt-lines a client sent to upload-pack. It
+// understands the want/have exchange of protocol v0/v1 as well as the
+// arguments of a protocol v2 fetch command.
+type negotiation struct {
+	wants          int
+	haves          int
+	shallows       int
+	deepen         int
+	deepenLine     bool
+	deepenSince    bool
+	deepenNot      bool
+	deepenRelative bool
+	filter         string
+	done           bool
+	capabilities   []string
+}
+
+// parseNegotiation reads body up to the end or up to the first malformed
+// pkt-line. The lines read until then are counted even if err is not nil.
+func parseNegotiation(body io.Reader) (*negotiation, error) {
+	n := &negotiation{}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		n.addLine(scanner.Bytes())
+	}
+
+	return n, scanner.Err()
+}
+
+// maxNegotiationHead bounds the memory readNegotiationHead uses, also when
+// upload-pack requests have no size limit. 4MB hold over 80,000 wants.
+var maxNegotiationHead = 4 * 1024 * 1024
+
+// readNegotiationHead reads pkt-lines from r into head until the first
+// 'have' line, the end of the request or maxNegotiationHead bytes,
+// whichever comes first. That is enough to tell the kind of fetch: wants,
+// depth and filter come before the haves. complete is true when head
+// holds the whole request. If err is not nil, head still holds everything
+// read from r.
+func readNegotiationHead(r *bufio.Reader, n *negotiation) (head []byte, complete bool, err error) {
+	var buf bytes.Buffer
+
+	for buf.Len() < maxNegotiationHead {
+		pkt, err := readPktLine(r)
+		buf.Write(pkt)
+		if err == io.EOF {
+			return buf.Bytes(), true, nil
+		}
+		if err != nil {
+			return buf.Bytes(), false, err
+		}
+
+		payload := pkt[4:]
+		n.addLine(payload)
+
+		if bytes.HasPrefix(payload, []byte("have ")) {
+			return buf.Bytes(), false, nil
+		}
+	}
+
+	return buf.Bytes(), false, nil
+}
+
+// readPktLine returns the next pkt-line of r including its length prefix.
+// On a short read the partial pkt-line is returned along with the error.
+func readPktLine(r *bufio.Reader) ([]byte, error) {
+	prefix, err := r.Peek(4)
+	if err == io.EOF && len(prefix) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readPktLine: incomplete length prefix on %q", prefix)
+	}
+
+	length, err := strconv.ParseInt(string(prefix), 16, 0)
+	if err != nil {
+		return nil, fmt.Errorf("readPktLine: decode length: %v", err)
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("readPktLine: invalid length: %d", length)
+	}
+	if length < 4 {
+		// flush, delimiter and response end packets
+		length = 4
+	}
+
+	pkt := make([]byte, length)
+	if n, err := io.ReadFull(r, pkt); err != nil {
+		return pkt[:n], fmt.Errorf("readPktLine: %v", err)
+	}
+
+	return pkt, nil
+}
+
+// addLine counts the pkt-line payload line
+func (n *negotiation) addLine(payload []byte) {
+	line := strings.TrimSuffix(string(payload), "\n")
+	if line == "" || strings.HasPrefix(line, "command=") {
+		return
+	}
+
+	key, value := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		key, value = line[:i], line[i+1:]
+	}
+
+	switch key {
+	case "want":
+		n.wants++
+		// In protocol v0/v1 the capabilities follow the object ID on the
+		// first want line
+		if fields := strings.Fields(value); n.wants == 1 && len(fields) > 1 {
+			n.capabilities = append(n.capabilities, fields[1:]...)
+		}
+	case "want-ref":
+		n.wants++
+	case "have":
+		n.haves++
+	case "shallow":
+		n.shallows++
+	case "deepen":
+		// Any deepen line makes a shallow request, even "deepen 0"
+		n.deepenLine = true
+		n.deepen, _ = strconv.Atoi(value)
+	case "deepen-relative":
+		n.deepenRelative = true
+	case "deepen-since":
+		n.deepenSince = true
+	case "deepen-not":
+		n.deepenNot = true
+	case "filter":
+		n.filter = value
+	case "done":
+		n.done = true
+	default:
+		// Protocol v2 capabilities and flag arguments such as
+		// "agent=git/2.20.1", "thin-pack" or "ofs-delta"
+		if value == "" {
+			n.capabilities = append(n.capabilities, key)
+		}
+	}
+}
+
+// negotiationCounter is an io.Writer that counts the pkt-lines written to
+// it. It is meant to be the side of an io.TeeReader, so it never fails:
+// after a malformed pkt-line it stops counting and remembers the error.
+type negotiationCounter struct {
+	sync.Mutex
+	n       *negotiation
+	pending []byte
+	err     error
+}
+
+func (c *negotiationCounter) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.err != nil {
+		return len(p), nil
+	}
+
+	c.pending = append(c.pending, p...)
+	for {
+		advance, token, err := pktLineSplitter(c.pending, false)
+		if err != nil {
+			c.err = err
+			c.pending = nil
+			break
+		}
+		if advance == 0 {
+			break
+		}
+
+		c.n.addLine(token)
+		c.pending = c.pending[advance:]
+	}
+
+	// Do not keep the consumed part of the buffer alive
+	c.pending = append([]byte(nil), c.pending...)
+
+	return len(p), nil
+}
+
+// result returns a copy of the counts so far and the parse error, if any
+func (c *negotiationCounter) result() (negotiation, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return *c.n, c.err
+}
+
+func (n *negotiation) deepened() bool {
+	return n.deepen > 0 || n.deepenLine || n.deepenSince || n.deepenNot || n.deepenRelative
+}
+
+func (n *negotiation) kind() string {
+	switch {
+	case n.wants == 0:
+		return fetchKindNone
+	case n.deepened():
+		return fetchKindShallow
+	case n.filter != "":
+		return fetchKindPartial
+	case n.haves == 0:
+		return fetchKindClone
+	default:
+		return fetchKindIncremental
+	}
+}
+
+func (n *negotiation) observe() {
+	kind := n.kind()
+	uploadPackWants.WithLabelValues(kind).Observe(float64(n.wants))
+	uploadPackHaves.WithLabelValues(kind).Observe(float64(n.haves))
+	if n.deepen > 0 {
+		uploadPackDeepen.Observe(float64(n.deepen))
+	}
+}
+
+func (n *negotiation) logFields() map[string]interface{} {
+	return map[string]interface{}{
+		"gitFetchKind":    n.kind(),
+		"gitWants":        n.wants,
+		"gitHaves":        n.haves,
+		"gitShallows":     n.shallows,
+		"gitDeepen":       n.deepen,
+		"gitFilter":       n.filter,
+		"gitDone":         n.done,
+		"gitCapabilities": strings.Join(n.capabilities, " "),
+	}
+}
@@ -0,0 +1,195 @@
+package git
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const (
+	oid1 = "1e292f8fedd741b75372e19097c76d327140c312"
+	oid2 = "6907208d755b60ebeacb2e9dfea74c92c3449a1f"
+)
+
+func TestParseNegotiation(t *testing.T) {
+	examples := []struct {
+		desc         string
+		input        string
+		wants        int
+		haves        int
+		shallows     int
+		deepen       int
+		filter       string
+		done         bool
+		capabilities string
+		kind         string
+	}{
+		{
+			desc:         "v0 clone",
+			input:        pktLine("want "+oid1+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.20.1\n") + pktLine("want "+oid2+"\n") + "0000" + pktLine("done\n"),
+			wants:        2,
+			done:         true,
+			capabilities: "multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.20.1",
+			kind:         fetchKindClone,
+		},
+		{
+			desc:         "v0 shallow",
+			input:        pktLine("want "+oid1+" thin-pack\n") + pktLine("shallow "+oid2+"\n") + pktLine("deepen 50\n") + "0000" + pktLine("done\n"),
+			wants:        1,
+			shallows:     1,
+			deepen:       50,
+			done:         true,
+			capabilities: "thin-pack",
+			kind:         fetchKindShallow,
+		},
+		{
+			desc:  "v0 incremental",
+			input: pktLine("want "+oid1+"\n") + "0000" + pktLine("have "+oid2+"\n") + pktLine("have "+oid1+"\n") + "0000",
+			wants: 1,
+			haves: 2,
+			kind:  fetchKindIncremental,
+		},
+		{
+			desc:         "v2 partial clone",
+			input:        pktLine("command=fetch\n") + pktLine("agent=git/2.20.1\n") + "0001" + pktLine("thin-pack\n") + pktLine("ofs-delta\n") + pktLine("want "+oid1+"\n") + pktLine("filter blob:none\n") + pktLine("done\n") + "0000",
+			wants:        1,
+			filter:       "blob:none",
+			done:         true,
+			capabilities: "agent=git/2.20.1 thin-pack ofs-delta",
+			kind:         fetchKindPartial,
+		},
+		{
+			desc:  "empty",
+			input: "0000",
+			kind:  fetchKindNone,
+		},
+	}
+
+	for _, example := range examples {
+		n, err := parseNegotiation(strings.NewReader(example.input))
+		if err != nil {
+			t.Fatalf("%s: %v", example.desc, err)
+		}
+
+		if n.wants != example.wants || n.haves != example.haves || n.shallows != example.shallows || n.deepen != example.deepen {
+			t.Fatalf("%s: unexpected counts %+v", example.desc, n)
+		}
+		if n.filter != example.filter || n.done != example.done {
+			t.Fatalf("%s: unexpected filter or done %+v", example.desc, n)
+		}
+		if capabilities := strings.Join(n.capabilities, " "); capabilities != example.capabilities {
+			t.Fatalf("%s: expected capabilities %q, got %q", example.desc, example.capabilities, capabilities)
+		}
+		if kind := n.kind(); kind != example.kind {
+			t.Fatalf("%s: expected kind %q, got %q", example.desc, example.kind, kind)
+		}
+	}
+}
+
+func TestParseNegotiationMalformed(t *testing.T) {
+	input := pktLine("want "+oid1+"\n") + pktLine("have "+oid2+"\n") + "zzzz"
+
+	n, err := parseNegotiation(strings.NewReader(input))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if n.wants != 1 || n.haves != 1 {
+		t.Fatalf("lines before the error must be counted, got %+v", n)
+	}
+}
+
+func TestReadNegotiationHead(t *testing.T) {
+	wants := pktLine("want "+oid1+" thin-pack\n") + pktLine("deepen 1\n") + "0000"
+	haves := pktLine("have "+oid2+"\n") + pktLine("have "+oid1+"\n") + pktLine("done\n")
+
+	n := &negotiation{}
+	br := bufio.NewReader(strings.NewReader(wants + haves))
+	head, complete, err := readNegotiationHead(br, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Fatal("expected head to stop at the first have")
+	}
+	if expected := wants + pktLine("have "+oid2+"\n"); string(head) != expected {
+		t.Fatalf("expected head %q, got %q", expected, head)
+	}
+	if n.wants != 1 || n.deepen != 1 || n.haves != 1 {
+		t.Fatalf("unexpected negotiation %+v", n)
+	}
+
+	n = &negotiation{}
+	head, complete, err = readNegotiationHead(bufio.NewReader(strings.NewReader(wants)), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete || string(head) != wants {
+		t.Fatalf("expected complete head %q, got %q (complete: %v)", wants, head, complete)
+	}
+}
+
+func TestReadNegotiationHeadLimit(t *testing.T) {
+	defer func(max int) { maxNegotiationHead = max }(maxNegotiationHead)
+	maxNegotiationHead = 100
+
+	want := pktLine("want " + oid1 + "\n")
+	request := strings.Repeat(want, 10) + "0000" + pktLine("done\n")
+
+	n := &negotiation{}
+	head, complete, err := readNegotiationHead(bufio.NewReader(strings.NewReader(request)), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Fatal("expected head to stop at the limit")
+	}
+	if expected := strings.Repeat(want, 2); string(head) != expected {
+		t.Fatalf("expected head %q, got %q", expected, head)
+	}
+}
+
+func TestReadNegotiationHeadMalformed(t *testing.T) {
+	for _, input := range []string{
+		pktLine("want "+oid1+"\n") + "zzzz",
+		pktLine("want "+oid1+"\n") + "00",
+		pktLine("want "+oid1+"\n") + "0010want",
+	} {
+		head, _, err := readNegotiationHead(bufio.NewReader(strings.NewReader(input)), &negotiation{})
+		if err == nil {
+			t.Fatalf("%q: expected error", input)
+		}
+		if !strings.HasPrefix(input, string(head)) || !strings.HasPrefix(string(head), pktLine("want "+oid1+"\n")) {
+			t.Fatalf("%q: head must hold what was read, got %q", input, head)
+		}
+	}
+}
+
+func TestNegotiationCounter(t *testing.T) {
+	input := pktLine("want "+oid1+"\n") + "0000" + pktLine("have "+oid2+"\n") + pktLine("have "+oid1+"\n") + pktLine("done\n")
+
+	// Write in chunks that split pkt-lines
+	counter := &negotiationCounter{n: &negotiation{}}
+	for i := 0; i < len(input); i += 7 {
+		end := i + 7
+		if end > len(input) {
+			end = len(input)
+		}
+		counter.Write([]byte(input[i:end]))
+	}
+
+	n, err := counter.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.wants != 1 || n.haves != 2 || !n.done {
+		t.Fatalf("unexpected negotiation %+v", n)
+	}
+
+	counter = &negotiationCounter{n: &negotiation{}}
+	if written, err := counter.Write([]byte(pktLine("have "+oid1+"\n") + "zzzz")); err != nil || written != len(pktLine("have "+oid1+"\n"))+4 {
+		t.Fatalf("counter must not fail the tee, got %d, %v", written, err)
+	}
+	if _, err := counter.result(); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
@@ -1,7 +1,6 @@
 package git
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -9,15 +8,8 @@ import (
 )
 
 func scanDeepen(body io.Reader) bool {
-	scanner := bufio.NewScanner(body)
-	scanner.Split(pktLineSplitter)
-	for scanner.Scan() {
-		if bytes.HasPrefix(scanner.Bytes(), []byte("deepen")) && scanner.Err() == nil {
-			return true
-		}
-	}
-
-	return false
+	n, _ := parseNegotiation(body)
+	return n.deepened()
 }
 
 func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -43,7 +35,13 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// Cast is safe because we requested an int-size number from strconv.ParseInt
 	pktLength := int(pktLength64)
 
-	if pktLength < 0 {
+	if pktLength == 1 || pktLength == 2 {
+		// special case: protocol v2 "0001" delimiter and "0002" response end
+		// packets carry no data either
+		return 4, data[:0], nil
+	}
+
+	if pktLength < 4 {
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
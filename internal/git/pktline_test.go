@@ -13,6 +13,9 @@ func TestSuccessfulScanDeepen(t *testing.T) {
 		{"000dsomething000cdeepen 10000", true},
 		{"000dsomething0000000cdeepen 1", true},
 		{"000dsomething0000", false},
+		{"000dsomething000cdeepen 00000", true},
+		{"0012command=fetch\n00010014deepen-relative\n000cdeepen 10000", true},
+		{"0012command=fetch\n00010014deepen-relative\n0000", true},
 	}
 
 	for _, example := range examples {
@@ -29,6 +32,7 @@ func TestFailedScanDeepen(t *testing.T) {
 		"invalid data",
 		"deepen",
 		"000cdeepen",
+		"0003000cdeepen 10000",
 	}
 
 	for _, example := range examples {
@@ -37,3 +41,11 @@ func TestFailedScanDeepen(t *testing.T) {
 		}
 	}
 }
+
+func TestScanDeepenV2(t *testing.T) {
+	input := "0012command=fetch\n0001000cdeepen 10000"
+
+	if !scanDeepen(bytes.NewReader([]byte(input))) {
+		t.Fatalf("scanDeepen %q: expected result to be true, got false", input)
+	}
+}
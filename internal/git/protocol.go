@@ -0,0 +1,80 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Commands of Git wire protocol version 2, see
+// Documentation/technical/protocol-v2.txt in the Git source tree
+const (
+	v2CommandLsRefs     = "ls-refs"
+	v2CommandFetch      = "fetch"
+	v2CommandObjectInfo = "object-info"
+	v2CommandBundleURI  = "bundle-uri"
+	v2CommandUnknown    = "unknown"
+)
+
+// v2CommandRequestLimits caps the size of the request body per protocol v2
+// command. ls-refs, object-info and bundle-uri requests only carry a
+// handful of arguments; fetch uses the general upload-pack limit. These
+// limits are fixed on purpose and documented as such in README.md: unlike
+// fetch requests, their size does not grow with the repository.
+var v2CommandRequestLimits = map[string]int64{
+	v2CommandLsRefs:     1024 * 1024,
+	v2CommandObjectInfo: 1024 * 1024,
+	v2CommandBundleURI:  1024 * 1024,
+}
+
+// protocolVersion returns the Git protocol version that the colon-separated
+// Git-Protocol header asks for. Like git, it picks the highest version it
+// knows (0, 1 or 2) and ignores unknown ones.
+func protocolVersion(gitProtocol string) int {
+	version := 0
+	for _, param := range strings.Split(gitProtocol, ":") {
+		switch param {
+		case "version=1":
+			if version < 1 {
+				version = 1
+			}
+		case "version=2":
+			version = 2
+		}
+	}
+
+	return version
+}
+
+// isProtocolV2 tells whether the colon-separated Git-Protocol header asks
+// for protocol version 2
+func isProtocolV2(gitProtocol string) bool {
+	return protocolVersion(gitProtocol) == 2
+}
+
+// scanV2Command returns the command of a protocol v2 request, which must
+// start with a "command=<name>" pkt-line. Commands we do not know are
+// returned as v2CommandUnknown to keep metric label values bounded.
+func scanV2Command(body io.Reader) (string, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("scanV2Command: %v", err)
+		}
+		return "", fmt.Errorf("scanV2Command: empty request")
+	}
+
+	line := strings.TrimSuffix(scanner.Text(), "\n")
+	if !strings.HasPrefix(line, "command=") {
+		return "", fmt.Errorf("scanV2Command: expected command, got %q", line)
+	}
+
+	switch command := strings.TrimPrefix(line, "command="); command {
+	case v2CommandLsRefs, v2CommandFetch, v2CommandObjectInfo, v2CommandBundleURI:
+		return command, nil
+	default:
+		return v2CommandUnknown, nil
+	}
+}
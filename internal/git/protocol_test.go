@@ -0,0 +1,121 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func TestIsProtocolV2(t *testing.T) {
+	examples := []struct {
+		header string
+		v2     bool
+	}{
+		{"", false},
+		{"version=1", false},
+		{"version=2", true},
+		{"object-format=sha1:version=2", true},
+		{"version=20", false},
+	}
+
+	for _, example := range examples {
+		if v2 := isProtocolV2(example.header); v2 != example.v2 {
+			t.Fatalf("isProtocolV2 %q: expected %v, got %v", example.header, example.v2, v2)
+		}
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	examples := []struct {
+		header  string
+		version int
+	}{
+		{"", 0},
+		{"version=0", 0},
+		{"version=1", 1},
+		{"version=2", 2},
+		{"version=2:version=1", 2},
+		{"object-format=sha1:version=1", 1},
+		{"version=3", 0},
+	}
+
+	for _, example := range examples {
+		if version := protocolVersion(example.header); version != example.version {
+			t.Fatalf("protocolVersion %q: expected %d, got %d", example.header, example.version, version)
+		}
+	}
+}
+
+func TestScanV2Command(t *testing.T) {
+	examples := []struct {
+		input   string
+		command string
+	}{
+		{pktLine("command=ls-refs\n") + pktLine("agent=git/2.20.1\n") + "0001" + pktLine("peel\n") + "0000", v2CommandLsRefs},
+		{pktLine("command=fetch\n") + "0001" + pktLine("done\n") + "0000", v2CommandFetch},
+		{pktLine("command=object-info") + "0000", v2CommandObjectInfo},
+		{pktLine("command=frobnicate\n") + "0000", v2CommandUnknown},
+	}
+
+	for _, example := range examples {
+		command, err := scanV2Command(strings.NewReader(example.input))
+		if err != nil {
+			t.Fatalf("scanV2Command %q: %v", example.input, err)
+		}
+		if command != example.command {
+			t.Fatalf("scanV2Command %q: expected %q, got %q", example.input, example.command, command)
+		}
+	}
+}
+
+func TestFailedScanV2Command(t *testing.T) {
+	examples := []string{
+		"",
+		"0000",
+		pktLine("want 0000000000000000000000000000000000000000\n"),
+		"invalid data",
+	}
+
+	for _, example := range examples {
+		if _, err := scanV2Command(strings.NewReader(example)); err == nil {
+			t.Fatalf("scanV2Command %q: expected error", example)
+		}
+	}
+}
+
+func TestUploadPackV2RequestLimit(t *testing.T) {
+	body := pktLine("command=ls-refs\n") + "0001"
+	for int64(len(body)) <= v2CommandRequestLimits[v2CommandLsRefs] {
+		body += pktLine("ref-prefix refs/heads/" + strings.Repeat("x", 100) + "\n")
+	}
+	body += "0000"
+
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", bytes.NewReader([]byte(body)))
+	req.Header.Set("Git-Protocol", "version=2")
+
+	rr := httptest.NewRecorder()
+	w := NewHttpResponseWriter(rr)
+	if err := (&uploadPack{}).handle(w, req, &api.Response{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	expected := pktLine(fmt.Sprintf("ERR ls-refs request is larger than %d bytes\n", v2CommandRequestLimits[v2CommandLsRefs]))
+	if response := rr.Body.String(); response != expected {
+		t.Fatalf("expected %q, got %q", expected, response)
+	}
+	if w.command != v2CommandLsRefs {
+		t.Fatalf("expected command %q, got %q", v2CommandLsRefs, w.command)
+	}
+}
@@ -0,0 +1,462 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/packfile"
+)
+
+const (
+	defaultPushInspectionMaxMemory      = 256 * 1024 * 1024
+	defaultPushInspectionMaxTotalMemory = 1024 * 1024 * 1024
+	defaultPushInspectionMaxScanSize    = 1024 * 1024
+
+	// pushedCommitSize and treeEntrySize approximate the memory used to
+	// remember a commit and a tree entry for locating blobs
+	pushedCommitSize = 128
+	treeEntrySize    = 96
+
+	// maxPushFindings limits the findings listed in a rejection message
+	maxPushFindings = 10
+
+	// packHeldBackSize covers the checksum at the end of a packfile.
+	// Without it, receive-pack cannot finish a push.
+	packHeldBackSize = 32
+)
+
+var defaultSecretPatterns = []config.SecretPattern{
+	{Name: "private key", Pattern: `-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`},
+	{Name: "AWS access key", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "Google Cloud API key", Pattern: `\bAIza[0-9A-Za-z_\-]{35}\b`},
+}
+
+var (
+	pushInspections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_push_inspections",
+			Help: "How many pushed packfiles have been inspected, partitioned by result (clean, rejected, failed, skipped).",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pushInspections)
+}
+
+type secretPattern struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+// PushInspector reads the packfiles of pushes as they are streamed to
+// receive-pack and rejects pushes with blobs over the size limit of the
+// project or with contents that look like secrets. Every inspection may
+// use maxMemory; pushes beyond the number of inspections that fit into
+// the total memory limit are let through uninspected. A nil
+// *PushInspector inspects nothing.
+type PushInspector struct {
+	maxMemory   int64
+	maxScanSize int64
+	patterns    []secretPattern
+	slots       chan struct{}
+}
+
+// NewPushInspector returns nil if cfg is nil
+func NewPushInspector(cfg *config.PushInspectionConfig) (*PushInspector, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	p := &PushInspector{
+		maxMemory:   cfg.MaxMemory,
+		maxScanSize: cfg.MaxScanSize,
+	}
+	if p.maxMemory <= 0 {
+		p.maxMemory = defaultPushInspectionMaxMemory
+	}
+	if p.maxScanSize <= 0 {
+		p.maxScanSize = defaultPushInspectionMaxScanSize
+	}
+
+	maxTotalMemory := cfg.MaxTotalMemory
+	if maxTotalMemory <= 0 {
+		maxTotalMemory = defaultPushInspectionMaxTotalMemory
+	}
+	if maxTotalMemory < p.maxMemory {
+		return nil, fmt.Errorf("NewPushInspector: MaxTotalMemory must not be less than MaxMemory")
+	}
+	p.slots = make(chan struct{}, maxTotalMemory/p.maxMemory)
+
+	patterns := cfg.SecretPatterns
+	if !cfg.DisableDefaultSecretPatterns {
+		patterns = append(defaultSecretPatterns[:len(defaultSecretPatterns):len(defaultSecretPatterns)], patterns...)
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("NewPushInspector: secret pattern %q: %v", pattern.Name, err)
+		}
+		p.patterns = append(p.patterns, secretPattern{name: pattern.Name, regexp: re})
+	}
+
+	return p, nil
+}
+
+// pushFinding is a reason to reject a blob
+type pushFinding struct {
+	// blobID is empty for blobs that could only be read in part
+	blobID  string
+	reason  string
+	problem string
+}
+
+type pushedCommit struct {
+	id   string
+	tree string
+}
+
+// packInspection collects what the inspector learns from a packfile
+type packInspection struct {
+	commits  []pushedCommit
+	trees    map[string][]packfile.TreeEntry
+	findings []pushFinding
+}
+
+// inspect reads the packfile from pack and returns a rejection as soon as
+// it finds a blob larger than maxBlobSize or contents that look like
+// secrets. A maxBlobSize of 0 means unlimited. Commits and trees are kept
+// to name the paths of findings for as long as the memory limit permits.
+func (p *PushInspector) inspect(pack io.Reader, maxBlobSize int64) (*pushRejection, error) {
+	reader, err := packfile.NewReader(pack, p.maxScanSize, p.maxMemory)
+	if err == io.EOF {
+		// Pushes that only delete refs come without a packfile
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &packInspection{trees: make(map[string][]packfile.TreeEntry)}
+	for {
+		obj, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p.inspectObject(s, reader, obj, maxBlobSize)
+		if len(s.findings) > 0 {
+			return s.rejection(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *PushInspector) inspectObject(s *packInspection, reader *packfile.Reader, obj *packfile.Object, maxBlobSize int64) {
+	switch obj.Type {
+	case packfile.ObjectCommit:
+		if tree, err := packfile.CommitTree(obj.Data); err == nil && reader.Reserve(pushedCommitSize) {
+			s.commits = append(s.commits, pushedCommit{id: obj.ID, tree: tree})
+		}
+
+	case packfile.ObjectTree:
+		if entries, err := packfile.ParseTree(obj.Data); err == nil && obj.ID != "" && reader.Reserve(int64(len(obj.Data)+len(entries)*treeEntrySize)) {
+			s.trees[obj.ID] = entries
+		}
+
+	case packfile.ObjectBlob:
+		if maxBlobSize > 0 && obj.Size > maxBlobSize {
+			s.findings = append(s.findings, pushFinding{
+				blobID:  obj.ID,
+				reason:  rejectPushBlobTooLarge,
+				problem: fmt.Sprintf("is %d bytes, larger than the limit of %d bytes", obj.Size, maxBlobSize),
+			})
+			return
+		}
+
+		if obj.Data != nil {
+			p.scanSecrets(s, obj.ID, obj.Data)
+		} else if obj.Delta != nil {
+			p.scanSecrets(s, obj.ID, packfile.DeltaInserts(obj.Delta))
+		}
+
+	case packfile.ObjectUnresolved:
+		// Most likely a blob of a thin pack, changed from a version that
+		// the repository already has. What it adds is what matters.
+		if obj.Delta != nil {
+			p.scanSecrets(s, "", packfile.DeltaInserts(obj.Delta))
+		}
+	}
+}
+
+func (p *PushInspector) scanSecrets(s *packInspection, blobID string, data []byte) {
+	if isBinary(data) {
+		return
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.regexp.Match(data) {
+			s.findings = append(s.findings, pushFinding{
+				blobID:  blobID,
+				reason:  rejectPushSecret,
+				problem: "contains a possible " + pattern.name,
+			})
+		}
+	}
+}
+
+// isBinary applies the heuristic of Git: data with a NUL byte near its
+// start is binary
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+type blobLocation struct {
+	commit string
+	path   string
+}
+
+// locate finds a path and commit for each blob in ids by walking the trees
+// in the packfile. Blobs only reachable through trees that are not in the
+// packfile are not found.
+func (s *packInspection) locate(ids map[string]bool) map[string]blobLocation {
+	locations := make(map[string]blobLocation)
+	visited := make(map[string]bool)
+
+	var walk func(commit string, tree string, prefix string)
+	walk = func(commit string, tree string, prefix string) {
+		if visited[tree] {
+			return
+		}
+		visited[tree] = true
+
+		for _, entry := range s.trees[tree] {
+			entryPath := path.Join(prefix, entry.Name)
+			switch {
+			case entry.IsTree():
+				walk(commit, entry.ID, entryPath)
+			case entry.IsBlob() && ids[entry.ID]:
+				if _, ok := locations[entry.ID]; !ok {
+					locations[entry.ID] = blobLocation{commit: commit, path: entryPath}
+				}
+			}
+		}
+	}
+
+	// Git writes newer commits first. Walking the oldest commit first finds
+	// the commit that added a blob, unless the trees of that commit come
+	// after the blob in the packfile and were never read.
+	for i := len(s.commits) - 1; i >= 0; i-- {
+		walk(s.commits[i].id, s.commits[i].tree, "")
+	}
+
+	return locations
+}
+
+func (s *packInspection) rejection() *pushRejection {
+	ids := make(map[string]bool)
+	for _, f := range s.findings {
+		if f.blobID != "" {
+			ids[f.blobID] = true
+		}
+	}
+	locations := s.locate(ids)
+
+	rejection := &pushRejection{reason: rejectPushBlobTooLarge, status: "blob too large"}
+	lines := []string{"Your push contains content that is not allowed:"}
+	for i, f := range s.findings {
+		if f.reason == rejectPushSecret {
+			rejection.reason = rejectPushSecret
+			rejection.status = "secret detected"
+		}
+
+		if i == maxPushFindings {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(s.findings)-maxPushFindings))
+			continue
+		}
+		if i > maxPushFindings {
+			continue
+		}
+
+		location, ok := locations[f.blobID]
+		switch {
+		case ok:
+			lines = append(lines, fmt.Sprintf("  %s in commit %s %s", location.path, shortID(location.commit), f.problem))
+		case f.blobID != "":
+			lines = append(lines, fmt.Sprintf("  blob %s %s", shortID(f.blobID), f.problem))
+		default:
+			lines = append(lines, fmt.Sprintf("  a changed file %s", f.problem))
+		}
+	}
+	rejection.message = strings.Join(lines, "\n")
+
+	return rejection
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// inspectedPack passes a packfile on while the inspector reads it. The end
+// of the packfile is held back until the inspection is done, so that
+// receive-pack never gets to accept a push that is rejected.
+type inspectedPack struct {
+	r          io.Reader
+	pw         *io.PipeWriter
+	resultC    chan *pushRejection
+	held       []byte
+	buf        []byte
+	inspecting bool
+	err        error
+
+	mu        sync.Mutex
+	rejection *pushRejection
+}
+
+// start returns a reader that yields pack while it is being inspected. If
+// the inspection fails, the push is let through. If no memory is left for
+// the inspection, start returns nil.
+func (p *PushInspector) start(ctx context.Context, pack io.Reader, maxBlobSize int64) *inspectedPack {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		pushInspections.WithLabelValues("skipped").Inc()
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	i := &inspectedPack{
+		r:          pack,
+		pw:         pw,
+		resultC:    make(chan *pushRejection, 1),
+		inspecting: true,
+	}
+
+	go func() {
+		defer func() { <-p.slots }()
+
+		rejection, err := p.inspect(pr, maxBlobSize)
+		switch {
+		case err != nil:
+			pushInspections.WithLabelValues("failed").Inc()
+			log.WithError(ctx, err).Warning("PushInspector: inspection failed")
+		case rejection != nil:
+			pushInspections.WithLabelValues("rejected").Inc()
+		default:
+			pushInspections.WithLabelValues("clean").Inc()
+		}
+
+		// Unblock writes of data the inspector did not read
+		pr.CloseWithError(io.ErrClosedPipe)
+		i.resultC <- rejection
+	}()
+
+	return i
+}
+
+func (i *inspectedPack) Read(p []byte) (int, error) {
+	for {
+		available := len(i.held) - packHeldBackSize
+		if i.err != nil {
+			available = len(i.held)
+		}
+		if available > 0 {
+			n := copy(p, i.held[:available])
+			i.held = i.held[n:]
+			return n, nil
+		}
+		if i.err != nil {
+			return 0, i.err
+		}
+
+		if len(i.buf) < len(p) {
+			i.buf = make([]byte, len(p))
+		}
+		n, err := i.r.Read(i.buf[:len(p)])
+		if i.inspecting && n > 0 {
+			if _, err := i.pw.Write(i.buf[:n]); err != nil {
+				// The inspection is over before the end of the pack
+				i.inspecting = false
+				if rejection := <-i.resultC; rejection != nil {
+					i.reject(rejection)
+					return 0, rejection
+				}
+			}
+		}
+		i.held = append(i.held, i.buf[:n]...)
+
+		switch {
+		case err == io.EOF:
+			i.pw.Close()
+			i.err = io.EOF
+			if i.inspecting {
+				i.inspecting = false
+				if rejection := <-i.resultC; rejection != nil {
+					i.reject(rejection)
+				}
+			}
+		case err != nil:
+			i.pw.CloseWithError(err)
+			return 0, err
+		}
+	}
+}
+
+// reject drops what is held back so that receive-pack never gets the
+// end of the pack
+func (i *inspectedPack) reject(rejection *pushRejection) {
+	i.mu.Lock()
+	i.rejection = rejection
+	i.mu.Unlock()
+
+	i.held = nil
+	i.err = rejection
+}
+
+// rejected returns the rejection of the inspection, if any. It may be
+// called while another goroutine reads.
+func (i *inspectedPack) rejected() *pushRejection {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rejection
+}
+
+// readPushOptions reads the push options that follow the command list when
+// the client uses the push-options capability. raw holds everything read
+// from r.
+func readPushOptions(r *bufio.Reader) (raw []byte, err error) {
+	for {
+		pkt, err := readPktLine(r)
+		raw = append(raw, pkt...)
+		if err != nil {
+			return raw, err
+		}
+
+		if len(pkt) == 4 {
+			return raw, nil
+		}
+	}
+}
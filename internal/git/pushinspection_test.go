@@ -0,0 +1,178 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+// inspectionFixture returns the commands and the packfile of a
+// receive-pack request fixture
+func inspectionFixture(t *testing.T, name string) (commands []byte, pack []byte) {
+	data, err := ioutil.ReadFile(path.Join(testhelper.RootDir(), "testdata", name))
+	require.NoError(t, err)
+
+	i := bytes.Index(data, []byte("0000PACK"))
+	require.True(t, i >= 0, "no packfile in %s", name)
+
+	return data[:i+4], data[i+4:]
+}
+
+func newTestPushInspector(t *testing.T, cfg config.PushInspectionConfig) *PushInspector {
+	inspector, err := NewPushInspector(&cfg)
+	require.NoError(t, err)
+	return inspector
+}
+
+func TestNewPushInspector(t *testing.T) {
+	inspector, err := NewPushInspector(nil)
+	require.NoError(t, err)
+	require.Nil(t, inspector)
+
+	_, err = NewPushInspector(&config.PushInspectionConfig{
+		SecretPatterns: []config.SecretPattern{{Name: "broken", Pattern: "("}},
+	})
+	require.Error(t, err)
+
+	inspector = newTestPushInspector(t, config.PushInspectionConfig{
+		SecretPatterns:               []config.SecretPattern{{Name: "token", Pattern: "glpat-[0-9a-zA-Z]{20}"}},
+		DisableDefaultSecretPatterns: true,
+	})
+	require.Len(t, inspector.patterns, 1)
+	require.Equal(t, "token", inspector.patterns[0].name)
+}
+
+func TestPushInspectorFindsSecretsAndLargeBlobs(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{})
+
+	// The inspection stops at the first finding
+	rejection, err := inspector.inspect(bytes.NewReader(pack), 100*1024)
+	require.NoError(t, err)
+	require.NotNil(t, rejection)
+	require.Equal(t, rejectPushBlobTooLarge, rejection.reason)
+	require.Contains(t, rejection.message, "assets/big.bin in commit de7919a5 is 204800 bytes, larger than the limit of 102400 bytes")
+	require.NotContains(t, rejection.message, "config/deploy.key")
+
+	rejection, err = inspector.inspect(bytes.NewReader(pack), 0)
+	require.NoError(t, err)
+	require.NotNil(t, rejection)
+	require.Equal(t, rejectPushSecret, rejection.reason)
+	require.Equal(t, "secret detected", rejection.status)
+	require.Contains(t, rejection.message, "config/deploy.key in commit de7919a5 contains a possible private key")
+}
+
+func TestPushInspectorMemoryLimit(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+
+	// Without memory for trees the blob cannot be located
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{MaxMemory: 1})
+	rejection, err := inspector.inspect(bytes.NewReader(pack), 0)
+	require.NoError(t, err)
+	require.NotNil(t, rejection)
+	require.NotContains(t, rejection.message, "config/deploy.key")
+	require.Contains(t, rejection.message, "contains a possible private key")
+}
+
+func TestPushInspectorMaxTotalMemory(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+
+	_, err := NewPushInspector(&config.PushInspectionConfig{MaxMemory: 2048, MaxTotalMemory: 1024})
+	require.Error(t, err)
+
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{MaxMemory: 1024 * 1024, MaxTotalMemory: 1024 * 1024})
+	first := inspector.start(context.Background(), bytes.NewReader(pack), 0)
+	require.NotNil(t, first)
+	require.Nil(t, inspector.start(context.Background(), bytes.NewReader(pack), 0), "no memory left for a second inspection")
+
+	_, err = ioutil.ReadAll(first)
+	require.Error(t, err)
+
+	// The slot is given back once the inspection is done
+	second := inspector.start(context.Background(), bytes.NewReader(pack), 0)
+	require.NotNil(t, second)
+	ioutil.ReadAll(second)
+}
+
+func TestPushInspectorBlobSize(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{DisableDefaultSecretPatterns: true})
+
+	rejection, err := inspector.inspect(bytes.NewReader(pack), 100*1024)
+	require.NoError(t, err)
+	require.NotNil(t, rejection)
+	require.Equal(t, rejectPushBlobTooLarge, rejection.reason)
+	require.Equal(t, "blob too large", rejection.status)
+
+	rejection, err = inspector.inspect(bytes.NewReader(pack), 0)
+	require.NoError(t, err)
+	require.Nil(t, rejection, "no size limit")
+}
+
+func TestPushInspectorThinPack(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-thin-fixture.txt")
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{})
+
+	rejection, err := inspector.inspect(bytes.NewReader(pack), 0)
+	require.NoError(t, err)
+	require.NotNil(t, rejection)
+	require.Contains(t, rejection.message, "contains a possible AWS access key")
+}
+
+func TestPushInspectorNotPack(t *testing.T) {
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{})
+
+	_, err := inspector.inspect(strings.NewReader("not a packfile"), 0)
+	require.Error(t, err)
+
+	rejection, err := inspector.inspect(strings.NewReader(""), 0)
+	require.NoError(t, err, "pushes that only delete refs have no packfile")
+	require.Nil(t, rejection)
+}
+
+func TestInspectedPackHoldsBackRejectedPacks(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{})
+
+	inspected := inspector.start(context.Background(), bytes.NewReader(pack), 0)
+	data, err := ioutil.ReadAll(inspected)
+	require.Error(t, err)
+	require.Equal(t, inspected.rejected(), err)
+	require.True(t, len(data) <= len(pack)-packHeldBackSize, "the end of the packfile is not passed on")
+	require.Equal(t, pack[:len(data)], data)
+}
+
+func TestInspectedPackPassesCleanPacks(t *testing.T) {
+	_, pack := inspectionFixture(t, "receive-pack-inspection-fixture.txt")
+	inspector := newTestPushInspector(t, config.PushInspectionConfig{DisableDefaultSecretPatterns: true})
+
+	for _, data := range [][]byte{pack, []byte("not a packfile")} {
+		inspected := inspector.start(context.Background(), bytes.NewReader(data), 0)
+		out, err := ioutil.ReadAll(inspected)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+		require.Nil(t, inspected.rejected())
+	}
+}
+
+func TestReadPushOptions(t *testing.T) {
+	options := pktLine("ci.skip\n") + pktLine("merge_request.create\n") + "0000"
+	br := bufio.NewReader(strings.NewReader(options + "PACK"))
+
+	raw, err := readPushOptions(br)
+	require.NoError(t, err)
+	require.Equal(t, options, string(raw))
+
+	rest, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Equal(t, "PACK", string(rest))
+}
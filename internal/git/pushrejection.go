@@ -0,0 +1,273 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+// Reasons for rejecting a push
+const (
+	rejectPushTooLarge     = "too_large"
+	rejectPushBlobTooLarge = "blob_too_large"
+	rejectPushSecret       = "secret"
+)
+
+// Sideband channels of the receive-pack response
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+)
+
+var (
+	pushRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_push_rejections",
+			Help: "How many receive-pack requests have been rejected by workhorse, partitioned by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pushRejections)
+}
+
+// receivePackCommand is a single ref update of a push
+type receivePackCommand struct {
+	oldID string
+	newID string
+	ref   string
+}
+
+// receivePackHead holds the ref updates and capabilities that a client
+// sends ahead of the packfile of a push
+type receivePackHead struct {
+	commands     []receivePackCommand
+	capabilities []string
+}
+
+// readReceivePackHead reads pkt-lines from r up to and including the flush
+// packet that ends the command list. raw holds everything read from r,
+// also if err is not nil.
+func readReceivePackHead(r *bufio.Reader) (raw []byte, head *receivePackHead, err error) {
+	var buf bytes.Buffer
+	head = &receivePackHead{}
+
+	for {
+		pkt, err := readPktLine(r)
+		buf.Write(pkt)
+		if err == io.EOF {
+			return buf.Bytes(), head, nil
+		}
+		if err != nil {
+			return buf.Bytes(), head, err
+		}
+
+		payload := pkt[4:]
+		if len(payload) == 0 {
+			return buf.Bytes(), head, nil
+		}
+
+		head.addLine(payload)
+	}
+}
+
+// addLine records the command and capabilities on payload. Lines that are
+// not commands, such as those of a push certificate, are ignored.
+func (h *receivePackHead) addLine(payload []byte) {
+	line := strings.TrimSuffix(string(payload), "\n")
+	if i := strings.IndexByte(line, 0); i >= 0 {
+		h.capabilities = strings.Fields(line[i+1:])
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 3 && isObjectID(fields[0]) && isObjectID(fields[1]) {
+		h.commands = append(h.commands, receivePackCommand{oldID: fields[0], newID: fields[1], ref: fields[2]})
+	}
+}
+
+func (h *receivePackHead) hasCapability(name string) bool {
+	for _, c := range h.capabilities {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pushRejection is the reason why workhorse refuses a push. status is the
+// short text git shows next to each rejected ref; message is shown as
+// "remote: " lines when the client supports sideband.
+type pushRejection struct {
+	reason  string
+	status  string
+	message string
+}
+
+func (p *pushRejection) Error() string {
+	return fmt.Sprintf("push rejected: %s", p.status)
+}
+
+// rejectPush answers a receive-pack request with rejection. It must only be
+// called while the response so far ends on a pkt-line boundary.
+func rejectPush(w io.Writer, r *http.Request, head *receivePackHead, rejection *pushRejection) error {
+	pushRejections.WithLabelValues(rejection.reason).Inc()
+	helper.SetAccessLogField(r.Context(), "gitPushRejection", rejection.reason)
+	log.WithError(r.Context(), rejection).Info("handleReceivePack: push rejected")
+
+	_, err := w.Write(formatPushRejection(head, rejection))
+	return err
+}
+
+// maxDrainBytes is how much of the body of a rejected push is read before
+// the connection is closed instead
+const maxDrainBytes = 4 << 20
+
+// drainBody discards the rest of the request body of a rejected push, so
+// that clients still sending the pack get the rejection instead of a
+// connection reset. Bodies longer than maxDrainBytes are not read to the
+// end: the connection is closed after the rejection.
+func drainBody(w http.ResponseWriter, r *http.Request) {
+	n, err := io.CopyN(ioutil.Discard, r.Body, maxDrainBytes)
+	if n == maxDrainBytes {
+		w.Header().Set("Connection", "close")
+	} else if err != nil && err != io.EOF {
+		log.WithError(r.Context(), err).Warning("handleReceivePack: drain request body")
+	}
+	r.Body.Close()
+}
+
+// formatPushRejection fails every ref update of head with the same status
+// in a report-status response. If the client asked for sideband, the
+// report is wrapped in sideband packets after the message.
+func formatPushRejection(head *receivePackHead, rejection *pushRejection) []byte {
+	var report bytes.Buffer
+	// The unpack and ng lines of report-status-v2 are the same as those of
+	// report-status
+	if head.hasCapability("report-status") || head.hasCapability("report-status-v2") {
+		writePktLine(&report, "unpack "+rejection.status+"\n")
+		for _, c := range head.commands {
+			writePktLine(&report, fmt.Sprintf("ng %s %s\n", c.ref, rejection.status))
+		}
+		report.WriteString("0000")
+	}
+
+	// Sideband packets carry a length prefix and a channel byte
+	var maxData int
+	switch {
+	case head.hasCapability("side-band-64k"):
+		maxData = 65520 - 5
+	case head.hasCapability("side-band"):
+		maxData = 1000 - 5
+	default:
+		return report.Bytes()
+	}
+
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(rejection.message, "\n"), "\n") {
+		writeSideband(&out, sidebandProgress, []byte(strings.TrimSuffix(line, "\n")+"\n"), maxData)
+	}
+	writeSideband(&out, sidebandData, report.Bytes(), maxData)
+	out.WriteString("0000")
+
+	return out.Bytes()
+}
+
+func writeSideband(w io.Writer, channel byte, data []byte, maxData int) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxData {
+			n = maxData
+		}
+
+		fmt.Fprintf(w, "%04x%c", n+5, channel)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+func writePktLine(w io.Writer, s string) error {
+	_, err := fmt.Fprintf(w, "%04x%s", len(s)+4, s)
+	return err
+}
+
+// pktLineTracker passes writes on to w and keeps track of whether the data
+// written so far ends on a pkt-line boundary. More pkt-lines can only be
+// appended to a response that was cut off if it does.
+type pktLineTracker struct {
+	w         io.Writer
+	prefix    []byte
+	remaining int64
+	invalid   bool
+}
+
+func (t *pktLineTracker) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.track(p[:n])
+	return n, err
+}
+
+func (t *pktLineTracker) track(p []byte) {
+	for len(p) > 0 && !t.invalid {
+		if t.remaining > 0 {
+			n := t.remaining
+			if n > int64(len(p)) {
+				n = int64(len(p))
+			}
+			t.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		n := 4 - len(t.prefix)
+		if n > len(p) {
+			n = len(p)
+		}
+		t.prefix = append(t.prefix, p[:n]...)
+		p = p[n:]
+		if len(t.prefix) < 4 {
+			return
+		}
+
+		length, err := strconv.ParseInt(string(t.prefix), 16, 0)
+		if err != nil {
+			t.invalid = true
+			return
+		}
+		if length > 4 {
+			t.remaining = length - 4
+		}
+		t.prefix = t.prefix[:0]
+	}
+}
+
+func (t *pktLineTracker) atBoundary() bool {
+	return !t.invalid && t.remaining == 0 && len(t.prefix) == 0
+}
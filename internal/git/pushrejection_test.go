@@ -0,0 +1,147 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+const zeroID = "0000000000000000000000000000000000000000"
+
+func receivePackRequest(capabilities string, pack string) string {
+	return pktLine(zeroID+" "+oid1+" refs/heads/master\x00"+capabilities+"\n") +
+		pktLine(oid2+" "+oid1+" refs/heads/feature\n") +
+		"0000" + pack
+}
+
+func TestReadReceivePackHead(t *testing.T) {
+	body := receivePackRequest("report-status side-band-64k agent=git/2.20.1", "PACK...")
+
+	br := bufio.NewReader(strings.NewReader(body))
+	raw, head, err := readReceivePackHead(br)
+	require.NoError(t, err)
+
+	require.Equal(t, strings.TrimSuffix(body, "PACK..."), string(raw))
+	require.Equal(t, []receivePackCommand{
+		{oldID: zeroID, newID: oid1, ref: "refs/heads/master"},
+		{oldID: oid2, newID: oid1, ref: "refs/heads/feature"},
+	}, head.commands)
+	require.True(t, head.hasCapability("report-status"))
+	require.True(t, head.hasCapability("side-band-64k"))
+	require.False(t, head.hasCapability("side-band"))
+
+	rest, _ := br.ReadString(0)
+	require.Equal(t, "PACK...", rest)
+}
+
+func TestFormatPushRejection(t *testing.T) {
+	rejection := &pushRejection{reason: "test", status: "rejected", message: "first line\nsecond line\n"}
+	report := pktLine("unpack rejected\n") +
+		pktLine("ng refs/heads/master rejected\n") +
+		pktLine("ng refs/heads/feature rejected\n") +
+		"0000"
+
+	parse := func(capabilities string) *receivePackHead {
+		_, head, err := readReceivePackHead(bufio.NewReader(strings.NewReader(receivePackRequest(capabilities, ""))))
+		require.NoError(t, err)
+		return head
+	}
+
+	require.Equal(t, report, string(formatPushRejection(parse("report-status"), rejection)))
+	require.Equal(t, report, string(formatPushRejection(parse("report-status-v2"), rejection)))
+
+	expected := pktLine("\x02first line\n") + pktLine("\x02second line\n") + pktLine("\x01"+report) + "0000"
+	require.Equal(t, expected, string(formatPushRejection(parse("report-status side-band-64k"), rejection)))
+
+	// Without report-status only the message is left
+	expected = pktLine("\x02first line\n") + pktLine("\x02second line\n") + "0000"
+	require.Equal(t, expected, string(formatPushRejection(parse("side-band"), rejection)))
+}
+
+func TestWriteSidebandSplitsLargeData(t *testing.T) {
+	var out bytes.Buffer
+	writeSideband(&out, sidebandData, bytes.Repeat([]byte("x"), 2500), 1000-5)
+
+	expected := pktLine("\x01"+strings.Repeat("x", 995)) + pktLine("\x01"+strings.Repeat("x", 995)) + pktLine("\x01"+strings.Repeat("x", 510))
+	require.Equal(t, expected, out.String())
+}
+
+func TestPktLineTracker(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		writes     []string
+		atBoundary bool
+	}{
+		{desc: "nothing written", atBoundary: true},
+		{desc: "complete packets", writes: []string{pktLine("\x02progress\n") + "0000"}, atBoundary: true},
+		{desc: "split packets", writes: []string{"00", "0e\x02prog", "ress\n", "00", "00"}, atBoundary: true},
+		{desc: "partial prefix", writes: []string{pktLine("abc") + "00"}},
+		{desc: "partial payload", writes: []string{"000dabc"}},
+		{desc: "not pkt-lines", writes: []string{"PACK"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			tracker := &pktLineTracker{w: &out}
+			for _, w := range tc.writes {
+				tracker.Write([]byte(w))
+			}
+
+			require.Equal(t, tc.atBoundary, tracker.atBoundary())
+			require.Equal(t, strings.Join(tc.writes, ""), out.String())
+		})
+	}
+}
+
+func TestReceivePackDrainsLimitedBody(t *testing.T) {
+	body := strings.NewReader(receivePackRequest("report-status", "PACK"+strings.Repeat("x", 2*maxDrainBytes)))
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+
+	rr := httptest.NewRecorder()
+	require.NoError(t, handleReceivePack(NewHttpResponseWriter(rr), req, &api.Response{GL_ID: GL_ID, MaxPushSize: 500}, nil))
+	require.NotEqual(t, 0, body.Len(), "the rest of the body must not be read")
+	require.Equal(t, "close", rr.Header().Get("Connection"))
+	require.Contains(t, rr.Body.String(), "push too large")
+}
+
+func TestReceivePackRejectsLargeContentLength(t *testing.T) {
+	body := strings.NewReader(receivePackRequest("report-status", "PACK"+strings.Repeat("x", 1000)))
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", body)
+
+	rr := httptest.NewRecorder()
+	require.NoError(t, handleReceivePack(NewHttpResponseWriter(rr), req, &api.Response{GL_ID: GL_ID, MaxPushSize: 500}, nil))
+	require.Equal(t, 0, body.Len(), "the request body must be drained")
+	require.Empty(t, rr.Header().Get("Connection"))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/x-git-receive-pack-result", rr.Header().Get("Content-Type"))
+
+	expected := pktLine("unpack push too large\n") +
+		pktLine("ng refs/heads/master push too large\n") +
+		pktLine("ng refs/heads/feature push too large\n") +
+		"0000"
+	require.Equal(t, expected, rr.Body.String())
+}
+
+func TestReceivePackLimitsHeadOfLargeContentLength(t *testing.T) {
+	commands := []string{pktLine(zeroID + " " + oid1 + " refs/heads/master\x00report-status\n")}
+	for i := 1; i < 100; i++ {
+		commands = append(commands, pktLine(fmt.Sprintf("%s %s refs/heads/branch-%d\n", oid1, oid2, i)))
+	}
+	body := strings.Join(commands, "") + "0000PACK"
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", strings.NewReader(body))
+
+	rr := httptest.NewRecorder()
+	require.NoError(t, handleReceivePack(NewHttpResponseWriter(rr), req, &api.Response{GL_ID: GL_ID, MaxPushSize: 1000}, nil))
+
+	// Only the commands within the limit are read and rejected
+	rejected := strings.Count(rr.Body.String(), "push too large\n") - 1
+	require.True(t, rejected > 0 && rejected < 100, "rejected %d commands", rejected)
+}
@@ -1,6 +1,8 @@
 package git
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -9,35 +11,95 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response, inspector *PushInspector) error {
 	action := getService(r)
 	writePostRPCHeader(w, action)
 
-	cr, cw := helper.NewWriteAfterReader(r.Body, w)
+	body := &requestLimitReader{r: r.Body, limit: a.MaxPushSize}
+	br := bufio.NewReader(body)
+
+	if a.MaxPushSize > 0 && r.ContentLength > a.MaxPushSize {
+		// Read nothing but the ref updates, which we need to reject each
+		// of them in a way the client understands
+		_, head, _ := readReceivePackHead(br)
+		drainBody(w, r)
+		return rejectPush(w, r, head, pushTooLarge(a.MaxPushSize))
+	}
+
+	raw, head, err := readReceivePackHead(br)
+	if body.tooLarge() {
+		drainBody(w, r)
+		return rejectPush(w, r, head, pushTooLarge(a.MaxPushSize))
+	}
+	if err != nil {
+		// Leave it to receive-pack to reject malformed requests
+		log.WithError(r.Context(), err).Warning("handleReceivePack: read commands")
+	}
+
+	var pack io.Reader = br
+	var inspected *inspectedPack
+	if inspector != nil && err == nil && len(head.commands) > 0 {
+		if head.hasCapability("push-options") {
+			var options []byte
+			options, err = readPushOptions(br)
+			raw = append(raw, options...)
+		}
+		if err == nil {
+			inspected = inspector.start(r.Context(), br, a.MaxBlobSize)
+		}
+		if inspected != nil {
+			pack = inspected
+		}
+	}
+
+	cr, cw := helper.NewWriteAfterReader(io.MultiReader(bytes.NewReader(raw), pack), w)
 	defer cw.Flush()
+	response := &pktLineTracker{w: cw}
 
-	var err error
 	if a.GitalyServer.Address == "" {
-		err = handleReceivePackLocally(a, r, cr, cw, action)
+		err = handleReceivePackLocally(a, r, cr, response, action)
 	} else {
 		gitProtocol := r.Header.Get("Git-Protocol")
 
-		err = handleReceivePackWithGitaly(r.Context(), a, cr, cw, gitProtocol)
+		err = handleReceivePackWithGitaly(r.Context(), a, cr, response, gitProtocol)
+	}
+
+	if body.tooLarge() && response.atBoundary() {
+		return rejectPush(response, r, head, pushTooLarge(a.MaxPushSize))
+	}
+	if inspected != nil && inspected.rejected() != nil && response.atBoundary() {
+		drainBody(w, r)
+		return rejectPush(response, r, head, inspected.rejected())
 	}
 
 	return err
 }
 
+func pushTooLarge(limit int64) *pushRejection {
+	return &pushRejection{
+		reason:  rejectPushTooLarge,
+		status:  "push too large",
+		message: fmt.Sprintf("Your push is larger than the limit of %d bytes for this project.", limit),
+	}
+}
+
 func handleReceivePackLocally(a *api.Response, r *http.Request, stdin io.Reader, stdout io.Writer, action string) error {
-	cmd, err := startGitCommand(a, stdin, stdout, action)
+	// Stop git as soon as reading the request fails so that it does not
+	// unpack a truncated push
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	cmd, err := startGitCommand(a, &cancelOnErrorReader{Reader: stdin, cancel: cancel}, stdout, action)
 	if err != nil {
 		return fmt.Errorf("startGitCommand: %v", err)
 	}
 	defer helper.CleanUpProcessGroup(cmd)
+	defer terminateOnCancel(ctx, cmd)()
 
 	if err := cmd.Wait(); err != nil {
 		helper.LogError(r, fmt.Errorf("wait for %v: %v", cmd.Args, err))
@@ -48,6 +110,22 @@ func handleReceivePackLocally(a *api.Response, r *http.Request, stdin io.Reader,
 	return nil
 }
 
+// cancelOnErrorReader calls cancel when reading fails with an error other
+// than io.EOF
+type cancelOnErrorReader struct {
+	io.Reader
+	cancel func()
+}
+
+func (c *cancelOnErrorReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		c.cancel()
+	}
+
+	return n, err
+}
+
 func handleReceivePackWithGitaly(ctx context.Context, a *api.Response, clientRequest io.Reader, clientResponse io.Writer, gitProtocol string) error {
 	smarthttp, err := gitaly.NewSmartHTTPClient(a.GitalyServer)
 	if err != nil {
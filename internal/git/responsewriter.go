@@ -23,17 +23,17 @@ var (
 	gitHTTPRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gitlab_workhorse_git_http_requests",
-			Help: "How many Git HTTP requests have been processed by gitlab-workhorse, partitioned by request type and agent.",
+			Help: "How many Git HTTP requests have been processed by gitlab-workhorse, partitioned by request type, agent and protocol v2 command.",
 		},
-		[]string{"method", "code", "service", "agent"},
+		[]string{"method", "code", "service", "agent", "command"},
 	)
 
 	gitHTTPBytes = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gitlab_workhorse_git_http_bytes",
-			Help: "How many Git HTTP bytes have been sent by gitlab-workhorse, partitioned by request type, agent and direction.",
+			Help: "How many Git HTTP bytes have been sent by gitlab-workhorse, partitioned by request type, agent, protocol v2 command and direction.",
 		},
-		[]string{"method", "code", "service", "agent", "direction"},
+		[]string{"method", "code", "service", "agent", "command", "direction"},
 	)
 )
 
@@ -45,6 +45,9 @@ func init() {
 
 type HttpResponseWriter struct {
 	helper.CountingResponseWriter
+
+	// command is the protocol v2 command of the request, if any
+	command string
 }
 
 func NewHttpResponseWriter(rw http.ResponseWriter) *HttpResponseWriter {
@@ -59,10 +62,10 @@ func (w *HttpResponseWriter) Log(r *http.Request, writtenIn int64) {
 	agent := getRequestAgent(r)
 
 	gitHTTPSessionsActive.Dec()
-	gitHTTPRequests.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent).Inc()
-	gitHTTPBytes.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, directionIn).
+	gitHTTPRequests.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, w.command).Inc()
+	gitHTTPBytes.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, w.command, directionIn).
 		Add(float64(writtenIn))
-	gitHTTPBytes.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, directionOut).
+	gitHTTPBytes.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, w.command, directionOut).
 		Add(float64(w.Count()))
 }
 
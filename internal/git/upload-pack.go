@@ -1,35 +1,188 @@
 package git
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
+// uploadPack handles git-upload-pack requests. The request body is
+// streamed to upload-pack; only the head of the negotiation is kept in memory.
+type uploadPack struct {
+	policies *ClonePolicies
+	cache    *UploadPackCache
+	// requestLimit is the maximum request body size, 0 means unlimited
+	requestLimit int64
+}
+
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func (u *uploadPack) handle(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
 	// The body will consist almost entirely of 'have XXX' and 'want XXX'
-	// lines; these are about 50 bytes long. With a limit of 10MB the client
-	// can send over 200,000 have/want lines.
-	buffer, err := helper.ReadAllTempfile(io.LimitReader(r.Body, 10*1024*1024))
+	// lines; these are about 50 bytes long. With the default requestLimit
+	// of 10MB the client can send over 200,000 have/want lines. Only the
+	// head of the body, at most maxNegotiationHead bytes, is kept in
+	// memory; the rest is streamed.
+	body := &requestLimitReader{r: r.Body, limit: u.requestLimit}
+	defer r.Body.Close()
+
+	action := getService(r)
+	tooLarge := func() error {
+		helper.SetAccessLogField(r.Context(), "gitRequestTooLarge", true)
+		return writeErrorPktLine(w, action, fmt.Sprintf("upload-pack request is larger than %d bytes", u.requestLimit))
+	}
+
+	// Wants, depth and filter come before the haves, so the head of the
+	// request is enough to apply clone policies. Clones have no haves at
+	// all and are read completely, which the cache needs for its key.
+	n := &negotiation{}
+	br := bufio.NewReader(body)
+	head, complete, err := readNegotiationHead(br, n)
+	if body.tooLarge() {
+		return tooLarge()
+	}
 	if err != nil {
-		return fmt.Errorf("ReadAllTempfile: %v", err)
+		// Leave it to upload-pack to reject malformed requests
+		log.WithError(r.Context(), err).Warning("handleUploadPack: read negotiation")
 	}
-	defer buffer.Close()
-	r.Body.Close()
 
-	action := getService(r)
+	gitProtocol := r.Header.Get("Git-Protocol")
+	if isProtocolV2(gitProtocol) {
+		helper.SetAccessLogField(r.Context(), "gitProtocol", "v2")
+
+		command, err := scanV2Command(bytes.NewReader(head))
+		if err != nil {
+			command = v2CommandUnknown
+		}
+		w.command = command
+		helper.SetAccessLogField(r.Context(), "gitCommand", command)
+
+		if limit, ok := v2CommandRequestLimits[command]; ok && int64(len(head)) > limit {
+			helper.SetAccessLogField(r.Context(), "gitRequestTooLarge", true)
+			return writeErrorPktLine(w, action, fmt.Sprintf("%s request is larger than %d bytes", command, limit))
+		}
+	}
+
+	if w.command == v2CommandBundleURI {
+		if bundles := advertisedBundles(a); len(bundles) > 0 {
+			writePostRPCHeader(w, action)
+			return writeBundleList(w, bundles)
+		}
+	}
+
+	counter := &negotiationCounter{n: n}
+	if w.command == "" || w.command == v2CommandFetch {
+		defer func() { recordNegotiation(r, counter) }()
+
+		release, err := u.policies.admit(a, n)
+		defer release()
+		if policyErr, ok := err.(*clonePolicyError); ok {
+			clonePolicyRejections.WithLabelValues(policyErr.reason).Inc()
+			helper.SetAccessLogField(r.Context(), "clonePolicyRejection", policyErr.reason)
+			return writeErrorPktLine(w, action, policyErr.message)
+		}
+
+		if u.cache != nil && complete && n.cacheable() {
+			writePostRPCHeader(w, action)
+			return handleUploadPackWithCache(r, a, head, w, gitProtocol, u.cache)
+		}
+	}
+
+	// upload-pack gets the head we already read followed by the rest of the
+	// body, which is counted on its way through
+	request := io.MultiReader(bytes.NewReader(head), io.TeeReader(br, counter))
+
 	writePostRPCHeader(w, action)
 
-	gitProtocol := r.Header.Get("Git-Protocol")
+	// net/http closes the request body once the response is flushed, so
+	// the response is held back until the request has been read
+	cr, cw := helper.NewWriteAfterReader(request, w)
+	err = handleUploadPackRPC(r.Context(), a, cr, cw, gitProtocol)
+	if body.tooLarge() && w.Count() == 0 {
+		// Whatever upload-pack answered to the truncated request is dropped
+		return tooLarge()
+	}
+
+	if flushErr := cw.Flush(); err == nil && flushErr != nil {
+		err = fmt.Errorf("handleUploadPack: %v", flushErr)
+	}
 
-	return handleUploadPackWithGitaly(r.Context(), a, buffer, w, gitProtocol)
+	return err
+}
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// requestLimitReader reads at most limit bytes from r. Unlike
+// io.LimitReader it fails when r holds more than that, so that a request
+// is never passed on truncated.
+type requestLimitReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded int32
+}
+
+func (l *requestLimitReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if l.tooLarge() {
+		return 0, errRequestTooLarge
+	}
+
+	// Read one byte more than allowed to tell an exact fit from an
+	// oversized body
+	if max := l.limit - l.read + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		atomic.StoreInt32(&l.exceeded, 1)
+		return n - int(l.read-l.limit), errRequestTooLarge
+	}
+
+	return n, err
+}
+
+func (l *requestLimitReader) tooLarge() bool {
+	return atomic.LoadInt32(&l.exceeded) == 1
+}
+
+// handleUploadPackRPC runs upload-pack on Gitaly or, if no Gitaly server
+// is configured, on the repository at a.RepoPath
+func handleUploadPackRPC(ctx context.Context, a *api.Response, clientRequest io.Reader, clientResponse io.Writer, gitProtocol string) error {
+	if a.GitalyServer.Address == "" {
+		return handleUploadPackLocally(ctx, a, clientRequest, clientResponse, gitProtocol)
+	}
+
+	return handleUploadPackWithGitaly(ctx, a, clientRequest, clientResponse, gitProtocol)
+}
+
+func handleUploadPackLocally(ctx context.Context, a *api.Response, clientRequest io.Reader, clientResponse io.Writer, gitProtocol string) error {
+	cmd, err := startGitRPCCommand(a, clientRequest, clientResponse, "git-upload-pack", gitConfigOptions(a), gitProtocol)
+	if err != nil {
+		return fmt.Errorf("startGitRPCCommand: %v", err)
+	}
+	defer helper.CleanUpProcessGroup(cmd)
+	defer terminateOnCancel(ctx, cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("wait for %v: %v", cmd.Args, err)
+	}
+
+	return nil
 }
 
 func handleUploadPackWithGitaly(ctx context.Context, a *api.Response, clientRequest io.Reader, clientResponse io.Writer, gitProtocol string) error {
@@ -44,3 +197,29 @@ func handleUploadPackWithGitaly(ctx context.Context, a *api.Response, clientRequ
 
 	return nil
 }
+
+func handleUploadPackWithCache(r *http.Request, a *api.Response, request []byte, w io.Writer, gitProtocol string, cache *UploadPackCache) error {
+	repo := repositoryKey(a)
+	key, err := uploadPackCacheKey(repo, gitProtocol, gitConfigOptions(a), request)
+	if err != nil {
+		return err
+	}
+
+	return cache.serve(r.Context(), w, key, repo, func(ctx context.Context, fill io.Writer) error {
+		return handleUploadPackRPC(ctx, a, bytes.NewReader(request), fill, gitProtocol)
+	})
+}
+
+// recordNegotiation exports statistics about the negotiation counted by
+// counter
+func recordNegotiation(r *http.Request, counter *negotiationCounter) {
+	n, err := counter.result()
+	if err != nil {
+		log.WithError(r.Context(), err).Warning("handleUploadPack: parse negotiation")
+	}
+
+	n.observe()
+	for key, value := range n.logFields() {
+		helper.SetAccessLogField(r.Context(), key, value)
+	}
+}
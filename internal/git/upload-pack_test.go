@@ -0,0 +1,116 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestRequestLimitReader(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		limit    int64
+		input    string
+		tooLarge bool
+	}{
+		{desc: "unlimited", limit: 0, input: "0123456789"},
+		{desc: "below limit", limit: 20, input: "0123456789"},
+		{desc: "exact fit", limit: 10, input: "0123456789"},
+		{desc: "too large", limit: 9, input: "0123456789", tooLarge: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			l := &requestLimitReader{r: strings.NewReader(tc.input), limit: tc.limit}
+			data, err := ioutil.ReadAll(l)
+
+			require.Equal(t, tc.tooLarge, l.tooLarge())
+			if tc.tooLarge {
+				require.Equal(t, errRequestTooLarge, err)
+				require.Equal(t, tc.input[:tc.limit], string(data))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.input, string(data))
+		})
+	}
+}
+
+func TestUploadPackRequestLimit(t *testing.T) {
+	body := pktLine("want "+oid1+" thin-pack\n") + pktLine("want "+oid2+"\n") + "0000" + pktLine("done\n")
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", bytes.NewReader([]byte(body)))
+
+	rr := httptest.NewRecorder()
+	u := &uploadPack{requestLimit: 64}
+	require.NoError(t, u.handle(NewHttpResponseWriter(rr), req, &api.Response{}))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/x-git-upload-pack-result", rr.Header().Get("Content-Type"))
+	require.Equal(t, pktLine("ERR upload-pack request is larger than 64 bytes\n"), rr.Body.String())
+}
+
+func TestUploadPackLargeNegotiation(t *testing.T) {
+	repo, err := ioutil.TempDir("", "upload-pack")
+	require.NoError(t, err)
+	defer os.RemoveAll(repo)
+
+	// A history long enough that the acknowledgements of its commits fill
+	// the response buffer of net/http
+	var stream bytes.Buffer
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&stream, "commit refs/heads/master\nmark :%d\ncommitter Test <test@example.com> %d +0000\ndata 8\ncommit %d\n", i, 1500000000+i, i%10)
+		if i > 1 {
+			fmt.Fprintf(&stream, "from :%d\n", i-1)
+		}
+	}
+	out, err := exec.Command("git", "init", "-q", "--bare", repo).CombinedOutput()
+	require.NoError(t, err, "git init: %s", out)
+	cmd := exec.Command("git", "-C", repo, "fast-import", "--quiet")
+	cmd.Stdin = &stream
+	out, err = cmd.CombinedOutput()
+	require.NoError(t, err, "git fast-import: %s", out)
+
+	out, err = exec.Command("git", "-C", repo, "rev-list", "master").Output()
+	require.NoError(t, err)
+	commits := strings.Fields(string(out))
+
+	// upload-pack acknowledges common commits while it reads the haves,
+	// long before the request has been read
+	var body bytes.Buffer
+	body.WriteString(pktLine("want " + commits[0] + " multi_ack_detailed side-band-64k\n"))
+	body.WriteString("0000")
+	for _, commit := range commits {
+		body.WriteString(pktLine("have " + commit + "\n"))
+	}
+	for i := 0; i < 20000; i++ {
+		body.WriteString(pktLine(fmt.Sprintf("have %040x\n", i+1)))
+	}
+	body.WriteString(pktLine("done\n"))
+
+	handlerErr := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := &uploadPack{}
+		handlerErr <- u.handle(NewHttpResponseWriter(w), r, &api.Response{RepoPath: repo})
+	}))
+	defer ts.Close()
+
+	// Large requests of git are chunked
+	resp, err := http.Post(ts.URL, "application/x-git-upload-pack-request", ioutil.NopCloser(&body))
+	require.NoError(t, err)
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	require.NoError(t, <-handlerErr)
+	require.Contains(t, string(response), "ACK "+commits[len(commits)-1]+" common")
+	require.Contains(t, string(response), "PACK")
+}
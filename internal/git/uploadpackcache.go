@@ -0,0 +1,409 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	uploadPackCacheHit       = "hit"
+	uploadPackCacheMiss      = "miss"
+	uploadPackCacheCoalesced = "coalesced"
+
+	defaultUploadPackCacheMaxBytes = 10 * 1024 * 1024 * 1024
+	defaultUploadPackCacheMaxAge   = 10 * time.Minute
+
+	// uploadPackCacheFillPrefix starts the names of the files in the cache
+	uploadPackCacheFillPrefix = "fill"
+
+	// uploadPackCacheNotificationPrefix starts the keys of keywatcher
+	// notifications about pushes
+	uploadPackCacheNotificationPrefix = "workhorse:upload_pack_cache:"
+)
+
+var (
+	uploadPackCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache_requests",
+			Help: "How many cacheable upload-pack requests have been served, partitioned by cache result (hit, miss, coalesced).",
+		},
+		[]string{"result"},
+	)
+
+	uploadPackCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache_bytes",
+			Help: "Total size of the upload-pack responses in the cache.",
+		},
+	)
+
+	uploadPackCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache_evictions",
+			Help: "How many upload-pack responses have been removed from the cache, partitioned by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackCacheRequests)
+	prometheus.MustRegister(uploadPackCacheBytes)
+	prometheus.MustRegister(uploadPackCacheEvictions)
+}
+
+var (
+	uploadPackCachesMutex  sync.Mutex
+	uploadPackCaches       []*UploadPackCache
+	uploadPackCacheListens sync.Once
+)
+
+// UploadPackCache keeps upload-pack responses on disk so that identical
+// clones, e.g. of the same commit by many CI jobs, only make Gitaly build
+// the pack once. A miss is generated once and streamed to every client
+// asking for it while it is being generated. A nil *UploadPackCache
+// caches nothing.
+type UploadPackCache struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mutex      sync.Mutex
+	entries    map[string]*uploadPackCacheEntry
+	lru        *list.List
+	totalBytes int64
+	fills      map[string]*uploadPackCacheFill
+}
+
+type uploadPackCacheEntry struct {
+	key     string
+	repo    string
+	path    string
+	size    int64
+	created time.Time
+	element *list.Element
+}
+
+// NewUploadPackCache creates the cache directory in cfg.Dir and starts
+// listening for pushes on other workhorse processes through the Redis
+// keywatcher channel. Responses left behind by an earlier process are
+// not known to the LRU index; they are removed once they are older than
+// MaxAge, when no process serves them any more.
+func NewUploadPackCache(cfg *config.UploadPackCacheConfig) (*UploadPackCache, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("NewUploadPackCache: Dir is not set")
+	}
+
+	c := &UploadPackCache{
+		dir:      filepath.Join(cfg.Dir, "upload-pack"),
+		maxBytes: cfg.MaxBytes,
+		maxAge:   defaultUploadPackCacheMaxAge,
+		entries:  make(map[string]*uploadPackCacheEntry),
+		lru:      list.New(),
+		fills:    make(map[string]*uploadPackCacheFill),
+	}
+	if c.maxBytes == 0 {
+		c.maxBytes = defaultUploadPackCacheMaxBytes
+	}
+	if cfg.MaxAge != nil {
+		c.maxAge = cfg.MaxAge.Duration
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("NewUploadPackCache: %v", err)
+	}
+	if err := removeOrphanedFills(c.dir, c.maxAge); err != nil {
+		return nil, fmt.Errorf("NewUploadPackCache: %v", err)
+	}
+
+	uploadPackCachesMutex.Lock()
+	uploadPackCaches = append(uploadPackCaches, c)
+	uploadPackCachesMutex.Unlock()
+	uploadPackCacheListens.Do(func() {
+		redis.ListenKeys(uploadPackCacheNotificationPrefix, handleUploadPackCacheNotification)
+	})
+
+	return c, nil
+}
+
+// removeOrphanedFills removes the responses in dir that have not been
+// written to for maxAge. During a restart the previous process may still
+// be serving the newer ones.
+func removeOrphanedFills(dir string, maxAge time.Duration) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), uploadPackCacheFillPrefix) || time.Since(info.ModTime()) <= maxAge {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheable tells whether the response to n only depends on the state of
+// the repository. Negotiations with 'have' lines are specific to the
+// client, and without 'done' the response is just an ACK/NAK round.
+func (n *negotiation) cacheable() bool {
+	return n.wants > 0 && n.haves == 0 && n.done
+}
+
+// uploadPackCacheKey hashes the repository, the options that change the
+// response and the normalized request. Lines are sorted so that the order
+// of wants or capabilities does not matter; agent strings are dropped
+// because they differ between client versions without changing the pack.
+func uploadPackCacheKey(repo string, gitProtocol string, options []string, request []byte) (string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(request))
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\n")
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "want" && len(fields) > 2 {
+			lines = append(lines, "want "+fields[1])
+			fields = fields[2:]
+		} else {
+			fields = []string{line}
+		}
+
+		for _, f := range fields {
+			if !strings.HasPrefix(f, "agent=") && !strings.HasPrefix(f, "session-id=") {
+				lines = append(lines, f)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("uploadPackCacheKey: %v", err)
+	}
+
+	sort.Strings(lines)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00%s\x00", repo, isProtocolV2(gitProtocol), strings.Join(options, "\x00"))
+	io.WriteString(h, strings.Join(lines, "\n"))
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serve writes the response for key to w. On a miss, generate is called
+// once with a writer that stores the response; concurrent requests for
+// the same key are streamed the response while it is written.
+func (c *UploadPackCache) serve(ctx context.Context, w io.Writer, key string, repo string, generate func(context.Context, io.Writer) error) error {
+	c.mutex.Lock()
+
+	if entry := c.lookup(key); entry != nil {
+		file, err := os.Open(entry.path)
+		c.mutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("UploadPackCache: %v", err)
+		}
+		defer file.Close()
+
+		uploadPackCacheRequests.WithLabelValues(uploadPackCacheHit).Inc()
+		if _, err := io.Copy(w, file); err != nil {
+			return fmt.Errorf("UploadPackCache: copy cached response: %v", err)
+		}
+		return nil
+	}
+
+	result := uploadPackCacheCoalesced
+	fill, ok := c.fills[key]
+	if !ok {
+		var err error
+		if fill, err = c.startFill(key, repo, generate); err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+		result = uploadPackCacheMiss
+	}
+
+	reader, err := fill.follow()
+	c.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("UploadPackCache: %v", err)
+	}
+	defer fill.unfollow(reader)
+
+	uploadPackCacheRequests.WithLabelValues(result).Inc()
+	if err := fill.copyTo(ctx, w, reader); err != nil {
+		return fmt.Errorf("UploadPackCache: %v", err)
+	}
+	return nil
+}
+
+// lookup must be called with c.mutex held
+func (c *UploadPackCache) lookup(key string) *uploadPackCacheEntry {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Since(entry.created) > c.maxAge {
+		c.remove(entry, "expired")
+		return nil
+	}
+
+	c.lru.MoveToFront(entry.element)
+	return entry
+}
+
+// startFill must be called with c.mutex held
+func (c *UploadPackCache) startFill(key string, repo string, generate func(context.Context, io.Writer) error) (*uploadPackCacheFill, error) {
+	file, err := ioutil.TempFile(c.dir, uploadPackCacheFillPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("UploadPackCache: create fill: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fill := &uploadPackCacheFill{
+		cacheFill: newCacheFill(file, cancel),
+		key:       key,
+		repo:      repo,
+	}
+	c.fills[key] = fill
+
+	go func() {
+		err := generate(ctx, fill)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		cancel()
+		c.finishFill(fill, err)
+	}()
+
+	return fill, nil
+}
+
+func (c *UploadPackCache) finishFill(fill *uploadPackCacheFill, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.fills, fill.key)
+	size := fill.finish(err)
+
+	if err != nil || fill.stale || size > c.maxBytes {
+		if err != nil {
+			log.WithFields(context.Background(), log.Fields{"repository": fill.repo}).WithError(err).Warning("UploadPackCache: fill failed")
+		}
+		os.Remove(fill.file.Name())
+		return
+	}
+
+	entry := &uploadPackCacheEntry{
+		key:     fill.key,
+		repo:    fill.repo,
+		path:    fill.file.Name(),
+		size:    size,
+		created: time.Now(),
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[entry.key] = entry
+	c.totalBytes += size
+
+	for c.totalBytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*uploadPackCacheEntry), "size")
+	}
+	uploadPackCacheBytes.Set(float64(c.totalBytes))
+}
+
+// remove must be called with c.mutex held. Clients still reading the file
+// keep their open file descriptor.
+func (c *UploadPackCache) remove(entry *uploadPackCacheEntry, reason string) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.totalBytes -= entry.size
+	uploadPackCacheBytes.Set(float64(c.totalBytes))
+	uploadPackCacheEvictions.WithLabelValues(reason).Inc()
+
+	if err := os.Remove(entry.path); err != nil {
+		log.WithFields(context.Background(), log.Fields{"path": entry.path}).WithError(err).Warning("UploadPackCache: remove")
+	}
+}
+
+// Invalidate drops the cached responses of repo, e.g. after a push, here
+// and on all other workhorse processes listening on Redis. Fills in
+// progress for repo are served but not kept.
+func (c *UploadPackCache) Invalidate(repo string) {
+	if c == nil {
+		return
+	}
+
+	c.invalidate(repo)
+
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := redis.Publish(uploadPackCacheNotificationPrefix+repo, value); err != nil {
+		log.WithFields(context.Background(), log.Fields{"repository": repo}).WithError(err).Warning("UploadPackCache: publish invalidation")
+	}
+}
+
+func handleUploadPackCacheNotification(key, value string) {
+	uploadPackCachesMutex.Lock()
+	caches := uploadPackCaches
+	uploadPackCachesMutex.Unlock()
+
+	for _, c := range caches {
+		c.invalidate(strings.TrimPrefix(key, uploadPackCacheNotificationPrefix))
+	}
+}
+
+func (c *UploadPackCache) invalidate(repo string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.repo == repo {
+			c.remove(entry, "invalidated")
+		}
+	}
+
+	for _, fill := range c.fills {
+		if fill.repo == repo {
+			fill.stale = true
+		}
+	}
+}
+
+// uploadPackCacheFill is a response being written to the cache
+type uploadPackCacheFill struct {
+	*cacheFill
+	key  string
+	repo string
+	// stale is protected by UploadPackCache.mutex
+	stale bool
+}
@@ -0,0 +1,267 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func newTestUploadPackCache(t *testing.T, maxBytes int64) (*UploadPackCache, func()) {
+	dir, err := ioutil.TempDir("", "upload-pack-cache")
+	require.NoError(t, err)
+
+	cache, err := NewUploadPackCache(&config.UploadPackCacheConfig{Dir: dir, MaxBytes: maxBytes})
+	require.NoError(t, err)
+
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func (c *UploadPackCache) cached(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func staticResponse(response string, calls *int32) func(context.Context, io.Writer) error {
+	return func(_ context.Context, w io.Writer) error {
+		atomic.AddInt32(calls, 1)
+		_, err := io.WriteString(w, response)
+		return err
+	}
+}
+
+func TestUploadPackCacheKey(t *testing.T) {
+	request := pktLine("want "+oid1+" thin-pack ofs-delta agent=git/2.20.1\n") + pktLine("want "+oid2+"\n") + "0000" + pktLine("done\n")
+	reordered := pktLine("want "+oid2+" ofs-delta thin-pack agent=git/2.21.0\n") + pktLine("want "+oid1+"\n") + "0000" + pktLine("done\n")
+	other := pktLine("want "+oid1+" thin-pack\n") + "0000" + pktLine("done\n")
+
+	key := func(repo string, request string) string {
+		k, err := uploadPackCacheKey(repo, "", nil, []byte(request))
+		require.NoError(t, err)
+		return k
+	}
+
+	require.Equal(t, key("repo", request), key("repo", reordered))
+	require.NotEqual(t, key("repo", request), key("repo", other))
+	require.NotEqual(t, key("repo", request), key("other-repo", request))
+
+	v2, err := uploadPackCacheKey("repo", "version=2", nil, []byte(request))
+	require.NoError(t, err)
+	require.NotEqual(t, key("repo", request), v2)
+
+	allRefs, err := uploadPackCacheKey("repo", "", []string{GitConfigShowAllRefs}, []byte(request))
+	require.NoError(t, err)
+	require.NotEqual(t, key("repo", request), allRefs)
+}
+
+func TestUploadPackCacheHit(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var response bytes.Buffer
+		require.NoError(t, cache.serve(context.Background(), &response, "key", "repo", staticResponse("PACK", &calls)))
+		require.Equal(t, "PACK", response.String())
+	}
+
+	require.Equal(t, int32(1), calls)
+}
+
+func TestUploadPackCacheCoalescesMisses(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024*1024)
+	defer cleanup()
+
+	var calls int32
+	proceed := make(chan struct{})
+	generate := func(_ context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, "first half ")
+		<-proceed
+		_, err := io.WriteString(w, "second half")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]bytes.Buffer, 5)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, cache.serve(context.Background(), &responses[i], "key", "repo", generate))
+		}(i)
+	}
+
+	// Wait until all clients follow the fill
+	followers := func() int {
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		fill := cache.fills["key"]
+		if fill == nil {
+			return 0
+		}
+		fill.mutex.Lock()
+		defer fill.mutex.Unlock()
+		return fill.followers
+	}
+	for deadline := time.Now().Add(5 * time.Second); followers() < len(responses); time.Sleep(time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "clients did not join the fill")
+	}
+
+	close(proceed)
+	wg.Wait()
+
+	require.Equal(t, int32(1), calls)
+	for i := range responses {
+		require.Equal(t, "first half second half", responses[i].String())
+	}
+}
+
+func TestUploadPackCacheEviction(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 10)
+	defer cleanup()
+
+	var calls int32
+	serve := func(key string) {
+		require.NoError(t, cache.serve(context.Background(), ioutil.Discard, key, "repo", staticResponse("12345", &calls)))
+	}
+
+	serve("a")
+	serve("b")
+	serve("a") // hit, "b" becomes least recently used
+	serve("c") // evicts "b"
+	require.Equal(t, int32(3), calls)
+
+	serve("a")
+	serve("c")
+	require.Equal(t, int32(3), calls)
+
+	serve("b")
+	require.Equal(t, int32(4), calls)
+	cache.mutex.Lock()
+	require.Equal(t, int64(10), cache.totalBytes)
+	cache.mutex.Unlock()
+
+	// Responses larger than the cache are served but not kept
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "big", "repo", staticResponse("0123456789abcdef", &calls)))
+	require.False(t, cache.cached("big"))
+}
+
+func TestUploadPackCacheInvalidate(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+
+	var calls int32
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key1", "repo1", staticResponse("PACK", &calls)))
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key2", "repo2", staticResponse("PACK", &calls)))
+
+	cache.Invalidate("repo1")
+
+	require.False(t, cache.cached("key1"))
+	require.True(t, cache.cached("key2"))
+
+	var nilCache *UploadPackCache
+	nilCache.Invalidate("repo1")
+}
+
+func TestUploadPackCacheInvalidateFromNotification(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+
+	var calls int32
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key1", "repo1", staticResponse("PACK", &calls)))
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key2", "repo2", staticResponse("PACK", &calls)))
+
+	handleUploadPackCacheNotification(uploadPackCacheNotificationPrefix+"repo1", "1")
+
+	require.False(t, cache.cached("key1"))
+	require.True(t, cache.cached("key2"))
+}
+
+func TestUploadPackCacheRemovesOrphanedFills(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-pack-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "upload-pack")
+	require.NoError(t, os.MkdirAll(cacheDir, 0700))
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"fill-old", "fill-recent", "other"} {
+		path := filepath.Join(cacheDir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte("PACK"), 0600))
+		if name != "fill-recent" {
+			require.NoError(t, os.Chtimes(path, old, old))
+		}
+	}
+
+	_, err = NewUploadPackCache(&config.UploadPackCacheConfig{Dir: dir})
+	require.NoError(t, err)
+
+	requireFileExists(t, filepath.Join(cacheDir, "fill-old"), false)
+	requireFileExists(t, filepath.Join(cacheDir, "fill-recent"), true)
+	requireFileExists(t, filepath.Join(cacheDir, "other"), true)
+}
+
+func TestUploadPackCacheExpiry(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+	cache.maxAge = time.Millisecond
+
+	var calls int32
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key", "repo", staticResponse("PACK", &calls)))
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, cache.serve(context.Background(), ioutil.Discard, "key", "repo", staticResponse("PACK", &calls)))
+
+	require.Equal(t, int32(2), calls)
+}
+
+func TestUploadPackCacheFillError(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+
+	generate := func(_ context.Context, w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("gitaly went away")
+	}
+
+	var response bytes.Buffer
+	err := cache.serve(context.Background(), &response, "key", "repo", generate)
+	require.Error(t, err)
+	require.Equal(t, "partial", response.String())
+	require.False(t, cache.cached("key"))
+}
+
+func TestUploadPackCacheCancelsAbandonedFill(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024)
+	defer cleanup()
+
+	cancelled := make(chan struct{})
+	generate := func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, cache.serve(ctx, ioutil.Discard, "key", "repo", generate))
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fill was not cancelled")
+	}
+}
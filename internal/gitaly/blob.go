@@ -8,21 +8,24 @@ import (
 	"strconv"
 
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
-	"gitlab.com/gitlab-org/gitaly/streamio"
 )
 
 type BlobClient struct {
 	pb.BlobServiceClient
+	metadata map[string]string
 }
 
 func (client *BlobClient) SendBlob(ctx context.Context, w http.ResponseWriter, request *pb.GetBlobRequest) error {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "GetBlob", 0, currentTimeouts().streamIdle, 0)
+	defer deadline.stop()
+
 	c, err := client.GetBlob(ctx, request)
 	if err != nil {
-		return fmt.Errorf("rpc failed: %v", err)
+		return fmt.Errorf("rpc failed: %v", deadline.err(err))
 	}
 
 	firstResponseReceived := false
-	rr := streamio.NewReader(func() ([]byte, error) {
+	rr := deadline.reader(func() ([]byte, error) {
 		resp, err := c.Recv()
 
 		if !firstResponseReceived && err == nil {
@@ -0,0 +1,278 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/gitaly/streamio"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	timeoutFirstByte = "first_byte"
+	timeoutIdle      = "idle"
+	timeoutTotal     = "total"
+
+	defaultInfoRefsFirstByteTimeout = 30 * time.Second
+	defaultStreamIdleTimeout        = 5 * time.Minute
+)
+
+var (
+	rpcTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_rpc_timeouts",
+			Help: "How many Gitaly calls have been cancelled because Gitaly did not answer in time, partitioned by RPC and type (first_byte, idle, total).",
+		},
+		[]string{"rpc", "type"},
+	)
+
+	timeouts atomic.Value
+)
+
+func init() {
+	prometheus.MustRegister(rpcTimeouts)
+	timeouts.Store(newTimeoutSettings(nil))
+}
+
+type timeoutSettings struct {
+	infoRefsFirstByte time.Duration
+	streamIdle        time.Duration
+	archive           time.Duration
+}
+
+func newTimeoutSettings(cfg *config.GitalyConfig) timeoutSettings {
+	settings := timeoutSettings{
+		infoRefsFirstByte: defaultInfoRefsFirstByteTimeout,
+		streamIdle:        defaultStreamIdleTimeout,
+	}
+	if cfg == nil {
+		return settings
+	}
+
+	if cfg.InfoRefsFirstByteTimeout != nil {
+		settings.infoRefsFirstByte = cfg.InfoRefsFirstByteTimeout.Duration
+	}
+	if cfg.StreamIdleTimeout != nil {
+		settings.streamIdle = cfg.StreamIdleTimeout.Duration
+	}
+	if cfg.ArchiveTimeout != nil {
+		settings.archive = cfg.ArchiveTimeout.Duration
+	}
+
+	return settings
+}
+
+func currentTimeouts() timeoutSettings {
+	return timeouts.Load().(timeoutSettings)
+}
+
+// TimeoutError is returned by calls that were cancelled because Gitaly
+// did not answer in time
+type TimeoutError struct {
+	RPC     string
+	Type    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	switch e.Type {
+	case timeoutFirstByte:
+		return fmt.Sprintf("gitaly %s timeout: no response within %v", e.RPC, e.Timeout)
+	case timeoutIdle:
+		return fmt.Sprintf("gitaly %s timeout: no progress for %v", e.RPC, e.Timeout)
+	default:
+		return fmt.Sprintf("gitaly %s timeout: not finished within %v", e.RPC, e.Timeout)
+	}
+}
+
+// rpcDeadline cancels a streaming call when Gitaly does not answer in
+// time. Only time spent waiting for Gitaly counts: the first-byte and
+// idle timeouts run while a Recv is pending, and data sent to Gitaly
+// counts as progress. The total timeout runs from the start of the call.
+type rpcDeadline struct {
+	rpc       string
+	parent    context.Context
+	cancel    context.CancelFunc
+	firstByte time.Duration
+	idle      time.Duration
+
+	mutex      sync.Mutex
+	timer      *time.Timer
+	generation uint64
+	total      *time.Timer
+	receiving  bool
+	received   bool
+	expired    *TimeoutError
+}
+
+// withDeadline returns the context to make the call rpc with. A zero
+// timeout is not enforced; without a first-byte timeout the idle timeout
+// applies from the start.
+func withDeadline(ctx context.Context, rpc string, firstByte, idle, total time.Duration) (context.Context, *rpcDeadline) {
+	rpcCtx, cancel := context.WithCancel(ctx)
+	d := &rpcDeadline{
+		rpc:       rpc,
+		parent:    ctx,
+		cancel:    cancel,
+		firstByte: firstByte,
+		idle:      idle,
+	}
+
+	if total > 0 {
+		d.total = time.AfterFunc(total, func() { d.expire(timeoutTotal, total) })
+	}
+
+	return rpcCtx, d
+}
+
+// timeout must be called with d.mutex held
+func (d *rpcDeadline) timeout() (string, time.Duration) {
+	if !d.received && d.firstByte > 0 {
+		return timeoutFirstByte, d.firstByte
+	}
+
+	return timeoutIdle, d.idle
+}
+
+// arm must be called with d.mutex held
+func (d *rpcDeadline) arm() {
+	d.disarm()
+
+	_, timeout := d.timeout()
+	if timeout <= 0 {
+		return
+	}
+
+	generation := d.generation
+	d.timer = time.AfterFunc(timeout, func() { d.timerExpired(generation) })
+}
+
+// disarm must be called with d.mutex held. Timers that already fired are
+// ignored because their generation is outdated.
+func (d *rpcDeadline) disarm() {
+	d.generation++
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func (d *rpcDeadline) timerExpired(generation uint64) {
+	d.mutex.Lock()
+	if !d.receiving || generation != d.generation {
+		d.mutex.Unlock()
+		return
+	}
+	timeoutType, timeout := d.timeout()
+	d.mutex.Unlock()
+
+	d.expire(timeoutType, timeout)
+}
+
+func (d *rpcDeadline) expire(timeoutType string, timeout time.Duration) {
+	if d.parent.Err() != nil {
+		// The request is over, possibly without reading the whole stream
+		return
+	}
+
+	d.mutex.Lock()
+	if d.expired != nil {
+		d.mutex.Unlock()
+		return
+	}
+	d.expired = &TimeoutError{RPC: d.rpc, Type: timeoutType, Timeout: timeout}
+	d.mutex.Unlock()
+
+	rpcTimeouts.WithLabelValues(d.rpc, timeoutType).Inc()
+	helper.SetAccessLogField(d.parent, "gitalyTimeout", timeoutType)
+	d.cancel()
+}
+
+func (d *rpcDeadline) beginRecv() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.receiving = true
+	d.arm()
+}
+
+func (d *rpcDeadline) endRecv(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.receiving = false
+	d.disarm()
+	if err == nil {
+		d.received = true
+	}
+}
+
+// sent records progress of the request stream
+func (d *rpcDeadline) sent() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.receiving {
+		d.arm()
+	}
+}
+
+// err returns the TimeoutError in place of the error that the
+// cancellation caused
+func (d *rpcDeadline) err(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.expired != nil {
+		return d.expired
+	}
+	return err
+}
+
+// stop ends the call
+func (d *rpcDeadline) stop() {
+	d.mutex.Lock()
+	d.disarm()
+	if d.total != nil {
+		d.total.Stop()
+	}
+	d.mutex.Unlock()
+
+	d.cancel()
+}
+
+// reader returns a reader of the data that recv receives. The call is
+// stopped when recv fails or the stream ends.
+func (d *rpcDeadline) reader(recv func() ([]byte, error)) io.Reader {
+	return streamio.NewReader(func() ([]byte, error) {
+		d.beginRecv()
+		data, err := recv()
+		d.endRecv(err)
+
+		if err != nil {
+			d.stop()
+		}
+		return data, d.err(err)
+	})
+}
+
+// writer returns a writer that sends data with send
+func (d *rpcDeadline) writer(send func([]byte) error) io.Writer {
+	return streamio.NewWriter(func(data []byte) error {
+		err := send(data)
+		if err == nil {
+			d.sent()
+		}
+		return d.err(err)
+	})
+}
@@ -0,0 +1,161 @@
+package gitaly
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// fakeStream hands out the messages sent to it, and fails like a gRPC
+// stream once its context is cancelled
+type fakeStream struct {
+	ctx      context.Context
+	messages chan []byte
+}
+
+func (s *fakeStream) recv() ([]byte, error) {
+	select {
+	case data, ok := <-s.messages:
+		if !ok {
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func requireTimeout(t *testing.T, err error, timeoutType string) {
+	timeoutErr, ok := err.(*TimeoutError)
+	require.True(t, ok, "expected a TimeoutError, got %v", err)
+	require.Equal(t, timeoutType, timeoutErr.Type)
+}
+
+func TestDeadlineFirstByteTimeout(t *testing.T) {
+	ctx, deadline := withDeadline(context.Background(), "InfoRefsUploadPack", 10*time.Millisecond, time.Hour, 0)
+	stream := &fakeStream{ctx: ctx, messages: make(chan []byte)}
+
+	_, err := ioutil.ReadAll(deadline.reader(stream.recv))
+	requireTimeout(t, err, timeoutFirstByte)
+	require.Contains(t, err.Error(), "no response within 10ms")
+}
+
+func TestDeadlineIdleTimeout(t *testing.T) {
+	ctx, deadline := withDeadline(context.Background(), "GetBlob", time.Hour, 20*time.Millisecond, 0)
+	stream := &fakeStream{ctx: ctx, messages: make(chan []byte, 1)}
+	stream.messages <- []byte("first")
+
+	reader := deadline.reader(stream.recv)
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(reader, buf)
+	require.NoError(t, err)
+
+	// A slow client does not count against Gitaly
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(5 * time.Millisecond)
+			stream.messages <- []byte("more")
+		}
+	}()
+
+	_, err = ioutil.ReadAll(reader)
+	requireTimeout(t, err, timeoutIdle)
+}
+
+func TestDeadlineSendsAreProgress(t *testing.T) {
+	ctx, deadline := withDeadline(context.Background(), "PostReceivePack", 0, 30*time.Millisecond, 0)
+	stream := &fakeStream{ctx: ctx, messages: make(chan []byte)}
+
+	writer := deadline.writer(func([]byte) error { return nil })
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(10 * time.Millisecond)
+			writer.Write([]byte("pack data"))
+		}
+		stream.messages <- []byte("response")
+		close(stream.messages)
+	}()
+
+	data, err := ioutil.ReadAll(deadline.reader(stream.recv))
+	require.NoError(t, err)
+	require.Equal(t, "response", string(data))
+}
+
+func TestDeadlineTotalTimeout(t *testing.T) {
+	ctx, deadline := withDeadline(context.Background(), "GetArchive", 0, time.Hour, 30*time.Millisecond)
+	stream := &fakeStream{ctx: ctx, messages: make(chan []byte)}
+
+	go func() {
+		for {
+			select {
+			case stream.messages <- []byte("archive data"):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	_, err := ioutil.ReadAll(deadline.reader(stream.recv))
+	requireTimeout(t, err, timeoutTotal)
+}
+
+func TestDeadlineEndedRequest(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, deadline := withDeadline(parent, "GetSnapshot", 0, 10*time.Millisecond, 0)
+	stream := &fakeStream{ctx: ctx, messages: make(chan []byte)}
+
+	cancel()
+	_, err := ioutil.ReadAll(deadline.reader(stream.recv))
+	require.Equal(t, context.Canceled, err)
+}
+
+type fakeInfoRefsStream struct{ *fakeStream }
+
+func (s fakeInfoRefsStream) Recv() (*pb.InfoRefsResponse, error) {
+	data, err := s.recv()
+	return &pb.InfoRefsResponse{Data: data}, err
+}
+
+func TestInfoRefsReaderStopsDeadline(t *testing.T) {
+	ctx, deadline := withDeadline(context.Background(), "InfoRefsUploadPack", time.Hour, time.Hour, 0)
+	_, err := infoRefsReader(deadline, nil, errors.New("unavailable"))
+	require.Error(t, err)
+	require.Error(t, ctx.Err(), "deadline stopped when the call fails")
+
+	ctx, deadline = withDeadline(context.Background(), "InfoRefsUploadPack", time.Hour, time.Hour, 0)
+	stream := fakeInfoRefsStream{&fakeStream{ctx: ctx, messages: make(chan []byte, 1)}}
+	stream.messages <- []byte("refs")
+
+	reader, err := infoRefsReader(deadline, stream, nil)
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	require.NoError(t, ctx.Err())
+
+	require.NoError(t, reader.Close())
+	require.Error(t, ctx.Err(), "deadline stopped when the reader is abandoned")
+}
+
+func TestConfigureTimeouts(t *testing.T) {
+	defer Configure(nil)
+
+	require.Equal(t, defaultInfoRefsFirstByteTimeout, currentTimeouts().infoRefsFirstByte)
+	require.Equal(t, time.Duration(0), currentTimeouts().archive)
+
+	require.NoError(t, Configure(&config.GitalyConfig{
+		StreamIdleTimeout: &config.TomlDuration{},
+		ArchiveTimeout:    &config.TomlDuration{Duration: time.Hour},
+	}))
+	require.Equal(t, timeoutSettings{infoRefsFirstByte: defaultInfoRefsFirstByteTimeout, archive: time.Hour}, currentTimeouts())
+}
@@ -0,0 +1,128 @@
+package gitaly
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	tlsScheme = "tls://"
+
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultKeepaliveTimeout    = 20 * time.Second
+)
+
+var (
+	healthChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_health_checks",
+			Help: "How many health checks of Gitaly connections have been made, partitioned by result (ok, failed).",
+		},
+		[]string{"result"},
+	)
+
+	connectionFailovers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_connection_failovers",
+			Help: "How many Gitaly clients have been created for an address other than the first one of their storage.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(healthChecks)
+	prometheus.MustRegister(connectionFailovers)
+}
+
+// dialSettings apply to connections dialled after Configure
+type dialSettings struct {
+	tlsConfig           *tls.Config
+	keepalive           *keepalive.ClientParameters
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+}
+
+func newDialSettings() dialSettings {
+	return dialSettings{
+		tlsConfig:           &tls.Config{},
+		healthCheckInterval: defaultHealthCheckInterval,
+		healthCheckTimeout:  defaultHealthCheckTimeout,
+	}
+}
+
+// Configure sets up TLS, keepalive and health checks of Gitaly
+// connections, and the timeouts of Gitaly calls. A nil cfg restores the defaults.
+func Configure(cfg *config.GitalyConfig) error {
+	settings := newDialSettings()
+
+	if cfg != nil {
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return fmt.Errorf("gitaly.Configure: %v", err)
+			}
+
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("gitaly.Configure: no certificates in %q", cfg.CAFile)
+			}
+			settings.tlsConfig.RootCAs = pool
+		}
+
+		if cfg.KeepaliveTime != nil {
+			settings.keepalive = &keepalive.ClientParameters{
+				Time:                cfg.KeepaliveTime.Duration,
+				Timeout:             defaultKeepaliveTimeout,
+				PermitWithoutStream: true,
+			}
+			if cfg.KeepaliveTimeout != nil {
+				settings.keepalive.Timeout = cfg.KeepaliveTimeout.Duration
+			}
+		}
+
+		if cfg.HealthCheckInterval != nil {
+			settings.healthCheckInterval = cfg.HealthCheckInterval.Duration
+		}
+		if cfg.HealthCheckTimeout != nil {
+			settings.healthCheckTimeout = cfg.HealthCheckTimeout.Duration
+		}
+	}
+
+	cache.Lock()
+	cache.settings = settings
+	cache.Unlock()
+	timeouts.Store(newTimeoutSettings(cfg))
+
+	return nil
+}
+
+func dialTLS(rawAddress string, tlsConfig *tls.Config, connOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	u, err := url.Parse(rawAddress)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("network tls requires host: %q", rawAddress)
+	}
+	if u.Path != "" {
+		return nil, fmt.Errorf("network tls should have no path: %q", rawAddress)
+	}
+
+	connOpts = append(connOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	return grpc.Dial(u.Host, connOpts...)
+}
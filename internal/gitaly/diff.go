@@ -7,22 +7,25 @@ import (
 	"net/http"
 
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
-	"gitlab.com/gitlab-org/gitaly/streamio"
 )
 
 type DiffClient struct {
 	pb.DiffServiceClient
+	metadata map[string]string
 }
 
 func (client *DiffClient) SendRawDiff(ctx context.Context, w http.ResponseWriter, request *pb.RawDiffRequest) error {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "RawDiff", 0, currentTimeouts().streamIdle, 0)
+	defer deadline.stop()
+
 	c, err := client.RawDiff(ctx, request)
 	if err != nil {
-		return fmt.Errorf("rpc failed: %v", err)
+		return fmt.Errorf("rpc failed: %v", deadline.err(err))
 	}
 
 	w.Header().Del("Content-Length")
 
-	rr := streamio.NewReader(func() ([]byte, error) {
+	rr := deadline.reader(func() ([]byte, error) {
 		resp, err := c.Recv()
 		return resp.GetData(), err
 	})
@@ -35,14 +38,17 @@ func (client *DiffClient) SendRawDiff(ctx context.Context, w http.ResponseWriter
 }
 
 func (client *DiffClient) SendRawPatch(ctx context.Context, w http.ResponseWriter, request *pb.RawPatchRequest) error {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "RawPatch", 0, currentTimeouts().streamIdle, 0)
+	defer deadline.stop()
+
 	c, err := client.RawPatch(ctx, request)
 	if err != nil {
-		return fmt.Errorf("rpc failed: %v", err)
+		return fmt.Errorf("rpc failed: %v", deadline.err(err))
 	}
 
 	w.Header().Del("Content-Length")
 
-	rr := streamio.NewReader(func() ([]byte, error) {
+	rr := deadline.reader(func() ([]byte, error) {
 		resp, err := c.Recv()
 		return resp.GetData(), err
 	})
@@ -1,59 +1,115 @@
 package gitaly
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
 	"gitlab.com/gitlab-org/gitaly/auth"
 	gitalyclient "gitlab.com/gitlab-org/gitaly/client"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
 type Server struct {
 	Address string `json:"address"`
 	Token   string `json:"token"`
+	// Addresses lists further addresses of the same storage. Calls fail
+	// over to them, in order, while Address is unhealthy.
+	Addresses []string `json:"addresses"`
+	// Metadata is added to every call, e.g. feature flags
+	// (gitaly-feature-<name>) and the identity of the user
+	Metadata map[string]string `json:"metadata"`
+}
+
+// addresses returns the addresses of server without duplicates, Address
+// first
+func (server Server) addresses() []string {
+	addresses := []string{server.Address}
+	for _, address := range server.Addresses {
+		duplicate := false
+		for _, a := range addresses {
+			duplicate = duplicate || a == address
+		}
+		if address != "" && !duplicate {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+type connectionKey struct {
+	address string
+	token   string
+}
+
+type connection struct {
+	*grpc.ClientConn
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func (conn *connection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.stop)
+		conn.ClientConn.Close()
+	})
 }
 
 type connectionsCache struct {
 	sync.RWMutex
-	connections map[Server]*grpc.ClientConn
+	connections map[connectionKey]*connection
+	// unhealthy holds the addresses that failed a health check, and until
+	// when calls should prefer other addresses of their storage
+	unhealthy map[string]time.Time
+	settings  dialSettings
 }
 
 var cache = connectionsCache{
-	connections: make(map[Server]*grpc.ClientConn),
+	connections: make(map[connectionKey]*connection),
+	unhealthy:   make(map[string]time.Time),
+	settings:    newDialSettings(),
 }
 
 func NewSmartHTTPClient(server Server) (*SmartHTTPClient, error) {
-	conn, err := getOrCreateConnection(server)
+	conn, err := getConnection(server)
 	if err != nil {
 		return nil, err
 	}
 	grpcClient := pb.NewSmartHTTPServiceClient(conn)
-	return &SmartHTTPClient{grpcClient}, nil
+	return &SmartHTTPClient{SmartHTTPServiceClient: grpcClient, metadata: server.Metadata}, nil
 }
 
 func NewBlobClient(server Server) (*BlobClient, error) {
-	conn, err := getOrCreateConnection(server)
+	conn, err := getConnection(server)
 	if err != nil {
 		return nil, err
 	}
 	grpcClient := pb.NewBlobServiceClient(conn)
-	return &BlobClient{grpcClient}, nil
+	return &BlobClient{BlobServiceClient: grpcClient, metadata: server.Metadata}, nil
 }
 
 func NewRepositoryClient(server Server) (*RepositoryClient, error) {
-	conn, err := getOrCreateConnection(server)
+	conn, err := getConnection(server)
 	if err != nil {
 		return nil, err
 	}
 	grpcClient := pb.NewRepositoryServiceClient(conn)
-	return &RepositoryClient{grpcClient}, nil
+	return &RepositoryClient{RepositoryServiceClient: grpcClient, metadata: server.Metadata}, nil
 }
 
 // NewNamespaceClient is only used by the Gitaly integration tests at present
 func NewNamespaceClient(server Server) (*NamespaceClient, error) {
-	conn, err := getOrCreateConnection(server)
+	conn, err := getConnection(server)
 	if err != nil {
 		return nil, err
 	}
@@ -62,55 +118,165 @@ func NewNamespaceClient(server Server) (*NamespaceClient, error) {
 }
 
 func NewDiffClient(server Server) (*DiffClient, error) {
-	conn, err := getOrCreateConnection(server)
+	conn, err := getConnection(server)
 	if err != nil {
 		return nil, err
 	}
 	grpcClient := pb.NewDiffServiceClient(conn)
-	return &DiffClient{grpcClient}, nil
+	return &DiffClient{DiffServiceClient: grpcClient, metadata: server.Metadata}, nil
 }
 
-func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
+// getConnection returns the connection to the first address of server
+// that is not known to be broken. The last address is used regardless so
+// that calls fail with the actual error.
+func getConnection(server Server) (*grpc.ClientConn, error) {
+	addresses := server.addresses()
+	for i, address := range addresses {
+		last := i == len(addresses)-1
+		if !last && cache.isUnhealthy(address) {
+			continue
+		}
+
+		conn, err := getOrCreateConnection(connectionKey{address: address, token: server.Token})
+		if err != nil {
+			if last {
+				return nil, err
+			}
+			continue
+		}
+
+		if !last && conn.GetState() == connectivity.TransientFailure {
+			continue
+		}
+
+		if i > 0 {
+			connectionFailovers.Inc()
+		}
+		return conn.ClientConn, nil
+	}
+
+	return nil, fmt.Errorf("getConnection: no address")
+}
+
+func getOrCreateConnection(key connectionKey) (*connection, error) {
 	cache.RLock()
-	conn := cache.connections[server]
+	conn := cache.connections[key]
 	cache.RUnlock()
 
-	if conn != nil {
+	if conn != nil && conn.GetState() != connectivity.Shutdown {
 		return conn, nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
-	if conn := cache.connections[server]; conn != nil {
-		return conn, nil
+	if conn := cache.connections[key]; conn != nil {
+		if conn.GetState() != connectivity.Shutdown {
+			return conn, nil
+		}
+		delete(cache.connections, key)
 	}
 
-	conn, err := newConnection(server)
+	clientConn, err := newConnection(key, cache.settings)
 	if err != nil {
 		return nil, err
 	}
 
-	cache.connections[server] = conn
+	conn = &connection{ClientConn: clientConn, stop: make(chan struct{})}
+	cache.connections[key] = conn
+	if cache.settings.healthCheckInterval > 0 {
+		go cache.watch(key, conn, cache.settings)
+	}
 
 	return conn, nil
 }
 
+func (c *connectionsCache) isUnhealthy(address string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return time.Now().Before(c.unhealthy[address])
+}
+
+// watch health-checks conn until it is closed. A connection that fails a
+// check stays open, so that the calls running on it are not cut off, and
+// gRPC reconnects it by itself. Until it passes a check again, new calls
+// prefer the other addresses of their storage. Calls that fail on an
+// address are not retried on another one.
+func (c *connectionsCache) watch(key connectionKey, conn *connection, settings dialSettings) {
+	ticker := time.NewTicker(settings.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), settings.healthCheckTimeout)
+		err := checkHealth(ctx, conn.ClientConn)
+		cancel()
+
+		if err == nil {
+			healthChecks.WithLabelValues("ok").Inc()
+			c.setUnhealthy(key.address, time.Time{})
+			continue
+		}
+
+		healthChecks.WithLabelValues("failed").Inc()
+		log.WithFields(context.Background(), log.Fields{"address": key.address}).WithError(err).Error("Gitaly connection failed its health check")
+		// Stay unhealthy until the next check has had time to pass
+		c.setUnhealthy(key.address, time.Now().Add(settings.healthCheckInterval+settings.healthCheckTimeout))
+	}
+}
+
+func (c *connectionsCache) setUnhealthy(address string, until time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if until.IsZero() {
+		delete(c.unhealthy, address)
+	} else {
+		c.unhealthy[address] = until
+	}
+}
+
 func CloseConnections() {
 	cache.Lock()
 	defer cache.Unlock()
 
-	for _, conn := range cache.connections {
-		conn.Close()
+	for key, conn := range cache.connections {
+		conn.close()
+		delete(cache.connections, key)
 	}
 }
 
-func newConnection(server Server) (*grpc.ClientConn, error) {
-	connOpts := append(gitalyclient.DefaultDialOpts,
-		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-	)
+func newConnection(key connectionKey, settings dialSettings) (*grpc.ClientConn, error) {
+	connOpts := []grpc.DialOption{
+		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(key.token)),
+		grpc.WithStreamInterceptor(
+			grpc_middleware.ChainStreamClient(
+				streamMetadataInterceptor,
+				grpc_prometheus.StreamClientInterceptor,
+				grpc_opentracing.StreamClientInterceptor(),
+			),
+		),
+		grpc.WithUnaryInterceptor(
+			grpc_middleware.ChainUnaryClient(
+				unaryMetadataInterceptor,
+				grpc_prometheus.UnaryClientInterceptor,
+				grpc_opentracing.UnaryClientInterceptor(),
+			),
+		),
+	}
+	if settings.keepalive != nil {
+		connOpts = append(connOpts, grpc.WithKeepaliveParams(*settings.keepalive))
+	}
+
+	if strings.HasPrefix(key.address, tlsScheme) {
+		return dialTLS(key.address, settings.tlsConfig, connOpts)
+	}
 
-	return gitalyclient.Dial(server.Address, connOpts)
+	return gitalyclient.Dial(key.address, append(connOpts, gitalyclient.DefaultDialOpts...))
 }
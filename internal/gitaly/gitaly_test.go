@@ -0,0 +1,182 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func startHealthServer(t *testing.T, network string, address string, status int32, opts ...grpc.ServerOption) (string, *grpc.Server) {
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "grpc.health.v1.Health",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Check",
+			Handler: func(srv interface{}, ctx netcontext.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				if err := dec(&healthCheckRequest{}); err != nil {
+					return nil, err
+				}
+				return &healthCheckResponse{Status: status}, nil
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+
+	return listener.Addr().String(), server
+}
+
+func TestServerAddresses(t *testing.T) {
+	server := Server{Address: "tcp://a:1", Addresses: []string{"tcp://b:1", "", "tcp://a:1", "tcp://b:1", "tls://c:1"}}
+	require.Equal(t, []string{"tcp://a:1", "tcp://b:1", "tls://c:1"}, server.addresses())
+	require.Equal(t, []string{""}, Server{}.addresses())
+}
+
+func TestFailoverFromUnhealthyConnection(t *testing.T) {
+	require.NoError(t, Configure(&config.GitalyConfig{HealthCheckInterval: &config.TomlDuration{Duration: 10 * time.Millisecond}}))
+	defer Configure(nil)
+	defer CloseConnections()
+
+	dir, err := ioutil.TempDir("", "gitaly")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	unhealthy, unhealthyServer := startHealthServer(t, "unix", path.Join(dir, "unhealthy.socket"), healthStatusNotServing)
+	defer unhealthyServer.Stop()
+	healthy, healthyServer := startHealthServer(t, "unix", path.Join(dir, "healthy.socket"), healthStatusServing)
+	defer healthyServer.Stop()
+
+	server := Server{Address: "unix:" + unhealthy, Addresses: []string{"unix:" + healthy}}
+	conn, err := getConnection(server)
+	require.NoError(t, err)
+	require.Error(t, checkHealth(context.Background(), conn), "the first address is used until it fails a check")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cache.isUnhealthy("unix:"+unhealthy) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.True(t, cache.isUnhealthy("unix:"+unhealthy))
+
+	cache.RLock()
+	cached := cache.connections[connectionKey{address: "unix:" + unhealthy}]
+	cache.RUnlock()
+	require.NotNil(t, cached, "calls running on the unhealthy connection are not cut off")
+	require.NotEqual(t, connectivity.Shutdown, cached.GetState())
+
+	conn, err = getConnection(server)
+	require.NoError(t, err)
+	require.NoError(t, checkHealth(context.Background(), conn))
+
+	// The last address is used even if it is unhealthy
+	conn, err = getConnection(Server{Address: "unix:" + unhealthy})
+	require.NoError(t, err)
+	require.Error(t, checkHealth(context.Background(), conn))
+}
+
+func TestRedialClosedConnection(t *testing.T) {
+	require.NoError(t, Configure(&config.GitalyConfig{HealthCheckInterval: &config.TomlDuration{}}))
+	defer Configure(nil)
+	defer CloseConnections()
+
+	address, server := startHealthServer(t, "tcp", "127.0.0.1:0", healthStatusServing)
+	defer server.Stop()
+
+	conn, err := getConnection(Server{Address: "tcp://" + address})
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	conn, err = getConnection(Server{Address: "tcp://" + address})
+	require.NoError(t, err)
+	require.NoError(t, checkHealth(context.Background(), conn))
+}
+
+func TestTLSConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gitaly"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caFile := path.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+
+	creds := credentials.NewServerTLSFromCert(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	address, server := startHealthServer(t, "tcp", "127.0.0.1:0", healthStatusServing, grpc.Creds(creds))
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, Configure(&config.GitalyConfig{CAFile: caFile}))
+	defer Configure(nil)
+	defer CloseConnections()
+
+	conn, err := getConnection(Server{Address: "tls://" + address})
+	require.NoError(t, err)
+	require.NoError(t, checkHealth(ctx, conn))
+
+	// Without the CA the certificate is not trusted
+	require.NoError(t, Configure(nil))
+	conn, err = getConnection(Server{Address: "tls://" + address, Token: "other connection"})
+	require.NoError(t, err)
+	require.Error(t, checkHealth(ctx, conn))
+}
+
+func TestConfigureInvalidCAFile(t *testing.T) {
+	defer Configure(nil)
+
+	require.Error(t, Configure(&config.GitalyConfig{CAFile: "/nonexistent/ca.pem"}))
+
+	file, err := ioutil.TempFile("", "ca")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("not a certificate")
+	file.Close()
+
+	require.Error(t, Configure(&config.GitalyConfig{CAFile: file.Name()}))
+}
+
+func TestDialInvalidTLSAddress(t *testing.T) {
+	_, err := getConnection(Server{Address: "tls://"})
+	require.Error(t, err)
+
+	_, err = getConnection(Server{Address: "tls://host:1/path"})
+	require.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The messages of the standard gRPC health service (grpc.health.v1),
+// which Gitaly registers on its server. The generated code of the service
+// is not part of our dependencies and two messages with one field each do
+// not justify adding it.
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+const (
+	healthStatusServing    = 1
+	healthStatusNotServing = 2
+)
+
+type healthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service,proto3"`
+}
+
+func (m *healthCheckRequest) Reset()         { *m = healthCheckRequest{} }
+func (m *healthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*healthCheckRequest) ProtoMessage()    {}
+
+type healthCheckResponse struct {
+	Status int32 `protobuf:"varint,1,opt,name=status,proto3"`
+}
+
+func (m *healthCheckResponse) Reset()         { *m = healthCheckResponse{} }
+func (m *healthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*healthCheckResponse) ProtoMessage()    {}
+
+// checkHealth asks the server behind conn whether it is serving. Servers
+// without the health service count as healthy: they answered after all.
+func checkHealth(ctx context.Context, conn *grpc.ClientConn) error {
+	response := &healthCheckResponse{}
+	err := conn.Invoke(ctx, healthCheckMethod, &healthCheckRequest{}, response, grpc.FailFast(true))
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("health check: %v", err)
+	}
+
+	if response.Status != healthStatusServing {
+		return fmt.Errorf("health check: status %d", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package gitaly
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Keys that gRPC or the authentication of workhorse set themselves
+var reservedMetadataKeys = map[string]bool{
+	"authorization": true,
+	"content-type":  true,
+	"te":            true,
+	"user-agent":    true,
+}
+
+var metadataKeyPattern = regexp.MustCompile(`\A[0-9a-z_.-]+\z`)
+
+type metadataContextKey struct{}
+
+// withMetadata returns a context whose Gitaly calls carry md. The
+// interceptors of every connection add it to the outgoing metadata.
+func withMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, metadataContextKey{}, md)
+}
+
+func outgoingContext(ctx netcontext.Context) netcontext.Context {
+	md, _ := ctx.Value(metadataContextKey{}).(map[string]string)
+
+	var pairs []string
+	for key, value := range md {
+		key = strings.ToLower(key)
+		if !validMetadataKey(key) || !(strings.HasSuffix(key, "-bin") || printableASCII(value)) {
+			continue
+		}
+		pairs = append(pairs, key, value)
+	}
+	if len(pairs) == 0 {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+func validMetadataKey(key string) bool {
+	return metadataKeyPattern.MatchString(key) && !reservedMetadataKeys[key] && !strings.HasPrefix(key, "grpc-")
+}
+
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func unaryMetadataInterceptor(ctx netcontext.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+}
+
+func streamMetadataInterceptor(ctx netcontext.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+}
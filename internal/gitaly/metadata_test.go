@@ -0,0 +1,106 @@
+package gitaly
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func startMetadataServer(t *testing.T, socketPath string, incoming chan<- metadata.MD) *grpc.Server {
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "grpc.health.v1.Health",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Check",
+			Handler: func(srv interface{}, ctx netcontext.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				incoming <- md
+				return &healthCheckResponse{Status: healthStatusServing}, dec(&healthCheckRequest{})
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				md, _ := metadata.FromIncomingContext(stream.Context())
+				incoming <- md
+				return nil
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+
+	return server
+}
+
+func TestMetadataIsAddedToCalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer CloseConnections()
+
+	incoming := make(chan metadata.MD, 1)
+	socketPath := path.Join(dir, "gitaly.socket")
+	server := startMetadataServer(t, socketPath, incoming)
+	defer server.Stop()
+
+	conn, err := getConnection(Server{Address: "unix:" + socketPath, Token: "secret"})
+	require.NoError(t, err)
+
+	ctx := withMetadata(context.Background(), map[string]string{
+		"gitaly-feature-inforef-uploadpack-cache": "true",
+		"Username":      "jane",
+		"user_id":       "42",
+		"remote_ip":     "192.0.2.1",
+		"authorization": "Bearer forged",
+		"grpc-timeout":  "1S",
+		"bad key":       "ignored",
+		"client_name":   "bad\nvalue",
+	})
+
+	require.NoError(t, checkHealth(ctx, conn))
+	md := <-incoming
+	require.Equal(t, []string{"true"}, md["gitaly-feature-inforef-uploadpack-cache"])
+	require.Equal(t, []string{"jane"}, md["username"])
+	require.Equal(t, []string{"42"}, md["user_id"])
+	require.Equal(t, []string{"192.0.2.1"}, md["remote_ip"])
+	require.Len(t, md["authorization"], 1)
+	require.NotEqual(t, "Bearer forged", md["authorization"][0])
+	require.NotContains(t, md, "bad key")
+	require.NotContains(t, md, "client_name")
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/grpc.health.v1.Health/Watch")
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+	md = <-incoming
+	require.Equal(t, []string{"jane"}, md["username"])
+
+	// Calls without metadata
+	require.NoError(t, checkHealth(context.Background(), conn))
+	md = <-incoming
+	require.NotContains(t, md, "username")
+}
+
+func TestClientsCarryServerMetadata(t *testing.T) {
+	server := Server{Address: "unix:/nonexistent", Metadata: map[string]string{"username": "jane"}}
+
+	smarthttp, err := NewSmartHTTPClient(server)
+	require.NoError(t, err)
+	require.Equal(t, server.Metadata, smarthttp.metadata)
+
+	repository, err := NewRepositoryClient(server)
+	require.NoError(t, err)
+	require.Equal(t, server.Metadata, repository.metadata)
+}
@@ -6,23 +6,27 @@ import (
 	"io"
 
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
-	"gitlab.com/gitlab-org/gitaly/streamio"
 )
 
 // RepositoryClient encapsulates RepositoryService calls
 type RepositoryClient struct {
 	pb.RepositoryServiceClient
+	metadata map[string]string
 }
 
 // ArchiveReader performs a GetArchive Gitaly request and returns an io.Reader
 // for the response
 func (client *RepositoryClient) ArchiveReader(ctx context.Context, request *pb.GetArchiveRequest) (io.Reader, error) {
+	timeouts := currentTimeouts()
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "GetArchive", 0, timeouts.streamIdle, timeouts.archive)
+
 	c, err := client.GetArchive(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("RepositoryService::GetArchive: %v", err)
+		deadline.stop()
+		return nil, fmt.Errorf("RepositoryService::GetArchive: %v", deadline.err(err))
 	}
 
-	return streamio.NewReader(func() ([]byte, error) {
+	return deadline.reader(func() ([]byte, error) {
 		resp, err := c.Recv()
 
 		return resp.GetData(), err
@@ -32,12 +36,15 @@ func (client *RepositoryClient) ArchiveReader(ctx context.Context, request *pb.G
 // SnapshotReader performs a GetSnapshot Gitaly request and returns an io.Reader
 // for the response
 func (client *RepositoryClient) SnapshotReader(ctx context.Context, request *pb.GetSnapshotRequest) (io.Reader, error) {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "GetSnapshot", 0, currentTimeouts().streamIdle, 0)
+
 	c, err := client.GetSnapshot(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("RepositoryService::GetSnapshot: %v", err)
+		deadline.stop()
+		return nil, fmt.Errorf("RepositoryService::GetSnapshot: %v", deadline.err(err))
 	}
 
-	return streamio.NewReader(func() ([]byte, error) {
+	return deadline.reader(func() ([]byte, error) {
 		resp, err := c.Recv()
 
 		return resp.GetData(), err
@@ -6,27 +6,34 @@ import (
 	"io"
 
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
-	"gitlab.com/gitlab-org/gitaly/streamio"
 )
 
 type SmartHTTPClient struct {
 	pb.SmartHTTPServiceClient
+	metadata map[string]string
 }
 
-func (client *SmartHTTPClient) InfoRefsResponseReader(ctx context.Context, repo *pb.Repository, rpc string, gitConfigOptions []string, gitProtocol string) (io.Reader, error) {
+// InfoRefsResponseReader returns the info/refs advertisement of repo. The
+// reader must be closed, also when it is not read to the end.
+func (client *SmartHTTPClient) InfoRefsResponseReader(ctx context.Context, repo *pb.Repository, rpc string, gitConfigOptions []string, gitProtocol string) (io.ReadCloser, error) {
 	rpcRequest := &pb.InfoRefsRequest{
 		Repository:       repo,
 		GitConfigOptions: gitConfigOptions,
 		GitProtocol:      gitProtocol,
 	}
 
+	ctx = withMetadata(ctx, client.metadata)
+	timeouts := currentTimeouts()
+
 	switch rpc {
 	case "git-upload-pack":
+		ctx, deadline := withDeadline(ctx, "InfoRefsUploadPack", timeouts.infoRefsFirstByte, timeouts.streamIdle, 0)
 		stream, err := client.InfoRefsUploadPack(ctx, rpcRequest)
-		return infoRefsReader(stream), err
+		return infoRefsReader(deadline, stream, err)
 	case "git-receive-pack":
+		ctx, deadline := withDeadline(ctx, "InfoRefsReceivePack", timeouts.infoRefsFirstByte, timeouts.streamIdle, 0)
 		stream, err := client.InfoRefsReceivePack(ctx, rpcRequest)
-		return infoRefsReader(stream), err
+		return infoRefsReader(deadline, stream, err)
 	default:
 		return nil, fmt.Errorf("InfoRefsResponseWriterTo: Unsupported RPC: %q", rpc)
 	}
@@ -36,17 +43,40 @@ type infoRefsClient interface {
 	Recv() (*pb.InfoRefsResponse, error)
 }
 
-func infoRefsReader(stream infoRefsClient) io.Reader {
-	return streamio.NewReader(func() ([]byte, error) {
+// infoRefsReadCloser stops the deadline of the call when it is closed
+type infoRefsReadCloser struct {
+	io.Reader
+	deadline *rpcDeadline
+}
+
+func (r *infoRefsReadCloser) Close() error {
+	r.deadline.stop()
+	return nil
+}
+
+func infoRefsReader(deadline *rpcDeadline, stream infoRefsClient, err error) (io.ReadCloser, error) {
+	if err != nil {
+		deadline.stop()
+		return nil, deadline.err(err)
+	}
+
+	reader := deadline.reader(func() ([]byte, error) {
 		resp, err := stream.Recv()
 		return resp.GetData(), err
 	})
+	return &infoRefsReadCloser{Reader: reader, deadline: deadline}, nil
 }
 
+// ReceivePack streams clientRequest to Gitaly and the response to
+// clientResponse. Like UploadPack it cancels the RPC if reading
+// clientRequest fails, so that Gitaly never unpacks a truncated push.
 func (client *SmartHTTPClient) ReceivePack(ctx context.Context, repo *pb.Repository, glId string, glUsername string, glRepository string, gitConfigOptions []string, clientRequest io.Reader, clientResponse io.Writer, gitProtocol string) error {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "PostReceivePack", 0, currentTimeouts().streamIdle, 0)
+	defer deadline.stop()
+
 	stream, err := client.PostReceivePack(ctx)
 	if err != nil {
-		return err
+		return deadline.err(err)
 	}
 
 	rpcRequest := &pb.PostReceivePackRequest{
@@ -59,43 +89,31 @@ func (client *SmartHTTPClient) ReceivePack(ctx context.Context, repo *pb.Reposit
 	}
 
 	if err := stream.Send(rpcRequest); err != nil {
-		return fmt.Errorf("initial request: %v", err)
+		return fmt.Errorf("initial request: %v", deadline.err(err))
 	}
 
-	numStreams := 2
-	errC := make(chan error, numStreams)
-
-	go func() {
-		rr := streamio.NewReader(func() ([]byte, error) {
-			response, err := stream.Recv()
-			return response.GetData(), err
-		})
-		_, err := io.Copy(clientResponse, rr)
-		errC <- err
-	}()
-
-	go func() {
-		sw := streamio.NewWriter(func(data []byte) error {
-			return stream.Send(&pb.PostReceivePackRequest{Data: data})
-		})
-		_, err := io.Copy(sw, clientRequest)
-		stream.CloseSend()
-		errC <- err
-	}()
-
-	for i := 0; i < numStreams; i++ {
-		if err := <-errC; err != nil {
-			return err
-		}
-	}
+	rr := deadline.reader(func() ([]byte, error) {
+		response, err := stream.Recv()
+		return response.GetData(), err
+	})
+	sw := deadline.writer(func(data []byte) error {
+		return stream.Send(&pb.PostReceivePackRequest{Data: data})
+	})
 
-	return nil
+	return proxyStreams(deadline.cancel, clientRequest, sw, stream.CloseSend, clientResponse, rr)
 }
 
+// UploadPack streams clientRequest to Gitaly and the response to
+// clientResponse. If reading clientRequest fails, the RPC is cancelled so
+// that Gitaly does not answer a truncated request, and UploadPack returns
+// the read error unchanged once nothing writes to clientResponse anymore.
 func (client *SmartHTTPClient) UploadPack(ctx context.Context, repo *pb.Repository, clientRequest io.Reader, clientResponse io.Writer, gitConfigOptions []string, gitProtocol string) error {
+	ctx, deadline := withDeadline(withMetadata(ctx, client.metadata), "PostUploadPack", 0, currentTimeouts().streamIdle, 0)
+	defer deadline.stop()
+
 	stream, err := client.PostUploadPack(ctx)
 	if err != nil {
-		return err
+		return deadline.err(err)
 	}
 
 	rpcRequest := &pb.PostUploadPackRequest{
@@ -105,33 +123,58 @@ func (client *SmartHTTPClient) UploadPack(ctx context.Context, repo *pb.Reposito
 	}
 
 	if err := stream.Send(rpcRequest); err != nil {
-		return fmt.Errorf("initial request: %v", err)
+		return fmt.Errorf("initial request: %v", deadline.err(err))
 	}
 
-	numStreams := 2
-	errC := make(chan error, numStreams)
+	rr := deadline.reader(func() ([]byte, error) {
+		response, err := stream.Recv()
+		return response.GetData(), err
+	})
+	sw := deadline.writer(func(data []byte) error {
+		return stream.Send(&pb.PostUploadPackRequest{Data: data})
+	})
+
+	return proxyStreams(deadline.cancel, clientRequest, sw, stream.CloseSend, clientResponse, rr)
+}
+
+// proxyStreams copies clientRequest to requestStream and responseStream to
+// clientResponse at the same time. If the request copy fails, cancel is
+// called and proxyStreams returns that error once the response copy has
+// stopped.
+func proxyStreams(cancel func(), clientRequest io.Reader, requestStream io.Writer, closeSend func() error, clientResponse io.Writer, responseStream io.Reader) error {
+	responseErrC := make(chan error, 1)
+	requestErrC := make(chan error, 1)
 
 	go func() {
-		rr := streamio.NewReader(func() ([]byte, error) {
-			response, err := stream.Recv()
-			return response.GetData(), err
-		})
-		_, err := io.Copy(clientResponse, rr)
-		errC <- err
+		_, err := io.Copy(clientResponse, responseStream)
+		responseErrC <- err
 	}()
 
 	go func() {
-		sw := streamio.NewWriter(func(data []byte) error {
-			return stream.Send(&pb.PostUploadPackRequest{Data: data})
-		})
-		_, err := io.Copy(sw, clientRequest)
-		stream.CloseSend()
-		errC <- err
+		_, err := io.Copy(requestStream, clientRequest)
+		if err == nil {
+			closeSend()
+		}
+		requestErrC <- err
 	}()
 
-	for i := 0; i < numStreams; i++ {
-		if err := <-errC; err != nil {
-			return err
+	for responseErrC != nil || requestErrC != nil {
+		select {
+		case err := <-responseErrC:
+			if err != nil {
+				return err
+			}
+			responseErrC = nil
+
+		case err := <-requestErrC:
+			if err != nil {
+				cancel()
+				if responseErrC != nil {
+					<-responseErrC
+				}
+				return err
+			}
+			requestErrC = nil
 		}
 	}
 
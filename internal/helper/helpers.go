@@ -10,17 +10,15 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
 	"syscall"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
 )
 
 const NginxResponseBufferHeader = "X-Accel-Buffering"
 
-var scrubRegexp = regexp.MustCompile(`(?i)([\?&]((?:private|authenticity|rss)[\-_]token)|(?:X-AMZ-)?Signature)=[^&]*`)
-
 func Fail500(w http.ResponseWriter, r *http.Request, err error) {
 	http.Error(w, "Internal server error", 500)
 	if err != nil {
@@ -49,9 +47,9 @@ func printError(r *http.Request, err error) {
 		log.WithFields(r.Context(), log.Fields{
 			"method": r.Method,
 			"uri":    ScrubURLParams(r.RequestURI),
-		}).WithError(err).Error("error")
+		}).WithError(redact.Error(err)).Error("error")
 	} else {
-		log.NoContext().WithError(err).Error("unknown error")
+		log.NoContext().WithError(redact.Error(err)).Error("unknown error")
 	}
 }
 
@@ -197,7 +195,7 @@ func CloneRequestWithNewBody(r *http.Request, body []byte) *http.Request {
 }
 
 // ScrubURLParams replaces the content of any sensitive query string parameters
-// in an URL with `[FILTERED]`
+// and user-info in an URL with `[FILTERED]`
 func ScrubURLParams(url string) string {
-	return scrubRegexp.ReplaceAllString(url, "$1=[FILTERED]")
+	return redact.URL(url)
 }
@@ -2,8 +2,10 @@ package helper
 
 import (
 	"bufio"
+	"context"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +22,33 @@ func SetAccessLoggerEntry(logEntry *log.Entry) {
 	accessLogEntry = logEntry
 }
 
+type accessLogFieldsKey struct{}
+
+type extraAccessLogFields struct {
+	sync.Mutex
+	fields log.Fields
+}
+
+// WithAccessLogFields returns a shallow copy of r whose context can
+// collect extra access log fields through SetAccessLogField
+func WithAccessLogFields(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessLogFieldsKey{}, &extraAccessLogFields{fields: log.Fields{}}))
+}
+
+// SetAccessLogField adds a field to the access log entry of the request
+// that ctx belongs to. It is a no-op for requests that did not pass
+// through WithAccessLogFields.
+func SetAccessLogField(ctx context.Context, key string, value interface{}) {
+	extra, ok := ctx.Value(accessLogFieldsKey{}).(*extraAccessLogFields)
+	if !ok {
+		return
+	}
+
+	extra.Lock()
+	defer extra.Unlock()
+	extra.fields[key] = value
+}
+
 type LoggingResponseWriter interface {
 	http.ResponseWriter
 
@@ -94,7 +123,7 @@ func (l *statsCollectingResponseWriter) writeAccessLog(r *http.Request) {
 func (l *statsCollectingResponseWriter) accessLogFields(r *http.Request) log.Fields {
 	duration := time.Since(l.started)
 
-	return log.Fields{
+	fields := log.Fields{
 		"host":       r.Host,
 		"remoteAddr": r.RemoteAddr,
 		"method":     r.Method,
@@ -106,6 +135,16 @@ func (l *statsCollectingResponseWriter) accessLogFields(r *http.Request) log.Fie
 		"userAgent":  r.UserAgent(),
 		"duration":   duration.Seconds(),
 	}
+
+	if extra, ok := r.Context().Value(accessLogFieldsKey{}).(*extraAccessLogFields); ok {
+		extra.Lock()
+		defer extra.Unlock()
+		for key, value := range extra.fields {
+			fields[key] = value
+		}
+	}
+
+	return fields
 }
 
 func (l *statsCollectingResponseWriter) RequestFinished(r *http.Request) {
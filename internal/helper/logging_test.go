@@ -3,6 +3,7 @@ package helper
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -85,3 +86,17 @@ func Test_statsCollectingResponseWriter_accessLogFields(t *testing.T) {
 	}
 
 }
+
+func TestSetAccessLogField(t *testing.T) {
+	req := WithAccessLogFields(httptest.NewRequest("GET", "/", nil))
+
+	SetAccessLogField(req.Context(), "gitCommand", "fetch")
+	// Requests without the extra fields must not panic
+	SetAccessLogField(httptest.NewRequest("GET", "/", nil).Context(), "gitCommand", "ls-refs")
+
+	l := &statsCollectingResponseWriter{status: 200, started: time.Now()}
+	fields := l.accessLogFields(req)
+
+	assert.Equal(t, "fetch", fields["gitCommand"])
+	assert.Equal(t, "GET", fields["method"])
+}
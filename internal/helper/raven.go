@@ -2,23 +2,21 @@ package helper
 
 import (
 	"net/http"
+	"net/url"
 	"reflect"
 
 	"github.com/getsentry/raven-go"
-)
 
-var ravenHeaderBlacklist = []string{
-	"Authorization",
-	"Private-Token",
-}
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
+)
 
 func captureRavenError(r *http.Request, err error) {
 	client := raven.DefaultClient
+	err = redact.Error(err)
 
 	interfaces := []raven.Interface{}
 	if r != nil {
-		CleanHeadersForRaven(r)
-		interfaces = append(interfaces, raven.NewHttp(r))
+		interfaces = append(interfaces, newRavenHTTP(r))
 	}
 
 	exception := &raven.Exception{
@@ -32,14 +30,38 @@ func captureRavenError(r *http.Request, err error) {
 	client.Capture(packet, nil)
 }
 
-func CleanHeadersForRaven(r *http.Request) {
+// newRavenHTTP describes r for Sentry without secrets. Unlike
+// CleanRequestForRaven it leaves r untouched because the request may
+// still be in flight.
+func newRavenHTTP(r *http.Request) *raven.Http {
+	h := raven.NewHttp(r)
+	h.URL = redact.URL(h.URL)
+	h.Query = redact.URL(h.Query)
+
+	for key := range h.Headers {
+		if redact.IsSensitiveHeader(key) {
+			h.Headers[key] = redact.HeaderPlaceholder
+		}
+	}
+	if h.Cookies != "" && redact.IsSensitiveHeader("Cookie") {
+		h.Cookies = redact.HeaderPlaceholder
+	}
+
+	return h
+}
+
+// CleanRequestForRaven removes secrets from the headers and URL of r so
+// that raven.RecoveryHandler can report a panic safely.
+func CleanRequestForRaven(r *http.Request) {
 	if r == nil {
 		return
 	}
 
-	for _, key := range ravenHeaderBlacklist {
-		if r.Header.Get(key) != "" {
-			r.Header.Set(key, "[redacted]")
+	redact.Header(r.Header)
+	if r.URL != nil {
+		r.URL.RawQuery = redact.URL(r.URL.RawQuery)
+		if r.URL.User != nil {
+			r.URL.User = url.User(redact.URLPlaceholder)
 		}
 	}
 }
@@ -9,7 +9,12 @@ import (
 	"net/http"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tracing"
 )
 
 // httpTransport defines a http.Transport with values
@@ -60,7 +65,7 @@ func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[str
 		if metrics {
 			objectStorageUploadRequestsRequestFailed.Inc()
 		}
-		return nil, fmt.Errorf("PUT %q: %v", helper.ScrubURLParams(putURL), err)
+		return nil, fmt.Errorf("PUT %q: %v", helper.ScrubURLParams(putURL), redact.Error(err))
 	}
 	req.ContentLength = size
 
@@ -101,17 +106,24 @@ func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[str
 			pr.CloseWithError(o.uploadError)
 		}()
 
-		req = req.WithContext(o.ctx)
+		span, spanCtx := opentracing.StartSpanFromContext(o.ctx, "objectstore.put")
+		ext.SpanKindRPCClient.Set(span)
+		ext.HTTPUrl.Set(span, helper.ScrubURLParams(o.PutURL))
+		span.SetTag("size", size)
+		defer func() { tracing.FinishWithError(span, o.uploadError) }()
+
+		req = req.WithContext(spanCtx)
 
 		resp, err := httpClient.Do(req)
 		if err != nil {
 			if metrics {
 				objectStorageUploadRequestsRequestFailed.Inc()
 			}
-			o.uploadError = fmt.Errorf("PUT request %q: %v", helper.ScrubURLParams(o.PutURL), err)
+			o.uploadError = fmt.Errorf("PUT request %q: %v", helper.ScrubURLParams(o.PutURL), redact.Error(err))
 			return
 		}
 		defer resp.Body.Close()
+		ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
 
 		if resp.StatusCode != http.StatusOK {
 			if metrics {
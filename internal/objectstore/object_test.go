@@ -149,3 +149,32 @@ func TestObjectUploadBrokenConnection(t *testing.T) {
 	closeErr := object.Close()
 	require.Equal(t, copyErr, closeErr)
 }
+
+func TestObjectUploadErrorsDoNotLeakSignatures(t *testing.T) {
+	const signature = "d41d8cd98f00b204e9800998ecf8427e"
+	query := "?X-Amz-Credential=AKIAEXAMPLE&X-Amz-Security-Token=" + signature + "&X-Amz-Signature=" + signature
+
+	for _, handler := range []http.Handler{
+		http.NotFoundHandler(),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		}),
+	} {
+		ts := httptest.NewServer(handler)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		deadline := time.Now().Add(testTimeout)
+		object, err := objectstore.NewObject(ctx, ts.URL+test.ObjectPath+query, "", map[string]string{}, deadline, test.ObjectSize)
+		require.NoError(t, err)
+
+		io.Copy(object, strings.NewReader(test.ObjectContent))
+		err = object.Close()
+		require.Error(t, err)
+		require.NotContains(t, err.Error(), signature)
+
+		cancel()
+		ts.Close()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
 )
 
 // Upload represents an upload to an ObjectStorage provider
@@ -76,14 +77,14 @@ func (u *uploader) syncAndDelete(url string) {
 
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
-		log.WithError(err).WithField("object", helper.ScrubURLParams(url)).Warning("Delete failed")
+		log.WithError(redact.Error(err)).WithField("object", helper.ScrubURLParams(url)).Warning("Delete failed")
 		return
 	}
 
 	// here we are not using u.ctx because we must perform cleanup regardless of parent context
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.WithError(err).WithField("object", helper.ScrubURLParams(url)).Warning("Delete failed")
+		log.WithError(redact.Error(err)).WithField("object", helper.ScrubURLParams(url)).Warning("Delete failed")
 		return
 	}
 	resp.Body.Close()
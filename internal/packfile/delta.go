@@ -0,0 +1,165 @@
+package packfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errDeltaTruncated = errors.New("packfile: delta truncated")
+	errDeltaTooLarge  = errors.New("packfile: delta result exceeds its size")
+)
+
+// deltaSizes decodes the base and result sizes at the start of delta and
+// returns the instructions that follow them
+func deltaSizes(delta []byte) (baseSize int64, targetSize int64, instructions []byte, err error) {
+	baseSize, delta, err = deltaVarint(delta)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	targetSize, delta, err = deltaVarint(delta)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return baseSize, targetSize, delta, nil
+}
+
+func deltaVarint(delta []byte) (int64, []byte, error) {
+	var value int64
+	for i, shift := 0, uint(0); i < len(delta); i, shift = i+1, shift+7 {
+		if shift > 56 {
+			return 0, nil, errors.New("packfile: delta size overflow")
+		}
+
+		value |= int64(delta[i]&0x7f) << shift
+		if delta[i]&0x80 == 0 {
+			return value, delta[i+1:], nil
+		}
+	}
+
+	return 0, nil, errDeltaTruncated
+}
+
+// ApplyDelta returns the result of applying the delta instructions in delta
+// to base
+func ApplyDelta(base []byte, delta []byte) ([]byte, error) {
+	baseSize, targetSize, delta, err := deltaSizes(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != int64(len(base)) {
+		return nil, fmt.Errorf("packfile: delta base size mismatch: expected %d, got %d", baseSize, len(base))
+	}
+
+	// The result is checked against targetSize before anything is appended:
+	// a single copy instruction can expand to 64KB, so a delta could
+	// otherwise grow far beyond the size it announced
+	target := make([]byte, 0, targetSize)
+	err = walkDelta(delta, func(offset, size int64) error {
+		if offset+size > int64(len(base)) {
+			return errors.New("packfile: delta copies beyond its base")
+		}
+		if int64(len(target))+size > targetSize {
+			return errDeltaTooLarge
+		}
+		target = append(target, base[offset:offset+size]...)
+		return nil
+	}, func(data []byte) error {
+		if int64(len(target))+int64(len(data)) > targetSize {
+			return errDeltaTooLarge
+		}
+		target = append(target, data...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(target)) != targetSize {
+		return nil, fmt.Errorf("packfile: delta result size mismatch: expected %d, got %d", targetSize, len(target))
+	}
+
+	return target, nil
+}
+
+// DeltaInserts returns the data that delta adds to its base. Insertions
+// that are not adjacent in the result are separated by newlines. This is
+// as much as can be learned about the contents of a delta whose base is
+// unknown.
+func DeltaInserts(delta []byte) []byte {
+	_, _, delta, err := deltaSizes(delta)
+	if err != nil {
+		return nil
+	}
+
+	var inserts []byte
+	adjacent := false
+	walkDelta(delta, func(int64, int64) error {
+		adjacent = false
+		return nil
+	}, func(data []byte) error {
+		if !adjacent && len(inserts) > 0 {
+			inserts = append(inserts, '\n')
+		}
+		inserts = append(inserts, data...)
+		adjacent = true
+		return nil
+	})
+
+	return inserts
+}
+
+// walkDelta calls copy for every copy instruction and insert for every
+// insert instruction in delta
+func walkDelta(delta []byte, copy func(offset, size int64) error, insert func([]byte) error) error {
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			// Copy from base: the low bits say which offset and size bytes
+			// follow
+			var offset, size int64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return errDeltaTruncated
+				}
+
+				if i < 4 {
+					offset |= int64(delta[0]) << (8 * i)
+				} else {
+					size |= int64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+
+			if err := copy(offset, size); err != nil {
+				return err
+			}
+
+		case op != 0:
+			// Insert the next op bytes
+			if int(op) > len(delta) {
+				return errDeltaTruncated
+			}
+			if err := insert(delta[:op]); err != nil {
+				return err
+			}
+			delta = delta[op:]
+
+		default:
+			return errors.New("packfile: invalid delta instruction")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package packfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	delta := []byte{
+		11, 17, // base and result size
+		0x91, 0, 6, // copy 6 bytes from offset 0: "hello "
+		5, 't', 'h', 'e', 'r', 'e', // insert "there"
+		0x91, 5, 6, // copy 6 bytes from offset 5: " world"
+	}
+
+	result, err := ApplyDelta(base, delta)
+	require.NoError(t, err)
+	require.Equal(t, "hello there world", string(result))
+
+	require.Equal(t, "there", string(DeltaInserts(delta)))
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	base := []byte("hello world")
+
+	for _, delta := range [][]byte{
+		{},                       // no sizes
+		{12, 5, 0x91, 0, 5},      // wrong base size
+		{11, 5, 0x91, 8, 5},      // copy beyond base
+		{11, 5, 0x91, 0},         // truncated copy
+		{11, 5, 5, 'a'},          // truncated insert
+		{11, 5, 0},               // reserved instruction
+		{11, 6, 0x91, 0, 5},      // wrong result size
+		{0x80, 0x80, 0x80, 0x80}, // truncated size
+	} {
+		_, err := ApplyDelta(base, delta)
+		require.Error(t, err, "delta %v", delta)
+	}
+}
+
+func TestApplyDeltaRejectsCopyBomb(t *testing.T) {
+	base := make([]byte, 0x10000)
+
+	// Every bare 0x80 copies 64KB from the start of base, so these
+	// instructions would build a result of 64GB
+	delta := []byte{0x80, 0x80, 0x04, 5}
+	for i := 0; i < 1<<20; i++ {
+		delta = append(delta, 0x80)
+	}
+
+	_, err := ApplyDelta(base, delta)
+	require.Equal(t, errDeltaTooLarge, err)
+}
+
+func TestApplyDeltaRejectsOversizedInsert(t *testing.T) {
+	_, err := ApplyDelta([]byte("hello"), []byte{5, 3, 5, 'w', 'o', 'r', 'l', 'd'})
+	require.Equal(t, errDeltaTooLarge, err)
+}
+
+func TestDeltaInsertsSeparatesDistantInsertions(t *testing.T) {
+	delta := []byte{
+		11, 14,
+		2, 'a', 'b',
+		1, 'c',
+		0x91, 0, 5,
+		6, 'd', 'e', 'f', 'g', 'h', 'i',
+	}
+
+	require.Equal(t, "abc\ndefghi", string(DeltaInserts(delta)))
+}
@@ -0,0 +1,63 @@
+package packfile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// TreeEntry is an entry of a tree object
+type TreeEntry struct {
+	Mode string
+	Name string
+	ID   string
+}
+
+// IsTree reports whether the entry is a subdirectory
+func (e TreeEntry) IsTree() bool {
+	return e.Mode == "40000"
+}
+
+// IsBlob reports whether the entry is a file or a symlink, as opposed to a
+// subdirectory or a submodule
+func (e TreeEntry) IsBlob() bool {
+	return strings.HasPrefix(e.Mode, "100") || e.Mode == "120000"
+}
+
+// ParseTree returns the entries of the tree object data
+func ParseTree(data []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
+
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 {
+			return nil, errors.New("packfile: tree entry without mode")
+		}
+		mode := string(data[:space])
+		data = data[space+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || len(data) < nul+1+objectIDSize {
+			return nil, errors.New("packfile: truncated tree entry")
+		}
+
+		entries = append(entries, TreeEntry{
+			Mode: mode,
+			Name: string(data[:nul]),
+			ID:   hex.EncodeToString(data[nul+1 : nul+1+objectIDSize]),
+		})
+		data = data[nul+1+objectIDSize:]
+	}
+
+	return entries, nil
+}
+
+// CommitTree returns the ID of the root tree of the commit object data
+func CommitTree(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("tree ")) || len(data) < len("tree ")+2*objectIDSize {
+		return "", errors.New("packfile: commit without tree")
+	}
+
+	return string(data[len("tree ") : len("tree ")+2*objectIDSize]), nil
+}
@@ -0,0 +1,401 @@
+/*
+Package packfile reads Git packfiles while they are being streamed, for
+example as part of a git push, without writing them to disk.
+
+Objects are inflated and deltas resolved in memory. To keep memory use
+bounded, objects larger than the maximum object size are not kept in
+memory, and once the memory limit is reached no more objects are kept as
+delta bases. Deltas against objects that are not available, such as the
+bases of a thin pack, are returned unresolved.
+*/
+package packfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ObjectType is the type of a Git object
+type ObjectType int
+
+// Object types as they are encoded in a packfile
+const (
+	// ObjectUnresolved is the type of deltas whose base is not available
+	ObjectUnresolved ObjectType = 0
+	ObjectCommit     ObjectType = 1
+	ObjectTree       ObjectType = 2
+	ObjectBlob       ObjectType = 3
+	ObjectTag        ObjectType = 4
+
+	objectOfsDelta ObjectType = 6
+	objectRefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	default:
+		return "unresolved"
+	}
+}
+
+const (
+	objectIDSize = sha1.Size
+	// entryOverhead approximates the memory used to remember an object
+	// besides its contents
+	entryOverhead = 128
+)
+
+// ErrNotPack is returned by NewReader if the stream does not start with a
+// packfile signature
+var ErrNotPack = errors.New("packfile: not a packfile")
+
+// Object is an object read from a packfile
+type Object struct {
+	// ID is the hex object ID. It is empty if the object could not be
+	// read completely, such as unresolved deltas and deltas whose result
+	// would exceed the maximum object size.
+	ID   string
+	Type ObjectType
+	// Size is the size of the object contents. For deltas it is the size
+	// of the result of applying the delta.
+	Size int64
+	// Data holds the contents of objects up to the maximum object size.
+	// It must not be modified.
+	Data []byte
+	// Delta holds the instructions of deltas that could not be applied
+	Delta []byte
+}
+
+type entry struct {
+	typ  ObjectType
+	data []byte
+}
+
+// Reader reads the objects of a packfile one at a time
+type Reader struct {
+	r             *offsetReader
+	zr            io.ReadCloser
+	objects       uint32
+	read          uint32
+	maxObjectSize int64
+	maxMemory     int64
+	memory        int64
+	byOffset      map[int64]*entry
+	byID          map[string]*entry
+}
+
+// NewReader reads the packfile header from r. Objects larger than
+// maxObjectSize are streamed through without being kept in memory;
+// maxMemory bounds the total size of the objects kept as delta bases.
+func NewReader(r io.Reader, maxObjectSize int64, maxMemory int64) (*Reader, error) {
+	p := &Reader{
+		r:             &offsetReader{r: bufio.NewReader(r)},
+		maxObjectSize: maxObjectSize,
+		maxMemory:     maxMemory,
+		byOffset:      make(map[int64]*entry),
+		byID:          make(map[string]*entry),
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("packfile: read header: %v", err)
+	}
+
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return nil, ErrNotPack
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return nil, fmt.Errorf("packfile: unsupported version %d", version)
+	}
+	p.objects = binary.BigEndian.Uint32(header[8:12])
+
+	return p, nil
+}
+
+// Objects returns the number of objects in the packfile
+func (p *Reader) Objects() uint32 {
+	return p.objects
+}
+
+// Next returns the next object of the packfile. After the last object it
+// returns io.EOF.
+func (p *Reader) Next() (*Object, error) {
+	if p.read == p.objects {
+		trailer := make([]byte, objectIDSize)
+		if _, err := io.ReadFull(p.r, trailer); err != nil {
+			return nil, fmt.Errorf("packfile: read trailer: %v", err)
+		}
+		return nil, io.EOF
+	}
+	p.read++
+
+	offset := p.r.offset
+	typ, size, err := p.readObjectHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var obj *Object
+	switch typ {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+		obj, err = p.readObject(typ, size)
+	case objectOfsDelta:
+		obj, err = p.readOfsDelta(offset, size)
+	case objectRefDelta:
+		obj, err = p.readRefDelta(size)
+	default:
+		err = fmt.Errorf("packfile: invalid object type %d at offset %d", typ, offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.remember(offset, obj)
+
+	return obj, nil
+}
+
+func (p *Reader) readObjectHeader() (ObjectType, int64, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return 0, 0, fmt.Errorf("packfile: read object header: %v", err)
+	}
+
+	typ := ObjectType((c >> 4) & 7)
+	size := int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return 0, 0, errors.New("packfile: object size overflow")
+		}
+		if c, err = p.r.ReadByte(); err != nil {
+			return 0, 0, fmt.Errorf("packfile: read object header: %v", err)
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	return typ, size, nil
+}
+
+func (p *Reader) readObject(typ ObjectType, size int64) (*Object, error) {
+	obj := &Object{Type: typ, Size: size}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s %d\x00", typ, size)
+
+	if size <= p.maxObjectSize {
+		data, err := p.inflate(size)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(data)
+		obj.Data = data
+	} else if err := p.inflateTo(hash, size); err != nil {
+		return nil, err
+	}
+
+	obj.ID = hex.EncodeToString(hash.Sum(nil))
+
+	return obj, nil
+}
+
+func (p *Reader) readOfsDelta(offset int64, size int64) (*Object, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("packfile: read delta offset: %v", err)
+	}
+
+	distance := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = p.r.ReadByte(); err != nil {
+			return nil, fmt.Errorf("packfile: read delta offset: %v", err)
+		}
+		distance = ((distance + 1) << 7) | int64(c&0x7f)
+	}
+
+	return p.readDelta(p.byOffset[offset-distance], size)
+}
+
+func (p *Reader) readRefDelta(size int64) (*Object, error) {
+	id := make([]byte, objectIDSize)
+	if _, err := io.ReadFull(p.r, id); err != nil {
+		return nil, fmt.Errorf("packfile: read delta base: %v", err)
+	}
+
+	return p.readDelta(p.byID[hex.EncodeToString(id)], size)
+}
+
+func (p *Reader) readDelta(base *entry, size int64) (*Object, error) {
+	obj := &Object{Type: ObjectUnresolved}
+	if base != nil {
+		obj.Type = base.typ
+	}
+
+	if size > p.maxObjectSize {
+		// Only keep the start of the delta, which holds the result size
+		head := &headWriter{max: 2 * binary.MaxVarintLen64}
+		if err := p.inflateTo(head, size); err != nil {
+			return nil, err
+		}
+
+		_, targetSize, _, err := deltaSizes(head.buf)
+		if err != nil {
+			return nil, err
+		}
+		obj.Size = targetSize
+
+		return obj, nil
+	}
+
+	delta, err := p.inflate(size)
+	if err != nil {
+		return nil, err
+	}
+
+	_, targetSize, _, err := deltaSizes(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	obj.Size = targetSize
+	obj.Delta = delta
+	if base == nil || base.data == nil || targetSize > p.maxObjectSize {
+		return obj, nil
+	}
+
+	data, err := ApplyDelta(base.data, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s %d\x00", obj.Type, len(data))
+	hash.Write(data)
+
+	obj.ID = hex.EncodeToString(hash.Sum(nil))
+	obj.Data = data
+	obj.Delta = nil
+
+	return obj, nil
+}
+
+// Reserve counts n bytes that the caller keeps in memory for the objects
+// it reads against the memory limit. It returns false, and counts
+// nothing, if they do not fit.
+func (p *Reader) Reserve(n int64) bool {
+	if p.memory+n > p.maxMemory {
+		return false
+	}
+
+	p.memory += n
+	return true
+}
+
+// remember keeps obj as a possible delta base as long as memory permits
+func (p *Reader) remember(offset int64, obj *Object) {
+	if obj.Type == ObjectUnresolved || p.memory+entryOverhead > p.maxMemory {
+		return
+	}
+
+	e := &entry{typ: obj.Type}
+	p.memory += entryOverhead
+	if obj.Data != nil && p.memory+int64(len(obj.Data)) <= p.maxMemory {
+		e.data = obj.Data
+		p.memory += int64(len(obj.Data))
+	}
+
+	p.byOffset[offset] = e
+	if obj.ID != "" {
+		p.byID[obj.ID] = e
+	}
+}
+
+func (p *Reader) inflate(size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(size))
+	if err := p.inflateTo(&buf, size); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// inflateTo decompresses the next zlib stream into w. The stream must
+// inflate to exactly size bytes.
+func (p *Reader) inflateTo(w io.Writer, size int64) error {
+	if p.zr == nil {
+		zr, err := zlib.NewReader(p.r)
+		if err != nil {
+			return fmt.Errorf("packfile: inflate: %v", err)
+		}
+		p.zr = zr
+	} else if err := p.zr.(zlib.Resetter).Reset(p.r, nil); err != nil {
+		return fmt.Errorf("packfile: inflate: %v", err)
+	}
+
+	n, err := io.Copy(w, io.LimitReader(p.zr, size+1))
+	if err != nil {
+		return fmt.Errorf("packfile: inflate: %v", err)
+	}
+	if n != size {
+		return fmt.Errorf("packfile: inflate: expected %d bytes, got %d", size, n)
+	}
+
+	return nil
+}
+
+// headWriter keeps the first max bytes written to it
+type headWriter struct {
+	buf []byte
+	max int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := h.max - len(h.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		h.buf = append(h.buf, p[:n]...)
+	}
+
+	return len(p), nil
+}
+
+// offsetReader keeps track of the position in the packfile. Because it
+// implements io.ByteReader, the zlib reader does not read beyond the end
+// of the compressed data of an object.
+type offsetReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *offsetReader) ReadByte() (byte, error) {
+	c, err := o.r.ReadByte()
+	if err == nil {
+		o.offset++
+	}
+	return c, err
+}
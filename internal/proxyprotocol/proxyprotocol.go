@@ -0,0 +1,265 @@
+/*
+Package proxyprotocol implements the receiving side of the HAProxy PROXY
+protocol, versions 1 and 2.
+
+See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+*/
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	// A v1 header is at most 107 bytes long including the CRLF
+	maxV1HeaderLength = 107
+
+	defaultHeaderTimeout = 10 * time.Second
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrUntrustedPeer is returned when a PROXY header arrives from an
+	// address outside of the trusted networks
+	ErrUntrustedPeer = errors.New("proxyprotocol: header from untrusted peer")
+)
+
+// Listener wraps a net.Listener. Every accepted connection must start
+// with a PROXY protocol header; the address in the header becomes the
+// RemoteAddr of the connection.
+type Listener struct {
+	net.Listener
+
+	// HeaderTimeout bounds the time to receive the header
+	HeaderTimeout time.Duration
+
+	trusted []*net.IPNet
+}
+
+// NewListener wraps l. When trustedCIDRs is not empty, headers are only
+// accepted from peers in those networks.
+func NewListener(l net.Listener, trustedCIDRs []string) (*Listener, error) {
+	trusted, err := helper.ParseNetworks(trustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{Listener: l, HeaderTimeout: defaultHeaderTimeout, trusted: trusted}, nil
+}
+
+// Accept waits for the next connection. The header is parsed lazily on
+// the first Read or RemoteAddr call so that a slow client cannot block
+// the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, listener: l, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *Listener) trustedPeer(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets can only be reached from the local machine
+		return true
+	}
+
+	return helper.NetworksContain(l.trusted, tcpAddr.IP)
+}
+
+// Conn is a connection accepted by Listener
+type Conn struct {
+	net.Conn
+
+	listener   *Listener
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	headerErr  error
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address announced in the header, or the
+// address of the peer for LOCAL and UNKNOWN connections.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	peer := c.Conn.RemoteAddr()
+	if !c.listener.trustedPeer(peer) {
+		c.fail(ErrUntrustedPeer)
+		return
+	}
+
+	if timeout := c.listener.HeaderTimeout; timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	addr, err := ReadHeader(c.reader)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	c.remoteAddr = addr
+}
+
+func (c *Conn) fail(err error) {
+	c.headerErr = err
+	log.NoContext().WithField("peer", c.Conn.RemoteAddr().String()).WithError(err).Error("proxyprotocol: reject connection")
+	c.Conn.Close()
+}
+
+// ReadHeader consumes a v1 or v2 header from r and returns the source
+// address it carries. The address is nil for LOCAL and UNKNOWN headers.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("proxyprotocol: read header: %v", err)
+	}
+
+	if bytes.Equal(start, v1Prefix) {
+		return readV1(r)
+	}
+
+	start, err = r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, errors.New("proxyprotocol: missing header")
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyprotocol: read v1 header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyprotocol: v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errors.New("proxyprotocol: malformed v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxyprotocol: unsupported v1 protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.New("proxyprotocol: malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("proxyprotocol: invalid v1 source address %q", fields[2])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyprotocol: invalid v1 source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+
+	v2FamilyInet  = 0x1
+	v2FamilyInet6 = 0x2
+)
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxyprotocol: read v2 header: %v", err)
+	}
+
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("proxyprotocol: unsupported version %d", version)
+	}
+	command := header[12] & 0xf
+	family := header[13] >> 4
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxyprotocol: read v2 addresses: %v", err)
+	}
+
+	switch command {
+	case v2CommandLocal:
+		return nil, nil
+	case v2CommandProxy:
+	default:
+		return nil, fmt.Errorf("proxyprotocol: unsupported v2 command %d", command)
+	}
+
+	// Trailing TLVs are ignored
+	switch family {
+	case v2FamilyInet:
+		if len(payload) < 12 {
+			return nil, errors.New("proxyprotocol: short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case v2FamilyInet6:
+		if len(payload) < 36 {
+			return nil, errors.New("proxyprotocol: short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,132 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 12345)
+	tlv := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0xff)
+
+	tests := []struct {
+		desc     string
+		header   []byte
+		expected string
+	}{
+		{desc: "v1 TCP4", header: []byte("PROXY TCP4 1.2.3.4 10.0.0.1 12345 443\r\n"), expected: "1.2.3.4:12345"},
+		{desc: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), expected: "[2001:db8::1]:12345"},
+		{desc: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{desc: "v2 IPv4", header: v2Header(v2CommandProxy, v2FamilyInet, ipv4), expected: "1.2.3.4:12345"},
+		{desc: "v2 IPv6", header: v2Header(v2CommandProxy, v2FamilyInet6, ipv6), expected: "[2001:db8::1]:12345"},
+		{desc: "v2 with TLVs", header: v2Header(v2CommandProxy, v2FamilyInet, tlv), expected: "1.2.3.4:12345"},
+		{desc: "v2 LOCAL", header: v2Header(v2CommandLocal, 0, nil)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tc.header, "GET / HTTP/1.1\r\n"...)))
+
+			addr, err := ReadHeader(r)
+			require.NoError(t, err)
+			if tc.expected == "" {
+				require.Nil(t, addr)
+			} else {
+				require.Equal(t, tc.expected, addr.String())
+			}
+
+			rest, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, "GET / HTTP/1.1\r\n", string(rest), "header must be consumed completely")
+		})
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header string
+	}{
+		{desc: "no header", header: "GET / HTTP/1.1\r\n"},
+		{desc: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"},
+		{desc: "v1 family mismatch", header: "PROXY TCP4 2001:db8::1 10.0.0.1 12345 443\r\n"},
+		{desc: "v1 bad port", header: "PROXY TCP4 1.2.3.4 10.0.0.1 123456 443\r\n"},
+		{desc: "v1 missing fields", header: "PROXY TCP4 1.2.3.4\r\n"},
+		{desc: "v2 short addresses", header: string(v2Header(v2CommandProxy, v2FamilyInet, []byte{1, 2, 3}))},
+		{desc: "v2 truncated", header: string(v2Signature) + "\x21"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := ReadHeader(bufio.NewReader(strings.NewReader(tc.header)))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		desc     string
+		trusted  []string
+		expected string
+		fail     bool
+	}{
+		{desc: "no trusted networks", expected: "1.2.3.4:12345"},
+		{desc: "trusted peer", trusted: []string{"127.0.0.0/8"}, expected: "1.2.3.4:12345"},
+		{desc: "untrusted peer", trusted: []string{"10.0.0.0/8"}, fail: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer tcpListener.Close()
+
+			listener, err := NewListener(tcpListener, tc.trusted)
+			require.NoError(t, err)
+
+			go func() {
+				client, err := net.Dial("tcp", tcpListener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				client.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 12345 443\r\nhello"))
+				ioutil.ReadAll(client)
+			}()
+
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			data := make([]byte, 5)
+			_, err = io.ReadFull(conn, data)
+			if tc.fail {
+				require.Equal(t, ErrUntrustedPeer, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(data))
+			require.Equal(t, tc.expected, conn.RemoteAddr().String())
+		})
+	}
+}
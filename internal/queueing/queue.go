@@ -148,6 +148,17 @@ func newQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue
 	return queue
 }
 
+// NewQueue creates a new queue for handlers that decide per request
+// whether the request has to wait in it. See newQueue for the arguments;
+// a zero timeout means DefaultTimeout.
+func NewQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return newQueue(name, limit, queueLimit, timeout)
+}
+
 // Acquire takes one slot from the Queue
 // and returns when a request should be processed
 // it allows up to (limit) of requests running at a time
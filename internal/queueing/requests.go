@@ -4,7 +4,10 @@ import (
 	"net/http"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tracing"
 )
 
 const (
@@ -30,7 +33,10 @@ func QueueRequests(name string, h http.Handler, limit, queueLimit uint, queueTim
 	queue := newQueue(name, limit, queueLimit, queueTimeout)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span, _ := opentracing.StartSpanFromContext(r.Context(), "queueing.acquire")
+		span.SetTag("queue_name", name)
 		err := queue.Acquire()
+		tracing.FinishWithError(span, err)
 
 		switch err {
 		case nil:
@@ -22,7 +22,7 @@ func pausedHttpHandler(pauseCh chan struct{}) http.Handler {
 func TestNormalRequestProcessing(t *testing.T) {
 	w := httptest.NewRecorder()
 	h := QueueRequests("Normal request processing", httpHandler, 1, 1, time.Second)
-	h.ServeHTTP(w, nil)
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
 	if w.Code != 200 {
 		t.Fatal("QueueRequests should process request")
 	}
@@ -44,7 +44,7 @@ func testSlowRequestProcessing(name string, count int, limit, queueLimit uint, q
 	for i := 0; i < count; i++ {
 		go func() {
 			w := httptest.NewRecorder()
-			handler.ServeHTTP(w, nil)
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
 			respCh <- w
 		}()
 	}
@@ -0,0 +1,92 @@
+package reauthorize
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+// Handler re-authorizes requests to h every interval for as long as they
+// run. A zero interval disables re-authorization.
+func Handler(h http.Handler, myAPI *api.API, interval time.Duration) http.Handler {
+	if interval <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, stop := Watch(r.Context(), interval, PreAuthorizeCheck(myAPI, r, ""))
+		defer stop()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type injecter struct {
+	senddata.Injecter
+	api      *api.API
+	interval time.Duration
+}
+
+// sendDataParams are the send-data parameters that concern
+// re-authorization. Rails adds them next to the parameters of the injecter.
+type sendDataParams struct {
+	// ReauthorizationPath is the path of the Rails endpoint that
+	// authorizes the download without serving it again
+	ReauthorizationPath string
+}
+
+// Injecter re-authorizes the requests served by a senddata injecter every
+// interval. Rails opts in per download by adding a ReauthorizationPath to
+// the send-data parameters; downloads without one are not re-authorized.
+// Only GET and HEAD requests are checked. A zero interval disables
+// re-authorization.
+func Injecter(i senddata.Injecter, myAPI *api.API, interval time.Duration) senddata.Injecter {
+	if interval <= 0 {
+		return i
+	}
+
+	return &injecter{Injecter: i, api: myAPI, interval: interval}
+}
+
+func (i *injecter) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params sendDataParams
+	if r.Method != "GET" && r.Method != "HEAD" || senddata.Prefix(i.Name()+":").Unpack(&params, sendData) != nil || params.ReauthorizationPath == "" {
+		// Broken parameters are reported by the injecter itself
+		i.Injecter.Inject(w, r, sendData)
+		return
+	}
+
+	authRequest, err := reauthorizationRequest(r, params.ReauthorizationPath)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("reauthorize: %v", err))
+		return
+	}
+
+	ctx, stop := Watch(r.Context(), i.interval, PreAuthorizeCheck(i.api, authRequest, ""))
+	defer stop()
+
+	i.Injecter.Inject(w, r.WithContext(ctx), sendData)
+}
+
+// reauthorizationRequest returns a copy of r for the re-authorization path
+// sent by Rails. The path may carry a query string but must stay on the
+// auth backend.
+func reauthorizationRequest(r *http.Request, reauthorizationPath string) (*http.Request, error) {
+	u, err := url.Parse(reauthorizationPath)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("invalid ReauthorizationPath %q", reauthorizationPath)
+	}
+
+	authRequest := r.WithContext(r.Context())
+	authRequest.URL = &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	return authRequest, nil
+}
@@ -0,0 +1,117 @@
+/*
+Package reauthorize repeats the pre-authorization check against Rails for
+long-running requests, so that revoking access also ends transfers that
+are already in progress.
+*/
+package reauthorize
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+var (
+	reauthorizationChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_reauthorization_checks",
+			Help: "How many periodic re-authorization checks of long-running requests have been made, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reauthorizationChecks)
+}
+
+// AccessDeniedError is returned by a CheckFunc when Rails no longer allows
+// the request.
+type AccessDeniedError struct {
+	StatusCode int
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access denied by authorization backend: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// CheckFunc repeats an authorization check. It returns an *AccessDeniedError
+// when access was revoked and any other error when the check itself failed.
+type CheckFunc func() error
+
+// Watch runs check every interval until ctx is done or the returned stop
+// function is called. The returned context is cancelled as soon as check
+// reports that access was denied. Failed checks are logged but do not end
+// the request, so that a Rails restart does not abort every running clone.
+func Watch(ctx context.Context, interval time.Duration, check CheckFunc) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := check()
+				if err == nil {
+					reauthorizationChecks.WithLabelValues("allowed").Inc()
+					continue
+				}
+
+				if _, ok := err.(*AccessDeniedError); ok {
+					reauthorizationChecks.WithLabelValues("denied").Inc()
+					log.WithError(ctx, err).Warning("reauthorize: access revoked, cancelling request")
+					cancel()
+					return
+				}
+
+				reauthorizationChecks.WithLabelValues("error").Inc()
+				log.WithError(ctx, err).Warning("reauthorize: check failed")
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		cancel()
+	}
+
+	return ctx, stop
+}
+
+// PreAuthorizeCheck generates a CheckFunc which repeats the pre-authorization
+// request for r with the given suffix. Only an explicit allow, a 200 response
+// carrying a pre-authorization JSON document, passes the check. Rails errors
+// count as failed checks; any other answer, including redirects and
+// send-data responses, means access was denied.
+func PreAuthorizeCheck(myAPI *api.API, r *http.Request, suffix string) CheckFunc {
+	return func() error {
+		httpResponse, authResponse, err := myAPI.PreAuthorize(suffix, r)
+		if err != nil {
+			return err
+		}
+		defer httpResponse.Body.Close()
+
+		if authResponse != nil {
+			return nil
+		}
+
+		if httpResponse.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("PreAuthorizeCheck: %s", httpResponse.Status)
+		}
+
+		return &AccessDeniedError{StatusCode: httpResponse.StatusCode}
+	}
+}
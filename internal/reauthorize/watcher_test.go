@@ -0,0 +1,207 @@
+package reauthorize
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/badgateway"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func checkerSeries(values ...error) CheckFunc {
+	return func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		out := values[0]
+		values = values[1:]
+		return out
+	}
+}
+
+func TestWatchCancelsWhenAccessDenied(t *testing.T) {
+	ctx, stop := Watch(context.Background(), time.Millisecond, checkerSeries(nil, nil, &AccessDeniedError{StatusCode: 403}))
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected context to be cancelled")
+	}
+}
+
+func TestWatchIgnoresFailedChecks(t *testing.T) {
+	ctx, stop := Watch(context.Background(), time.Millisecond, checkerSeries(errors.New("connection refused"), errors.New("connection refused")))
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("expected context to stay open after failed checks")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stop()
+	require.Error(t, ctx.Err())
+}
+
+func TestHandlerCancelsRequestWhenRailsDenies(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	ts := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	myAPI := api.NewAPI(backend, "123", badgateway.TestRoundTripper(backend))
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusGone)
+		case <-time.After(time.Second):
+			w.WriteHeader(http.StatusOK)
+		}
+	}), myAPI, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/group/project.git/git-upload-pack", nil))
+
+	testhelper.AssertResponseCode(t, w, http.StatusGone)
+}
+
+type waitingInjecter struct{ senddata.Prefix }
+
+func (waitingInjecter) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	select {
+	case <-r.Context().Done():
+		w.WriteHeader(http.StatusGone)
+	case <-time.After(50 * time.Millisecond):
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func TestInjecterChecksReauthorizationPath(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	var paths []string
+	var mu sync.Mutex
+	ts := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	myAPI := api.NewAPI(backend, "123", badgateway.TestRoundTripper(backend))
+
+	prefix := senddata.Prefix("test:")
+	injecter := Injecter(waitingInjecter{prefix}, myAPI, time.Millisecond)
+
+	testCases := []struct {
+		desc     string
+		params   sendDataParams
+		expected int
+		path     string
+	}{
+		{desc: "no re-authorization path", expected: http.StatusOK},
+		{desc: "re-authorization path", params: sendDataParams{ReauthorizationPath: "/group/project/-/archive/authorize?ref=v1.0"}, expected: http.StatusGone, path: "/group/project/-/archive/authorize?ref=v1.0"},
+		{desc: "other host", params: sendDataParams{ReauthorizationPath: "http://example.com/authorize"}, expected: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		paths = nil
+		sendData, err := prefix.Pack(tc.params)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		injecter.Inject(w, httptest.NewRequest("GET", "/group/project/-/archive/v1.0/project-v1.0.zip", nil), sendData)
+
+		require.Equal(t, tc.expected, w.Code, tc.desc)
+		mu.Lock()
+		if tc.path == "" {
+			require.Empty(t, paths, tc.desc)
+		} else {
+			require.Contains(t, paths, tc.path, tc.desc)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestPreAuthorizeCheckRequiresExplicitAllow(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	testCases := []struct {
+		desc   string
+		answer func(w http.ResponseWriter)
+		denied bool
+		failed bool
+	}{
+		{
+			desc: "pre-authorization response",
+			answer: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", api.ResponseContentType)
+				w.Write([]byte(`{}`))
+			},
+		},
+		{
+			desc: "send-data response",
+			answer: func(w http.ResponseWriter) {
+				w.Header().Set("Gitlab-Workhorse-Send-Data", "git-archive:e30=")
+				w.WriteHeader(http.StatusOK)
+			},
+			denied: true,
+		},
+		{
+			desc: "redirect",
+			answer: func(w http.ResponseWriter) {
+				w.Header().Set("Location", "/users/sign_in")
+				w.WriteHeader(http.StatusFound)
+			},
+			denied: true,
+		},
+		{
+			desc:   "forbidden",
+			answer: func(w http.ResponseWriter) { w.WriteHeader(http.StatusForbidden) },
+			denied: true,
+		},
+		{
+			desc:   "server error",
+			answer: func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) },
+			failed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		var path string
+		ts := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			tc.answer(w)
+		})
+
+		backend, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		myAPI := api.NewAPI(backend, "123", badgateway.TestRoundTripper(backend))
+
+		err = PreAuthorizeCheck(myAPI, httptest.NewRequest("GET", "/group/project/-/archive/v1.0/project-v1.0.zip", nil), "/authorize")()
+		ts.Close()
+
+		require.Equal(t, "/group/project/-/archive/v1.0/project-v1.0.zip/authorize", path, tc.desc)
+		_, denied := err.(*AccessDeniedError)
+		require.Equal(t, tc.denied, denied, "%s: %v", tc.desc, err)
+		require.Equal(t, tc.denied || tc.failed, err != nil, "%s: %v", tc.desc, err)
+	}
+}
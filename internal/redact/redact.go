@@ -0,0 +1,143 @@
+/*
+Package redact removes secrets from URLs, error messages and HTTP headers
+before they end up in logs, error messages or Sentry events.
+
+The built-in lists of query parameters and headers cover GitLab tokens and
+presigned object storage URLs. Configure adds more names from the
+[redaction] section of the config file.
+*/
+package redact
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	// URLPlaceholder replaces query parameter values and URL user-info
+	URLPlaceholder = "[FILTERED]"
+	// HeaderPlaceholder replaces header values
+	HeaderPlaceholder = "[redacted]"
+)
+
+var (
+	defaultQueryParams = []string{
+		"private_token",
+		"authenticity_token",
+		"rss_token",
+		"feed_token",
+		"job_token",
+		// S3 and GCS V2 presigned URLs
+		"Signature",
+		// S3 V4 presigned URLs
+		"X-Amz-Signature",
+		"X-Amz-Security-Token",
+		// GCS V4 presigned URLs
+		"X-Goog-Signature",
+		// Azure shared access signatures
+		"sig",
+	}
+
+	defaultHeaders = []string{
+		"Authorization",
+		"Proxy-Authorization",
+		"Private-Token",
+		"Job-Token",
+		"Cookie",
+		"Set-Cookie",
+	}
+
+	userInfoRegexp = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.\-]*://)[^/?#@\s"']+@`)
+
+	current atomic.Value
+)
+
+func init() {
+	current.Store(newRedactor(nil))
+}
+
+type redactor struct {
+	queryRegexp *regexp.Regexp
+	headers     map[string]bool
+}
+
+func newRedactor(cfg *config.RedactionConfig) *redactor {
+	params := defaultQueryParams
+	headers := defaultHeaders
+	if cfg != nil {
+		params = append(append([]string{}, params...), cfg.QueryParams...)
+		headers = append(append([]string{}, headers...), cfg.Headers...)
+	}
+
+	var names []string
+	for _, p := range params {
+		name := regexp.QuoteMeta(p)
+		// private_token and private-token are the same to Rails
+		name = strings.NewReplacer("-", `[\-_]`, "_", `[\-_]`).Replace(name)
+		names = append(names, name)
+	}
+
+	r := &redactor{
+		queryRegexp: regexp.MustCompile(`(?i)((?:^|[?&;])(?:` + strings.Join(names, "|") + `))=[^&#\s"']*`),
+		headers:     make(map[string]bool),
+	}
+	for _, h := range headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+
+	return r
+}
+
+func get() *redactor {
+	return current.Load().(*redactor)
+}
+
+// Configure adds the query parameters and headers in cfg to the built-in
+// lists. A nil cfg restores the built-in lists.
+func Configure(cfg *config.RedactionConfig) {
+	current.Store(newRedactor(cfg))
+}
+
+// URL replaces sensitive query parameter values and user-info in every
+// URL found in s. s can be a full URL, a request URI, a bare query string
+// or free text such as an error message.
+func URL(s string) string {
+	s = get().queryRegexp.ReplaceAllString(s, "${1}="+URLPlaceholder)
+	return userInfoRegexp.ReplaceAllString(s, "${1}"+URLPlaceholder+"@")
+}
+
+// Error returns an error whose message has been passed through URL. Errors
+// returned by net/http embed the full request URL, including presigned
+// signatures.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if redacted := URL(msg); redacted != msg {
+		return errors.New(redacted)
+	}
+
+	return err
+}
+
+// IsSensitiveHeader tells whether the value of header name must not be
+// logged or reported
+func IsSensitiveHeader(name string) bool {
+	return get().headers[http.CanonicalHeaderKey(name)]
+}
+
+// Header replaces the values of sensitive headers in h
+func Header(h http.Header) {
+	for key := range h {
+		if IsSensitiveHeader(key) {
+			h[key] = []string{HeaderPlaceholder}
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 var (
 	keyWatcher            = make(map[string][]chan string)
 	keyWatcherMutex       sync.Mutex
+	keyListeners          []keyListener
 	redisReconnectTimeout = backoff.Backoff{
 		//These are the defaults
 		Min:    100 * time.Millisecond,
@@ -49,6 +50,13 @@ const (
 	keySubChannel = "workhorse:notifications"
 )
 
+// keyListener is called for every notification of a key with prefix.
+// Listeners are protected by keyWatcherMutex.
+type keyListener struct {
+	prefix string
+	fn     func(key, value string)
+}
+
 // KeyChan holds a key and a channel
 type KeyChan struct {
 	Key  string
@@ -75,6 +83,7 @@ func processInner(conn redis.Conn) error {
 			}
 			key, value := msg[0], msg[1]
 			notifyChanWatchers(key, value)
+			notifyListeners(key, value)
 		case error:
 			helper.LogError(nil, fmt.Errorf("keywatcher: pubsub receive: %v", v))
 			// Intermittent error, return nil so that it doesn't wait before reconnect
@@ -131,6 +140,43 @@ func notifyChanWatchers(key, value string) {
 	}
 }
 
+func notifyListeners(key, value string) {
+	keyWatcherMutex.Lock()
+	listeners := keyListeners
+	keyWatcherMutex.Unlock()
+
+	for _, l := range listeners {
+		if strings.HasPrefix(key, l.prefix) {
+			l.fn(key, value)
+		}
+	}
+}
+
+// ListenKeys calls fn for every notification of a key that starts with
+// prefix, for as long as the process runs. fn must not block.
+func ListenKeys(prefix string, fn func(key, value string)) {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+	keyListeners = append(keyListeners[:len(keyListeners):len(keyListeners)], keyListener{prefix: prefix, fn: fn})
+}
+
+// Publish notifies all workhorse processes watching or listening to key
+// that its value is now value. It does nothing when Redis is not
+// configured.
+func Publish(key, value string) error {
+	conn := Get()
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", keySubChannel, key+"="+value); err != nil {
+		return fmt.Errorf("keywatcher: redis PUBLISH: %v", err)
+	}
+
+	return nil
+}
+
 func addKeyChan(kc *KeyChan) {
 	keyWatcherMutex.Lock()
 	defer keyWatcherMutex.Unlock()
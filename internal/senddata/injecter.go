@@ -32,6 +32,17 @@ func (p Prefix) Unpack(result interface{}, sendData string) error {
 	return nil
 }
 
+// Pack encodes params as the value of a HeaderKey header for the injecter
+// of p, the way Rails does
+func (p Prefix) Pack(params interface{}) (string, error) {
+	jsonBytes, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	return string(p) + base64.URLEncoding.EncodeToString(jsonBytes), nil
+}
+
 func (p Prefix) Name() string {
 	return strings.TrimSuffix(string(p), ":")
 }
@@ -3,6 +3,8 @@ package senddata
 import (
 	"net/http"
 
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
@@ -88,11 +90,7 @@ func (s *sendDataResponseWriter) tryInject() bool {
 	for _, injecter := range s.injecters {
 		if injecter.Match(header) {
 			s.hijacked = true
-			helper.DisableResponseBuffering(s.rw)
-			crw := helper.NewCountingResponseWriter(s.rw)
-			injecter.Inject(crw, s.req, header)
-			sendDataResponses.WithLabelValues(injecter.Name()).Inc()
-			sendDataResponseBytes.WithLabelValues(injecter.Name()).Add(float64(crw.Count()))
+			s.inject(injecter, header)
 			return true
 		}
 	}
@@ -100,6 +98,21 @@ func (s *sendDataResponseWriter) tryInject() bool {
 	return false
 }
 
+func (s *sendDataResponseWriter) inject(injecter Injecter, header string) {
+	helper.DisableResponseBuffering(s.rw)
+	crw := helper.NewCountingResponseWriter(s.rw)
+
+	span, ctx := opentracing.StartSpanFromContext(s.req.Context(), "senddata.inject")
+	span.SetTag("injecter", injecter.Name())
+	// The span is finished even if the injecter panics
+	defer span.Finish()
+
+	injecter.Inject(crw, s.req.WithContext(ctx), header)
+	ext.HTTPStatusCode.Set(span, uint16(crw.Status()))
+	sendDataResponses.WithLabelValues(injecter.Name()).Inc()
+	sendDataResponseBytes.WithLabelValues(injecter.Name()).Add(float64(crw.Count()))
+}
+
 func (s *sendDataResponseWriter) Flush() {
 	s.WriteHeader(http.StatusOK)
 }
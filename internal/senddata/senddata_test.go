@@ -18,3 +18,24 @@ func TestHeaderDelete(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixPack(t *testing.T) {
+	type params struct{ URL string }
+	prefix := Prefix("send-url:")
+
+	sendData, err := prefix.Pack(params{URL: "http://example.com/bundle?x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefix.Match(sendData) {
+		t.Fatalf("expected %q to match prefix %q", sendData, prefix)
+	}
+
+	var result params
+	if err := prefix.Unpack(&result, sendData); err != nil {
+		t.Fatal(err)
+	}
+	if result.URL != "http://example.com/bundle?x=y" {
+		t.Fatalf("expected URL to survive Pack and Unpack, got %q", result.URL)
+	}
+}
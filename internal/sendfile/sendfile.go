@@ -16,7 +16,9 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
-const sendFileResponseHeader = "X-Sendfile"
+// ResponseHeader names the file that SendFile serves instead of the
+// response body
+const ResponseHeader = "X-Sendfile"
 
 var (
 	sendFileRequests = prometheus.NewCounterVec(
@@ -88,8 +90,8 @@ func (s *sendFileResponseWriter) WriteHeader(status int) {
 		return
 	}
 
-	if file := s.Header().Get(sendFileResponseHeader); file != "" {
-		s.Header().Del(sendFileResponseHeader)
+	if file := s.Header().Get(ResponseHeader); file != "" {
+		s.Header().Del(ResponseHeader)
 		// Mark this connection as hijacked
 		s.hijacked = true
 
@@ -115,6 +115,7 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		helper.Fail500(w, r, fmt.Errorf("SendURL: NewRequest: %v", err))
 		return
 	}
+	newReq = newReq.WithContext(r.Context())
 
 	for _, header := range rangeHeaderKeys {
 		newReq.Header[header] = r.Header[header]
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+// InjectTracing starts a server span for every request. The span joins an
+// existing trace when the client (usually NGINX) sent a span context in the
+// request headers.
+func InjectTracing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracer := opentracing.GlobalTracer()
+		parent, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+
+		span := tracer.StartSpan("workhorse.http_request", ext.RPCServerOption(parent))
+		defer span.Finish()
+
+		ext.HTTPMethod.Set(span, r.Method)
+		ext.HTTPUrl.Set(span, helper.ScrubURLParams(r.RequestURI))
+		if correlationID, ok := r.Context().Value(log.KeyCorrelationID).(string); ok {
+			span.SetTag("correlation_id", correlationID)
+		}
+
+		h.ServeHTTP(w, r.WithContext(opentracing.ContextWithSpan(r.Context(), span)))
+	})
+}
@@ -0,0 +1,97 @@
+/*
+Package tracing sets up distributed tracing for gitlab-workhorse.
+
+Spans are created through the global opentracing.Tracer. Until Initialize
+is called that tracer is a no-op, so instrumented code paths cost almost
+nothing when tracing is not configured.
+*/
+package tracing
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	defaultServiceName = "gitlab-workhorse"
+	driverJaeger       = "jaeger"
+)
+
+// Initialize installs the global tracer described by cfg. The returned
+// io.Closer flushes buffered spans and should be closed on shutdown.
+func Initialize(cfg *config.TracingConfig, version string) (io.Closer, error) {
+	switch cfg.Driver {
+	case driverJaeger:
+		return initializeJaeger(cfg, version)
+	default:
+		return nil, fmt.Errorf("tracing: unknown driver %q", cfg.Driver)
+	}
+}
+
+func initializeJaeger(cfg *config.TracingConfig, version string) (io.Closer, error) {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	jaegerConfig := jaegercfg.Configuration{
+		ServiceName: serviceName,
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  cfg.Sampler,
+			Param: cfg.SamplerParam,
+		},
+		Reporter: &jaegercfg.ReporterConfig{
+			LocalAgentHostPort: cfg.UDPEndpoint,
+			CollectorEndpoint:  cfg.HTTPEndpoint,
+		},
+	}
+
+	tracer, closer, err := jaegerConfig.NewTracer(
+		jaegercfg.Logger(jaegerLogger{}),
+		jaegercfg.Tag("version", version),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: configure jaeger: %v", err)
+	}
+
+	opentracing.SetGlobalTracer(tracer)
+
+	return closer, nil
+}
+
+// InjectRequestHeaders adds the context of span to the headers of an
+// outgoing HTTP request so that the receiving service can join the trace.
+func InjectRequestHeaders(span opentracing.Span, req *http.Request) {
+	carrier := opentracing.HTTPHeadersCarrier(req.Header)
+	if err := span.Tracer().Inject(span.Context(), opentracing.HTTPHeaders, carrier); err != nil {
+		log.WithFields(req.Context(), log.Fields{"uri": req.URL.Path}).WithError(err).Warning("tracing: inject span context")
+	}
+}
+
+// FinishWithError marks span as failed when err is not nil and finishes it.
+func FinishWithError(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	}
+
+	span.Finish()
+}
+
+type jaegerLogger struct{}
+
+func (jaegerLogger) Error(msg string) {
+	log.NoContext().WithField("system", "tracing").Error(msg)
+}
+
+func (jaegerLogger) Infof(msg string, args ...interface{}) {
+	log.NoContext().WithField("system", "tracing").Infof(msg, args...)
+}
@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestInitializeUnknownDriver(t *testing.T) {
+	_, err := Initialize(&config.TracingConfig{Driver: "zipkin"}, "test")
+	require.Error(t, err)
+}
+
+func TestInitializeJaeger(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	closer, err := Initialize(&config.TracingConfig{Driver: "jaeger", Sampler: "const", SamplerParam: 1}, "test")
+	require.NoError(t, err)
+	defer closer.Close()
+
+	_, isNoop := opentracing.GlobalTracer().(opentracing.NoopTracer)
+	require.False(t, isNoop, "expected a jaeger tracer to be installed")
+}
+
+func TestInjectTracingAddsSpanToContext(t *testing.T) {
+	var span opentracing.Span
+	h := InjectTracing(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		span = opentracing.SpanFromContext(r.Context())
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	require.NotNil(t, span, "expected request context to carry a span")
+}
@@ -16,6 +16,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
 	proxypkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/proxy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/reauthorize"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
@@ -28,10 +29,11 @@ import (
 type matcherFunc func(*http.Request) bool
 
 type routeEntry struct {
-	method   string
-	regex    *regexp.Regexp
-	handler  http.Handler
-	matchers []matcherFunc
+	method    string
+	regex     *regexp.Regexp
+	regexpStr string
+	handler   http.Handler
+	matchers  []matcherFunc
 }
 
 const (
@@ -51,19 +53,21 @@ func compileRegexp(regexpStr string) *regexp.Regexp {
 
 func route(method, regexpStr string, handler http.Handler, matchers ...matcherFunc) routeEntry {
 	return routeEntry{
-		method:   method,
-		regex:    compileRegexp(regexpStr),
-		handler:  instrumentRoute(denyWebsocket(handler), method, regexpStr),
-		matchers: matchers,
+		method:    method,
+		regex:     compileRegexp(regexpStr),
+		regexpStr: regexpStr,
+		handler:   instrumentRoute(denyWebsocket(handler), method, regexpStr),
+		matchers:  matchers,
 	}
 }
 
 func wsRoute(regexpStr string, handler http.Handler, matchers ...matcherFunc) routeEntry {
 	return routeEntry{
-		method:   "GET",
-		regex:    compileRegexp(regexpStr),
-		handler:  instrumentRoute(handler, "GET", regexpStr),
-		matchers: append(matchers, websocket.IsWebSocketUpgrade),
+		method:    "GET",
+		regex:     compileRegexp(regexpStr),
+		regexpStr: regexpStr,
+		handler:   instrumentRoute(handler, "GET", regexpStr),
+		matchers:  append(matchers, websocket.IsWebSocketUpgrade),
 	}
 }
 
@@ -104,6 +108,7 @@ func (u *upstream) configureRoutes() {
 		u.Version,
 		u.RoundTripper,
 	)
+	api.AuthFailureLimiter = u.AuthFailureLimiter
 	static := &staticpages.Static{DocumentRoot: u.DocumentRoot}
 	proxy := senddata.SendData(
 		sendfile.SendFile(
@@ -113,13 +118,13 @@ func (u *upstream) configureRoutes() {
 					u.Version,
 					u.RoundTripper,
 				))),
-		git.SendArchive,
+		reauthorize.Injecter(git.NewSendArchive(u.ArchiveCache), api, u.ReauthorizationInterval),
 		git.SendBlob,
 		git.SendDiff,
 		git.SendPatch,
-		git.SendSnapshot,
+		reauthorize.Injecter(git.SendSnapshot, api, u.ReauthorizationInterval),
 		artifacts.SendEntry,
-		sendurl.SendURL,
+		reauthorize.Injecter(sendurl.SendURL, api, u.ReauthorizationInterval),
 	)
 
 	uploadPath := path.Join(u.DocumentRoot, "uploads/tmp")
@@ -129,9 +134,11 @@ func (u *upstream) configureRoutes() {
 
 	u.Routes = []routeEntry{
 		// Git Clone
-		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
-		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), isContentType("application/x-git-upload-pack-request")),
-		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), isContentType("application/x-git-receive-pack-request")),
+		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api, u.InfoRefsCache)),
+		route("POST", gitProjectPattern+`git-upload-pack\z`, reauthorize.Handler(contentEncodingHandler(git.UploadPack(api, u.ClonePolicies, u.UploadPackCache, u.UploadPackRequestLimit)), api, u.ReauthorizationInterval), isContentType("application/x-git-upload-pack-request")),
+		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api, u.UploadPackCache, u.InfoRefsCache, u.PushInspector)), isContentType("application/x-git-receive-pack-request")),
+		route("GET", gitProjectPattern+git.BundlePath+`[0-9A-Za-z_-]+\z`, git.GetBundle(api)),
+		route("GET", gitProjectPattern+git.CloneBundlePath+`\z`, git.GetBundle(api)),
 		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, proxy), isContentType("application/octet-stream")),
 
 		// CI Artifacts
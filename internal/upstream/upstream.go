@@ -11,11 +11,16 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/sebest/xff"
+	opentracing "github.com/opentracing/opentracing-go"
 
+	apipkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/badgateway"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bruteforce"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clientip"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/urlprefix"
 )
@@ -29,9 +34,17 @@ var (
 
 type upstream struct {
 	config.Config
-	URLPrefix    urlprefix.Prefix
-	Routes       []routeEntry
-	RoundTripper *badgateway.RoundTripper
+	URLPrefix          urlprefix.Prefix
+	Routes             []routeEntry
+	RoundTripper       *badgateway.RoundTripper
+	AuthFailureLimiter apipkg.AuthFailureLimiter
+	ClientIPResolver   *clientip.Resolver
+	ClonePolicies      *git.ClonePolicies
+	UploadPackCache    *git.UploadPackCache
+	PushInspector      *git.PushInspector
+	InfoRefsCache      *git.InfoRefsCache
+	ArchiveCache       *git.ArchiveCache
+	ArchiveWarmer      *git.ArchiveWarmer
 }
 
 func NewUpstream(cfg config.Config) http.Handler {
@@ -42,11 +55,79 @@ func NewUpstream(cfg config.Config) http.Handler {
 		up.Backend = DefaultBackend
 	}
 	up.RoundTripper = badgateway.NewRoundTripper(up.Backend, up.Socket, up.ProxyHeadersTimeout, cfg.DevelopmentMode)
+	up.configureClientIPResolver()
+	up.configureAuthFailureLimiter()
+	up.configureClonePolicies()
+	up.configureUploadPackCache()
+	up.configurePushInspector()
+	up.configureInfoRefsCache()
+	up.configureArchiveCache()
+	up.configureArchiveWarmer()
 	up.configureURLPrefix()
 	up.configureRoutes()
 	return &up
 }
 
+func (u *upstream) configureClientIPResolver() {
+	resolver, err := clientip.NewResolver(u.TrustedProxies)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configureClientIPResolver")
+	}
+	u.ClientIPResolver = resolver
+}
+
+func (u *upstream) configureAuthFailureLimiter() {
+	if u.BruteForce == nil {
+		return
+	}
+
+	limiter, err := bruteforce.NewLimiter(u.BruteForce)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configureAuthFailureLimiter")
+	}
+	u.AuthFailureLimiter = limiter
+}
+
+func (u *upstream) configureClonePolicies() {
+	u.ClonePolicies = git.NewClonePolicies(u.Config.ClonePolicy)
+}
+
+func (u *upstream) configureUploadPackCache() {
+	cache, err := git.NewUploadPackCache(u.Config.UploadPackCache)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configureUploadPackCache")
+	}
+	u.UploadPackCache = cache
+}
+
+func (u *upstream) configureInfoRefsCache() {
+	u.InfoRefsCache = git.NewInfoRefsCache(u.Config.InfoRefsCache)
+}
+
+func (u *upstream) configureArchiveCache() {
+	cache, err := git.NewArchiveCache(u.Config.ArchiveCache)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configureArchiveCache")
+	}
+	u.ArchiveCache = cache
+}
+
+func (u *upstream) configureArchiveWarmer() {
+	warmer, err := git.NewArchiveWarmer(u.Config.ArchiveWarming, u.ArchiveCache)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configureArchiveWarmer")
+	}
+	u.ArchiveWarmer = warmer
+}
+
+func (u *upstream) configurePushInspector() {
+	inspector, err := git.NewPushInspector(u.Config.PushInspection)
+	if err != nil {
+		log.NoContext().WithError(err).Fatal("configurePushInspector")
+	}
+	u.PushInspector = inspector
+}
+
 func (u *upstream) configureURLPrefix() {
 	relativeURLRoot := u.Backend.Path
 	if !strings.HasSuffix(relativeURLRoot, "/") {
@@ -56,8 +137,8 @@ func (u *upstream) configureURLPrefix() {
 }
 
 func (u *upstream) ServeHTTP(ow http.ResponseWriter, r *http.Request) {
-	// Automatic quasi-intelligent X-Forwarded-For parsing
-	r.RemoteAddr = xff.GetRemoteAddr(r)
+	u.ClientIPResolver.SetRemoteAddr(r)
+	r = helper.WithAccessLogFields(r)
 
 	w := helper.NewStatsCollectingResponseWriter(ow)
 	defer w.RequestFinished(r)
@@ -85,13 +166,16 @@ func (u *upstream) ServeHTTP(ow http.ResponseWriter, r *http.Request) {
 	}
 
 	// Look for a matching route
+	routeSpan, _ := opentracing.StartSpanFromContext(r.Context(), "workhorse.route_match")
 	var route *routeEntry
 	for _, ro := range u.Routes {
 		if ro.isMatch(prefix.Strip(URIPath), r) {
 			route = &ro
+			routeSpan.SetTag("route", ro.regexpStr)
 			break
 		}
 	}
+	routeSpan.Finish()
 
 	if route == nil {
 		// The protocol spec in git/Documentation/technical/http-protocol.txt
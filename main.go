@@ -20,16 +20,23 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/proxyprotocol"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redact"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tracing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
 )
 
@@ -41,6 +48,7 @@ var configFile = flag.String("config", "", "TOML file to load config from")
 var listenAddr = flag.String("listenAddr", "localhost:8181", "Listen address for HTTP server")
 var listenNetwork = flag.String("listenNetwork", "tcp", "Listen 'network' (tcp, tcp4, tcp6, unix)")
 var listenUmask = flag.Int("listenUmask", 0, "Umask for Unix socket")
+var listenProxyProtocol = flag.Bool("listenProxyProtocol", false, "Require a PROXY protocol (v1 or v2) header on every connection to listenAddr")
 var authBackend = flag.String("authBackend", upstream.DefaultBackend.String(), "Authentication/authorization backend")
 var authSocket = flag.String("authSocket", "", "Optional: Unix domain socket to dial authBackend at")
 var pprofListenAddr = flag.String("pprofListenAddr", "", "pprof listening address, e.g. 'localhost:6060'")
@@ -52,6 +60,8 @@ var apiLimit = flag.Uint("apiLimit", 0, "Number of API requests allowed at singl
 var apiQueueLimit = flag.Uint("apiQueueLimit", 0, "Number of API requests allowed to be queued")
 var apiQueueTimeout = flag.Duration("apiQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of requests")
 var apiCiLongPollingDuration = flag.Duration("apiCiLongPollingDuration", 50, "Long polling duration for job requesting for runners (default 50s - enabled)")
+var gitUploadPackRequestLimit = flag.Int64("gitUploadPackRequestLimit", 10*1024*1024, "Maximum size in bytes of a git-upload-pack request body (0 - unlimited)")
+var reauthorizationInterval = flag.Duration("reauthorizationInterval", 0, "How often to re-authorize long-running Git and download requests with authBackend (default 0s - disabled)")
 
 var prometheusListenAddr = flag.String("prometheusListenAddr", "", "Prometheus listening address, e.g. 'localhost:9229'")
 
@@ -131,6 +141,9 @@ func main() {
 		APIQueueLimit:            *apiQueueLimit,
 		APIQueueTimeout:          *apiQueueTimeout,
 		APICILongPollingDuration: *apiCiLongPollingDuration,
+		ReauthorizationInterval:  *reauthorizationInterval,
+		UploadPackRequestLimit:   *gitUploadPackRequestLimit,
+		ListenProxyProtocol:      *listenProxyProtocol,
 	}
 
 	if *configFile != "" {
@@ -139,15 +152,104 @@ func main() {
 			logger.WithField("configFile", *configFile).WithError(err).Fatal("Can not load config file")
 		}
 
+		cfg.TrustedProxies = cfgFromFile.TrustedProxies
+		cfg.Redaction = cfgFromFile.Redaction
+		cfg.ClonePolicy = cfgFromFile.ClonePolicy
+		cfg.UploadPackCache = cfgFromFile.UploadPackCache
+		cfg.PushInspection = cfgFromFile.PushInspection
+		cfg.InfoRefsCache = cfgFromFile.InfoRefsCache
+		cfg.Gitaly = cfgFromFile.Gitaly
+		cfg.Archive = cfgFromFile.Archive
+		cfg.ArchiveCache = cfgFromFile.ArchiveCache
+		cfg.ArchiveWarming = cfgFromFile.ArchiveWarming
+		redact.Configure(cfg.Redaction)
+		git.ConfigureArchive(cfg.Archive)
+
+		if err := gitaly.Configure(cfg.Gitaly); err != nil {
+			logger.WithError(err).Fatal("Can not configure Gitaly connections")
+		}
+
 		cfg.Redis = cfgFromFile.Redis
 
 		if cfg.Redis != nil {
 			redis.Configure(cfg.Redis, redis.DefaultDialFunc)
 			go redis.Process()
 		}
+
+		cfg.BruteForce = cfgFromFile.BruteForce
+
+		if cfg.BruteForce != nil && cfg.BruteForce.Shared && cfg.Redis == nil {
+			logger.Fatal("Shared brute-force protection requires a [redis] config section")
+		}
+
+		cfg.Tracing = cfgFromFile.Tracing
+
+		if cfg.Tracing != nil {
+			closer, err := tracing.Initialize(cfg.Tracing, Version)
+			if err != nil {
+				logger.WithError(err).Fatal("Can not initialize tracing")
+			}
+			onShutdown(func() { closer.Close() })
+		}
+	}
+
+	if cfg.ListenProxyProtocol {
+		listener, err = proxyprotocol.NewListener(listener, cfg.TrustedProxies)
+		if err != nil {
+			logger.WithError(err).Fatal("Can not configure PROXY protocol")
+		}
+	}
+
+	if cfg.ArchiveWarming != nil {
+		onShutdown(git.DrainArchiveWarmers)
 	}
 
-	up := wrapRaven(log.InjectCorrelationID(upstream.NewUpstream(cfg)))
+	up := wrapRaven(log.InjectCorrelationID(tracing.InjectTracing(upstream.NewUpstream(cfg))))
+
+	if len(shutdownHooks) > 0 {
+		go shutdownOnSignal()
+	}
+
+	err = http.Serve(listener, up)
+	runShutdownHooks()
+	logger.Fatal(err)
+}
+
+var (
+	shutdownMutex sync.Mutex
+	shutdownHooks []func()
+)
+
+// onShutdown registers fn to run before the process exits, e.g. to flush
+// buffered tracing spans
+func onShutdown(fn func()) {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// runShutdownHooks runs the registered hooks once, latest first
+func runShutdownHooks() {
+	shutdownMutex.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMutex.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// shutdownOnSignal runs the shutdown hooks when the process is asked to
+// terminate, and then lets the signal terminate it
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	log.NoContext().WithField("signal", sig).Print("Shutting down")
+	runShutdownHooks()
 
-	logger.Fatal(http.Serve(listener, up))
+	signal.Reset(sig)
+	syscall.Kill(os.Getpid(), sig.(syscall.Signal))
 }
@@ -14,6 +14,7 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -70,6 +71,33 @@ func TestDeniedClone(t *testing.T) {
 	assert.Error(t, err, "git clone should have failed")
 }
 
+func TestAllowedCloneWithoutGitaly(t *testing.T) {
+	for _, protocol := range []string{"version=0", "version=2"} {
+		t.Run(protocol, func(t *testing.T) {
+			// Prepare clone directory
+			require.NoError(t, os.RemoveAll(scratchDir))
+
+			// Without a Gitaly address workhorse runs git itself
+			ts := testAuthServer(nil, 200, gitOkBody(t))
+			defer ts.Close()
+			ws := startWorkhorseServer(ts.URL)
+			defer ws.Close()
+
+			// Do the git clone
+			cloneCmd := exec.Command("git", "-c", "protocol.version="+strings.TrimPrefix(protocol, "version="), "clone", fmt.Sprintf("%s/%s", ws.URL, testRepo), checkoutDir)
+			out, err := cloneCmd.CombinedOutput()
+			t.Log(string(out))
+			require.NoError(t, err, "git clone")
+
+			logCmd := exec.Command("git", "log", "-1", "--format=%H")
+			logCmd.Dir = checkoutDir
+			out, err = logCmd.Output()
+			require.NoError(t, err, "git log")
+			require.Len(t, strings.TrimSpace(string(out)), 40)
+		})
+	}
+}
+
 func TestDeniedPush(t *testing.T) {
 	// Prepare the test server and backend
 	ts := testAuthServer(nil, 403, "Access denied")
@@ -25,7 +25,7 @@ func wrapRaven(h http.Handler) http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if p := recover(); p != nil {
-					helper.CleanHeadersForRaven(r)
+					helper.CleanRequestForRaven(r)
 					panic(p)
 				}
 			}()